@@ -0,0 +1,115 @@
+package dbfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+)
+
+// CorruptedChunkErr is wrapped by every ChunkCorruptionError.
+var CorruptedChunkErr = fmt.Errorf("corrupted chunk")
+
+// ChunkCorruptionError is returned when the data of a chunk
+// does not match the checksum stored alongside it.
+type ChunkCorruptionError struct {
+	Inode    int
+	Position int
+}
+
+func (e *ChunkCorruptionError) Error() string {
+	return fmt.Sprintf("%s: inode %d, position %d", CorruptedChunkErr, e.Inode, e.Position)
+}
+
+func (e *ChunkCorruptionError) Unwrap() error {
+	return CorruptedChunkErr
+}
+
+func chunkChecksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// verifyChunk checks the data of a chunk against its stored checksum.
+// Chunks written before checksums were introduced have no checksum
+// and are always considered valid.
+func verifyChunk(inode, position int, data, checksum []byte) error {
+	if checksum == nil {
+		return nil
+	}
+	if !bytes.Equal(chunkChecksum(data), checksum) {
+		return &ChunkCorruptionError{Inode: inode, Position: position}
+	}
+	return nil
+}
+
+// SetChecksumVerification enables or disables the checksum verification
+// of chunks read through File.Read. Verification is enabled by default.
+func (fs *FS) SetChecksumVerification(enabled bool) {
+	fs.skipChecksums.Store(!enabled)
+}
+
+// ScrubReport is the result of a Scrub run.
+type ScrubReport struct {
+	// Checked is the number of chunks whose checksum has been verified.
+	Checked int
+	// Unverified is the number of chunks without a stored checksum.
+	Unverified int
+	// Corrupted lists the chunks whose data does not match their checksum.
+	Corrupted []ChunkCorruptionError
+}
+
+const scrubBatchSize = 256
+
+// Scrub verifies the checksum of every chunk in the database.
+// Chunks are read in small batches, each in its own transaction, so
+// a scrub can run in the background alongside the regular use of
+// the file system. It stops early when ctx is cancelled.
+func (fs *FS) Scrub(ctx context.Context) (ScrubReport, error) {
+	var (
+		report       ScrubReport
+		lastInode    = -1
+		lastPosition = -1
+	)
+	for {
+		rows, err := fs.db.QueryxContext(ctx, fs.query(`
+			SELECT inode, position, data, checksum
+			FROM github_dgsb_dbfs_chunks
+			WHERE inode > ? OR (inode = ? AND position > ?)
+			ORDER BY inode, position
+			LIMIT ?`), lastInode, lastInode, lastPosition, scrubBatchSize)
+		if err != nil {
+			return report, fmt.Errorf("cannot query file chunks: %w", err)
+		}
+
+		count := 0
+		for rows.Next() {
+			var data, checksum []byte
+			if err := rows.Scan(&lastInode, &lastPosition, &data, &checksum); err != nil {
+				rows.Close()
+				return report, fmt.Errorf("cannot scan file chunk: %w", err)
+			}
+			count++
+			if checksum == nil {
+				report.Unverified++
+				continue
+			}
+			report.Checked++
+			if err := verifyChunk(lastInode, lastPosition, data, checksum); err != nil {
+				report.Corrupted = append(
+					report.Corrupted, ChunkCorruptionError{Inode: lastInode, Position: lastPosition})
+			}
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return report, fmt.Errorf("cannot iterate over file chunks: %w", err)
+		}
+		if err := rows.Close(); err != nil {
+			return report, fmt.Errorf("cannot close file chunks cursor: %w", err)
+		}
+
+		if count < scrubBatchSize {
+			return report, nil
+		}
+	}
+}
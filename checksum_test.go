@@ -0,0 +1,72 @@
+package dbfs_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"testing"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ChunkChecksums(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "checksums.db")
+	sqliteFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	require.NoError(t, sqliteFS.UpsertFiles(map[string][]byte{
+		"poésie/lamartine/le_lac": []byte(leLac),
+		"a/regular/file":          []byte("bonjour"),
+	}, 64))
+
+	report, err := sqliteFS.Scrub(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, report.Corrupted)
+	require.Zero(t, report.Unverified)
+	require.Equal(t, (len(leLac)+63)/64+1, report.Checked)
+
+	db, err := sqlx.Open(sqliteDriver, dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+
+	var inode int
+	require.NoError(t, db.Get(&inode,
+		"SELECT inode FROM github_dgsb_dbfs_files WHERE full_path = 'poésie/lamartine/le_lac'"))
+	_, err = db.Exec(`
+		UPDATE github_dgsb_dbfs_chunks
+		SET data = zeroblob(size)
+		WHERE inode = ? AND position = 3`, inode)
+	require.NoError(t, err)
+	_, err = db.Exec(`UPDATE github_dgsb_dbfs_chunks SET checksum = NULL WHERE size = 7`)
+	require.NoError(t, err)
+
+	_, err = fs.ReadFile(sqliteFS, "poésie/lamartine/le_lac")
+	require.ErrorIs(t, err, CorruptedChunkErr)
+	var corruption *ChunkCorruptionError
+	require.True(t, errors.As(err, &corruption))
+	require.Equal(t, ChunkCorruptionError{Inode: inode, Position: 3}, *corruption)
+
+	data, err := fs.ReadFile(sqliteFS, "a/regular/file")
+	require.NoError(t, err)
+	require.Equal(t, "bonjour", string(data))
+
+	sqliteFS.SetChecksumVerification(false)
+	data, err = fs.ReadFile(sqliteFS, "poésie/lamartine/le_lac")
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, 64), data[3*64:4*64])
+	sqliteFS.SetChecksumVerification(true)
+
+	report, err = sqliteFS.Scrub(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []ChunkCorruptionError{{Inode: inode, Position: 3}}, report.Corrupted)
+	require.Equal(t, 1, report.Unverified)
+	require.Equal(t, (len(leLac)+63)/64, report.Checked)
+}
@@ -0,0 +1,150 @@
+package dbfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Clone copies the regular file, symbolic link or directory tree src to dst
+// without copying the content of the files: a clone shares the chunks of
+// its source until one of them is written, which gives it chunks of its own.
+// The extended attributes are copied.
+// The missing parent directories of dst are created.
+// An error wrapping fs.ErrExist is returned if dst already exists.
+func (fs *FS) Clone(src, dst string) error {
+	return fs.CloneContext(context.Background(), src, dst)
+}
+
+// CloneContext is Clone honouring the ctx cancellation.
+func (fs *FS) CloneContext(ctx context.Context, src, dst string) error {
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		return fs.clone(ctx, tx, src, dst)
+	})
+}
+
+// Clone copies src to dst sharing their content as FS.Clone does.
+func (t *Tx) Clone(src, dst string) error {
+	return t.fs.clone(t.ctx, t.tx, src, dst)
+}
+
+func (fs *FS) clone(ctx context.Context, tx *sqlx.Tx, src, dst string) error {
+	src, err := cleanPath(src)
+	if err != nil {
+		return err
+	}
+	dst, err = cleanPath(dst)
+	if err != nil {
+		return err
+	}
+	if _, _, err := fs.namei(ctx, tx, src); err != nil {
+		return fmt.Errorf("cannot find inode for %s: %w", src, err)
+	}
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return fmt.Errorf("%w: cannot clone %s inside itself", InvalidPathErr, src)
+	}
+	if _, _, err := fs.namei(ctx, tx, dst); err == nil {
+		return fmt.Errorf("%w: %s", iofs.ErrExist, dst)
+	} else if !errors.Is(err, InodeNotFoundErr) {
+		return err
+	}
+
+	type node struct {
+		inode    int
+		fullPath string
+		ftype    string
+		content  int
+	}
+	children, childrenArgs := underDir("full_path", src)
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT inode, full_path, type, COALESCE(content, inode)
+		FROM github_dgsb_dbfs_files
+		WHERE root = ? AND (full_path = ? OR `+children+`)
+		ORDER BY full_path`), append([]any{fs.rootInode, src}, childrenArgs...)...)
+	if err != nil {
+		return fmt.Errorf("cannot query the tree of %s: %w", src, err)
+	}
+	var nodes []node
+	for rows.Next() {
+		var n node
+		if err := rows.Scan(&n.inode, &n.fullPath, &n.ftype, &n.content); err != nil {
+			rows.Close()
+			return fmt.Errorf("cannot scan the tree of %s: %w", src, err)
+		}
+		nodes = append(nodes, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("cannot iterate over the tree of %s: %w", src, err)
+	}
+
+	for _, n := range nodes {
+		name := dst + strings.TrimPrefix(n.fullPath, src)
+		inode, _, err := fs.addNode(ctx, tx, name, n.ftype)
+		if err != nil {
+			return fmt.Errorf("cannot create clone %s: %w", name, err)
+		}
+		if _, err := tx.ExecContext(ctx, fs.query(`
+			INSERT INTO github_dgsb_dbfs_xattrs (inode, name, value)
+			SELECT ?, name, value FROM github_dgsb_dbfs_xattrs WHERE inode = ?`), inode, n.inode); err != nil {
+			return fmt.Errorf("cannot copy the extended attributes of %s to %s: %w", n.fullPath, name, err)
+		}
+		if n.ftype == DirectoryType {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx,
+			fs.query("UPDATE github_dgsb_dbfs_files SET content = ? WHERE inode = ?"), n.content, inode); err != nil {
+			return fmt.Errorf("cannot share the content of %s with %s: %w", n.fullPath, name, err)
+		}
+		if _, err := tx.ExecContext(ctx, fs.query(`
+			INSERT INTO github_dgsb_dbfs_hashes (inode, algorithm, digest)
+			SELECT ?, algorithm, digest FROM github_dgsb_dbfs_hashes WHERE inode = ?`), inode, n.inode); err != nil {
+			return fmt.Errorf("cannot copy the digests of %s to %s: %w", n.fullPath, name, err)
+		}
+	}
+	return fs.reindexTree(ctx, tx, fs.rootInode, dst)
+}
+
+// unshareContent is called before the chunks of inode are rewritten
+// or deleted. A clone stops sharing the chunks of its source and is
+// left without chunks. A file whose chunks are shared by clones hands
+// them over to its oldest clone which becomes the source of the others.
+func (fs *FS) unshareContent(ctx context.Context, tx *sqlx.Tx, inode int) error {
+	result, err := tx.ExecContext(ctx, fs.query(
+		"UPDATE github_dgsb_dbfs_files SET content = NULL WHERE inode = ? AND content IS NOT NULL"), inode)
+	if err != nil {
+		return fmt.Errorf("cannot unshare the content of inode %d: %w", inode, err)
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("cannot unshare the content of inode %d: %w", inode, err)
+	} else if count > 0 {
+		return nil
+	}
+
+	var heir sql.NullInt64
+	if err := tx.GetContext(ctx, &heir,
+		fs.query("SELECT min(inode) FROM github_dgsb_dbfs_files WHERE content = ?"), inode); err != nil {
+		return fmt.Errorf("cannot query the clones of inode %d: %w", inode, err)
+	}
+	if !heir.Valid {
+		return nil
+	}
+	for _, q := range []string{
+		"UPDATE github_dgsb_dbfs_chunks SET inode = ? WHERE inode = ?",
+		"UPDATE github_dgsb_dbfs_files SET content = ? WHERE content = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, fs.query(q), heir.Int64, inode); err != nil {
+			return fmt.Errorf("cannot hand over the chunks of inode %d to %d: %w", inode, heir.Int64, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx,
+		fs.query("UPDATE github_dgsb_dbfs_files SET content = NULL WHERE inode = ?"), heir.Int64); err != nil {
+		return fmt.Errorf("cannot hand over the chunks of inode %d to %d: %w", inode, heir.Int64, err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package dbfs_test
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"strings"
+	"testing"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Clone(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "clones.db")
+	sqliteFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+	db, err := sqlx.Open(sqliteDriver, dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	chunkCount := func() int {
+		var count int
+		require.NoError(t, db.Get(&count, "SELECT count(1) FROM github_dgsb_dbfs_chunks"))
+		return count
+	}
+
+	baseline := strings.Repeat("baseline ", 100)
+	require.NoError(t, sqliteFS.UpsertFiles(map[string][]byte{
+		"baseline/config": []byte(baseline),
+		"baseline/empty":  {},
+	}, 64))
+	require.NoError(t, sqliteFS.Symlink("config", "baseline/current"))
+	chunks := chunkCount()
+
+	require.NoError(t, sqliteFS.Clone("baseline/config", "staging/config"))
+	require.NoError(t, sqliteFS.Clone("baseline", "prod"))
+	require.NoError(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.Clone("prod/config", "dev/config")
+	}))
+	require.Equal(t, chunks, chunkCount())
+
+	require.ErrorIs(t, sqliteFS.Clone("baseline/config", "prod/config"), fs.ErrExist)
+	require.ErrorIs(t, sqliteFS.Clone("baseline", "baseline/copy"), InvalidPathErr)
+	require.ErrorIs(t, sqliteFS.Clone("missing", "copy"), InodeNotFoundErr)
+
+	expected := map[string][]byte{
+		"baseline":         nil,
+		"baseline/config":  []byte(baseline),
+		"baseline/empty":   {},
+		"baseline/current": []byte("-> config"),
+		"staging":          nil,
+		"staging/config":   []byte(baseline),
+		"prod":             nil,
+		"prod/config":      []byte(baseline),
+		"prod/empty":       {},
+		"prod/current":     []byte("-> config"),
+		"dev":              nil,
+		"dev/config":       []byte(baseline),
+	}
+	require.Equal(t, expected, fsContent(t, sqliteFS))
+	source, err := fs.Stat(sqliteFS, "baseline/config")
+	require.NoError(t, err)
+	clone, err := fs.Stat(sqliteFS, "prod/config")
+	require.NoError(t, err)
+	require.Equal(t, source.Size(), clone.Size())
+	require.Equal(t, source.Sys().(SysInfo).Hashes, clone.Sys().(SysInfo).Hashes)
+	entries, err := fs.ReadDir(sqliteFS, "prod")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	info, err := entries[0].Info()
+	require.NoError(t, err)
+	require.Equal(t, "config", info.Name())
+	require.Equal(t, int64(len(baseline)), info.Size())
+
+	// writing a clone leaves its source and the other clones untouched
+	require.NoError(t, sqliteFS.UpsertFile("staging/config", 64, []byte("staging")))
+	expected["staging/config"] = []byte("staging")
+	require.Equal(t, expected, fsContent(t, sqliteFS))
+	require.Equal(t, chunks+1, chunkCount())
+
+	// writing the source hands its chunks over to its clones
+	require.NoError(t, sqliteFS.UpsertFile("baseline/config", 64, []byte("baseline v2")))
+	expected["baseline/config"] = []byte("baseline v2")
+	require.Equal(t, expected, fsContent(t, sqliteFS))
+	require.Equal(t, chunks+2, chunkCount())
+
+	// deleting the source as well
+	require.NoError(t, sqliteFS.DeleteFile("baseline/config"))
+	delete(expected, "baseline/config")
+	require.NoError(t, sqliteFS.DeleteFile("prod/config"))
+	delete(expected, "prod/config")
+	require.Equal(t, expected, fsContent(t, sqliteFS))
+	require.NoError(t, sqliteFS.DeleteFile("dev/config"))
+	delete(expected, "dev/config")
+	require.Equal(t, expected, fsContent(t, sqliteFS))
+	// the link and the staging file
+	require.Equal(t, 2, chunkCount())
+
+	replica, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, replica.Close())
+	})
+	_, err = NewReplicator("primary", sqliteFS, replica).CatchUp(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, fsContent(t, sqliteFS), fsContent(t, replica))
+
+	report, err := sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Problems)
+	scrub, err := sqliteFS.Scrub(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, scrub.Corrupted)
+}
@@ -0,0 +1,205 @@
+package dbfs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_OpenFileKeepsItsVersion(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(path.Join(t.TempDir(), "version.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	require.NoError(t, sqliteFS.UpsertFile("poésie/lamartine/le_lac", 32, []byte(leLac)))
+
+	f, err := sqliteFS.Open("poésie/lamartine/le_lac")
+	require.NoError(t, err)
+	buf := make([]byte, 100)
+	_, err = io.ReadFull(f, buf)
+	require.NoError(t, err)
+
+	require.NoError(t, sqliteFS.UpsertFile("poésie/lamartine/le_lac", 16, bytes.Repeat([]byte("x"), 2*len(leLac))))
+	rest, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, leLac, string(buf)+string(rest))
+	require.NoError(t, f.Close())
+
+	f, err = sqliteFS.Open("poésie/lamartine/le_lac")
+	require.NoError(t, err)
+	require.NoError(t, sqliteFS.DeleteFile("poésie/lamartine/le_lac"))
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte("x"), 2*len(leLac)), data)
+	require.NoError(t, f.Close())
+
+	_, err = sqliteFS.Open("poésie/lamartine/le_lac")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+}
+
+// Test_ConcurrentReadWrite is meant to be run with the race detector.
+// Every version of a file is made of a single repeated byte so that
+// readers can detect a file mixing several versions.
+func Test_ConcurrentReadWrite(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(path.Join(t.TempDir(), "concurrent.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	const (
+		numFiles   = 4
+		numWriters = 3
+		numReaders = 4
+		iterations = 50
+	)
+	fileName := func(i int) string {
+		return fmt.Sprintf("shared/dir/file-%d", i)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < iterations; i++ {
+				version := byte(w*iterations + i)
+				files := map[string][]byte{}
+				for j := 0; j < 1+rng.Intn(numFiles); j++ {
+					files[fileName(rng.Intn(numFiles))] = bytes.Repeat([]byte{version}, 1+rng.Intn(16384))
+				}
+				assert.NoError(t, sqliteFS.UpsertFiles(files, 512))
+			}
+		}(w)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rng := rand.New(rand.NewSource(42))
+		for i := 0; i < iterations; i++ {
+			err := sqliteFS.DeleteFile(fileName(rng.Intn(numFiles)))
+			if err != nil && !errors.Is(err, InodeNotFoundErr) {
+				assert.NoError(t, err)
+			}
+		}
+	}()
+
+	for r := 0; r < numReaders; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(100 + r)))
+			for i := 0; i < 2*iterations; i++ {
+				f, err := sqliteFS.Open(fileName(rng.Intn(numFiles)))
+				if errors.Is(err, InodeNotFoundErr) {
+					continue
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				fi, err := f.Stat()
+				assert.NoError(t, err)
+
+				// read in small pieces to give the writers a chance to interleave
+				data := []byte{}
+				buf := make([]byte, 1000)
+				for {
+					n, err := f.Read(buf)
+					data = append(data, buf[:n]...)
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if !assert.NoError(t, err) {
+						break
+					}
+				}
+				assert.NoError(t, f.Close())
+
+				assert.Equal(t, fi.Size(), int64(len(data)))
+				if len(data) > 0 {
+					assert.Equal(t, bytes.Repeat(data[:1], len(data)), data, "file mixes several versions")
+				}
+			}
+		}(r)
+	}
+
+	wg.Wait()
+
+	report, err := sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Problems)
+	entries, err := fs.ReadDir(sqliteFS, "shared/dir")
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(entries), numFiles)
+}
+
+func Test_OpenFilesLeaveAConnectionToWriters(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(path.Join(t.TempDir(), "conns.db"), WithMaxOpenConns(3))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+	require.NoError(t, sqliteFS.UpsertFiles(map[string][]byte{
+		"a": []byte("a"),
+		"b": []byte("b"),
+	}, 16))
+
+	// the open file and the view take 2 of the 3 connections
+	fa, err := sqliteFS.Open("a")
+	require.NoError(t, err)
+	view, err := sqliteFS.View()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = sqliteFS.OpenContext(ctx, "b")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	watchCtx, cancelWatch := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelWatch()
+	_, ok := <-sqliteFS.Watch(watchCtx, "")
+	require.False(t, ok)
+
+	// the last connection is left to the writers
+	writeCtx, cancelWrite := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelWrite()
+	require.NoError(t, sqliteFS.UpsertFileContext(writeCtx, "a", 16, []byte("new a")))
+
+	require.NoError(t, view.Close())
+	fb, err := sqliteFS.Open("b")
+	require.NoError(t, err)
+	data, err := io.ReadAll(fa)
+	require.NoError(t, err)
+	require.Equal(t, "a", string(data))
+	require.NoError(t, fa.Close())
+	require.NoError(t, fa.Close())
+	require.NoError(t, fb.Close())
+
+	// the released connections can be held again
+	for i := 0; i < 3; i++ {
+		f, err := sqliteFS.Open("a")
+		require.NoError(t, err)
+		f2, err := sqliteFS.Open("b")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.NoError(t, f2.Close())
+	}
+
+	_, err = NewSqliteFS(path.Join(t.TempDir(), "single.db"), WithMaxOpenConns(1))
+	require.ErrorIs(t, err, TooFewConnsErr)
+}
@@ -0,0 +1,60 @@
+package dbfs_test
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"testing"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ContextCancellation(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = sqliteFS.UpsertFileContext(cancelled, "poésie/lamartine/le_lac", 32, []byte(leLac))
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = fs.Stat(sqliteFS, "poésie/lamartine/le_lac")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+
+	require.NoError(t, sqliteFS.UpsertFileContext(
+		context.Background(), "poésie/lamartine/le_lac", 32, []byte(leLac)))
+
+	_, err = sqliteFS.OpenContext(cancelled, "poésie/lamartine/le_lac")
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = sqliteFS.HashContext(cancelled, "poésie/lamartine/le_lac", SHA256)
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, sqliteFS.DeleteFileContext(cancelled, "poésie/lamartine/le_lac"), context.Canceled)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f, err := sqliteFS.OpenContext(ctx, "poésie/lamartine/le_lac")
+	require.NoError(t, err)
+	buf := make([]byte, 64)
+	_, err = io.ReadFull(f, buf)
+	require.NoError(t, err)
+	require.Equal(t, leLac[:64], string(buf))
+	cancel()
+	_, err = f.Read(buf)
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoError(t, f.Close())
+
+	ctx, cancel = context.WithCancel(context.Background())
+	d, err := sqliteFS.OpenContext(ctx, "poésie")
+	require.NoError(t, err)
+	cancel()
+	_, err = d.(fs.ReadDirFile).ReadDir(-1)
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoError(t, d.Close())
+
+	data, err := fs.ReadFile(sqliteFS, "poésie/lamartine/le_lac")
+	require.NoError(t, err)
+	require.Equal(t, leLac, string(data))
+}
@@ -1,31 +1,72 @@
-// Package dbfs implement the fs.FS over a sqlite3 database backend.
+// Package dbfs implement the fs.FS over a sqlite3 or a PostgreSQL database backend.
 // This is mostly a write once read many file system.
 // This package has an upsert file like function but fs.FS
 // interface only provides an Open method.
-// So the implementation does not expect to have concurrent read and update.
+//
+// An FS is safe for concurrent use, including by several processes
+// sharing the same database file. The database is run in WAL mode so
+// that readers do not block writers. Each opened File holds a read
+// transaction until it is closed so it keeps seeing the version of
+// the file it has opened even if the file is overwritten or deleted
+// in the meantime. Files should then be closed as soon as possible.
+// A ReadView extends this guarantee to all the files opened through it.
+//
+// sqlite is accessed with the cgo driver github.com/mattn/go-sqlite3.
+// Building with the dbfs_purego tag replaces it with the pure Go driver
+// modernc.org/sqlite, for instance to cross compile static binaries.
+//
+// NewSqliteFS(":memory:") does not keep the database in memory: it is
+// stored in a file of a temporary directory, under os.TempDir, which
+// is removed when the file system is closed.
 package dbfs
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type FS struct {
 	db             *sqlx.DB
+	dialect        dialect
+	tablePrefix    string
+	chunkSize      int
 	rootInode      int
+	volume         string
 	readChunksStmt *sqlx.NamedStmt
 	fileSizeStmt   *sqlx.Stmt
 	nameiStmt      *sqlx.Stmt
+	skipChecksums  atomic.Bool
+	readOnly       bool
+	// ownsDB is false when the database handle has been given to New.
+	ownsDB bool
+	// shared is true for a volume opened by OpenVolume whose database
+	// and statements belong to the FS it has been opened from.
+	shared bool
+	// tempDir holds the database of an FS created with the :memory: name.
+	tempDir string
+	// heldConns counts the connections held by the open files, the views
+	// and the watchers when the pool is bounded, nil otherwise.
+	heldConns chan struct{}
+	// fullTextStates caches the *fullTextState of the running
+	// write transactions, keyed by their *sqlx.Tx.
+	fullTextStates sync.Map
 }
 
 var (
@@ -33,39 +74,155 @@ var (
 	InodeNotFoundErr = fmt.Errorf("cannot find inode")
 	IncorrectTypeErr = fmt.Errorf("incorrect file type")
 	DirNotEmptyErr   = fmt.Errorf("directory is not empty")
+	TooFewConnsErr   = fmt.Errorf("at least 2 database connections are needed")
 )
 
 const (
 	DirectoryType   = "d"
 	RegularFileType = "f"
+	SymlinkType     = "l"
 )
 
 // NewSqliteFS creates a new sqlite based file system
 // The dbName parameter is the database file to open.
 // If it does not exist yet it will be created and the schema migration will be run.
-func NewSqliteFS(dbName string) (*FS, error) {
-	db, err := sqlx.Open("sqlite3", dbName)
+// The special :memory: name creates a private database in a temporary
+// file which is removed when the file system is closed. A real sqlite
+// memory database cannot be used as each connection of the pool
+// would see its own distinct database.
+// The options tune the database connections and the file system.
+func NewSqliteFS(dbName string, opts ...Option) (*FS, error) {
+	cfg, err := newConfig(opts)
 	if err != nil {
-		return nil, fmt.Errorf("canot open the database: %w", err)
+		return nil, err
 	}
-	err = runMigrations(db)
+
+	fs := &FS{dialect: sqliteDialect{}}
+	if dbName == ":memory:" {
+		dir, err := os.MkdirTemp("", "dbfs-*")
+		if err != nil {
+			return nil, fmt.Errorf("cannot create temporary directory: %w", err)
+		}
+		fs.tempDir = dir
+		dbName = filepath.Join(dir, "memory.db")
+	}
+
+	db, err := sqlx.Open(sqliteDriverName, sqliteDSN(dbName, cfg))
 	if err != nil {
+		err = fmt.Errorf("canot open the database: %w", err)
+		if fs.tempDir != "" {
+			if removeErr := os.RemoveAll(fs.tempDir); removeErr != nil {
+				err = multierror.Append(err, removeErr)
+			}
+		}
 		return nil, err
 	}
-	if _, err := db.Exec("PRAGMA foreign_key = ON"); err != nil {
-		return nil, fmt.Errorf("cannot activate foreign keys check: %w", err)
+	fs.ownsDB = true
+	for _, setup := range cfg.pool {
+		setup(db.DB)
+	}
+	if err := fs.init(db, cfg); err != nil {
+		return nil, multierror.Append(err, fs.Close())
 	}
+	return fs, nil
+}
 
-	fs := &FS{db: db}
-	row := db.QueryRow(`
-		SELECT inode
-		FROM github_dgsb_dbfs_files
-		WHERE fname = '/' AND parent IS NULL`)
+// sqliteDSN adds to dbName the connection parameters of cfg applied
+// to every connection of the pool, including the foreign keys check.
+func sqliteDSN(dbName string, cfg config) string {
+	var params []string
+	if cfg.readOnly {
+		params = append(params, "mode=ro")
+	}
+	if cfg.immutable {
+		params = append(params, "immutable=1")
+	}
+	if len(params) > 0 && !strings.HasPrefix(dbName, "file:") {
+		// the sqlite open parameters are only read from URI file names
+		dbName = "file:" + dbName
+	}
+
+	if !cfg.readOnly {
+		// changing the journal mode writes to the database
+		params = append(params, sqlitePragma("journal_mode", cfg.journalMode))
+	}
+	params = append(params,
+		sqlitePragma("busy_timeout", strconv.FormatInt(cfg.busyTimeout.Milliseconds(), 10)),
+		sqlitePragma("foreign_keys", "1"))
+	if cfg.synchronous != "" {
+		params = append(params, sqlitePragma("synchronous", cfg.synchronous))
+	}
+	if cfg.cacheSize != 0 {
+		params = append(params, sqlitePragma("cache_size", strconv.Itoa(cfg.cacheSize)))
+	}
+
+	separator := "?"
+	if strings.Contains(dbName, "?") {
+		separator = "&"
+	}
+	return dbName + separator + strings.Join(params, "&")
+}
+
+// New creates a file system in the database db already opened by the caller,
+// next to the tables of the application. The sqlite driver selected at
+// build time and the postgres driver are supported. A sqlite database
+// should be opened in WAL mode, with a busy timeout and the foreign keys
+// check enabled. Closing the file system does not close db.
+func New(db *sql.DB, opts ...Option) (*FS, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	d, driverName, err := dialectOf(db)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &FS{dialect: d}
+	if err := fs.init(sqlx.NewDb(db, driverName), cfg); err != nil {
+		return nil, multierror.Append(err, fs.Close())
+	}
+	return fs, nil
+}
+
+// init migrates the database schema and prepares the statements of fs.
+func (fs *FS) init(db *sqlx.DB, cfg config) error {
+	fs.db = db
+	fs.tablePrefix = cfg.tablePrefix
+	fs.chunkSize = cfg.chunkSize
+	fs.readOnly = cfg.readOnly
+	if maxConns := db.Stats().MaxOpenConnections; maxConns > 0 {
+		if maxConns < 2 {
+			return fmt.Errorf("cannot use a pool of %d connection: %w", maxConns, TooFewConnsErr)
+		}
+		// one connection is kept for the writers
+		fs.heldConns = make(chan struct{}, maxConns-1)
+	}
+	switch {
+	case cfg.migrate && cfg.readOnly:
+		if err := fs.verifyMigrations(); err != nil {
+			return err
+		}
+	case cfg.migrate:
+		if err := fs.migrate(context.Background()); err != nil {
+			return err
+		}
+	default:
+		if _, err := fs.SchemaVersion(); err != nil {
+			return err
+		}
+	}
+	var err error
+	fs.volume = DefaultVolume
+	row := db.QueryRow(fs.query("SELECT root FROM github_dgsb_dbfs_volumes WHERE name = ?"), fs.volume)
 	if err := row.Scan(&fs.rootInode); err != nil {
-		return nil, fmt.Errorf("no root inode: %w %w", InodeNotFoundErr, err)
+		return fmt.Errorf("no root inode: %w %w", InodeNotFoundErr, err)
+	}
+	if err := fs.setupFullText(cfg); err != nil {
+		return err
 	}
 
-	fs.readChunksStmt, err = fs.db.PrepareNamed(`
+	fs.readChunksStmt, err = fs.db.PrepareNamed(fs.query(`
 		WITH offsets AS (
 			SELECT
 				COALESCE(
@@ -82,38 +239,70 @@ func NewSqliteFS(dbName string) (*FS, error) {
 			github_dgsb_dbfs_chunks.position,
 			data,
 			size,
-			start
+			start,
+			checksum
 		FROM github_dgsb_dbfs_chunks JOIN offsets USING (position)
 		WHERE inode = :inode
 			AND :offset < start + size
-			AND :offset + :size >= start
-		ORDER BY github_dgsb_dbfs_chunks.position`)
+			AND :offset >= start - :size
+		ORDER BY github_dgsb_dbfs_chunks.position`))
 	if err != nil {
-		return nil, fmt.Errorf("cannot prepare chunk reader statement: %w", err)
+		return fmt.Errorf("cannot prepare chunk reader statement: %w", err)
 	}
 
-	fs.fileSizeStmt, err = fs.db.Preparex(
-		"SELECT COALESCE(sum(size), 0) FROM github_dgsb_dbfs_chunks WHERE inode = ?")
+	fs.fileSizeStmt, err = fs.db.Preparex(fs.query(
+		"SELECT COALESCE(sum(size), 0) FROM github_dgsb_dbfs_chunks WHERE inode = ?"))
 	if err != nil {
-		return nil, fmt.Errorf("cannot prepare file size statement: %w", err)
+		return fmt.Errorf("cannot prepare file size statement: %w", err)
 	}
 
-	fs.nameiStmt, err = fs.db.Preparex(`
+	fs.nameiStmt, err = fs.db.Preparex(fs.query(`
 		SELECT inode, type
 		FROM github_dgsb_dbfs_files 
-		WHERE full_path = ?`)
+		WHERE root = ? AND full_path = ?`))
 	if err != nil {
-		return nil, fmt.Errorf("cannot prepare namei statement: %w", err)
+		return fmt.Errorf("cannot prepare namei statement: %w", err)
 	}
 
-	return fs, nil
+	return nil
 }
 
 func (f *FS) Close() error {
-	return f.db.Close()
+	if f.shared {
+		return nil
+	}
+	var err error
+	closeStmt := func(stmt io.Closer) {
+		if closeErr := stmt.Close(); closeErr != nil {
+			err = multierror.Append(err, closeErr)
+		}
+	}
+	if f.readChunksStmt != nil {
+		closeStmt(f.readChunksStmt)
+	}
+	if f.fileSizeStmt != nil {
+		closeStmt(f.fileSizeStmt)
+	}
+	if f.nameiStmt != nil {
+		closeStmt(f.nameiStmt)
+	}
+	if f.ownsDB {
+		if closeErr := f.db.Close(); closeErr != nil {
+			err = multierror.Append(err, closeErr)
+		}
+	}
+	if f.tempDir != "" {
+		if rmErr := os.RemoveAll(f.tempDir); rmErr != nil {
+			err = multierror.Append(err, rmErr)
+		}
+	}
+	return err
 }
 
-func (f *FS) addRegularFileNode(tx *sqlx.Tx, fname string) (int, error) {
+// addNode looks up the node fname of type ftype, creating it
+// and its missing parent directories if needed.
+// The returned boolean reports whether the node has been created.
+func (f *FS) addNode(ctx context.Context, tx *sqlx.Tx, fname string, nodeType string) (int, bool, error) {
 	components := strings.Split(fname, "/")
 	var parentInode = f.rootInode
 	for i, searchMode := 0, true; i < len(components); i++ {
@@ -122,21 +311,21 @@ func (f *FS) addRegularFileNode(tx *sqlx.Tx, fname string) (int, error) {
 				inode int
 				ftype string
 			)
-			row := tx.QueryRowx(
-				"SELECT inode, type FROM github_dgsb_dbfs_files WHERE fname = ? AND parent = ?",
+			row := tx.QueryRowxContext(ctx,
+				f.query("SELECT inode, type FROM github_dgsb_dbfs_files WHERE fname = ? AND parent = ?"),
 				components[i], parentInode)
 			err := row.Scan(&inode, &ftype)
 			if err == nil {
 				parentInode = inode
 				if (i < len(components)-1 && ftype != DirectoryType) ||
-					(i == len(components)-1 && ftype != RegularFileType) {
-					return 0, fmt.Errorf(
+					(i == len(components)-1 && ftype != nodeType) {
+					return 0, false, fmt.Errorf(
 						"%w: %s %s", IncorrectTypeErr, "/"+strings.Join(components[:i+1], "/"), ftype)
 				}
 				continue
 			}
 			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, fmt.Errorf("cannot query files table: %w", err)
+				return 0, false, fmt.Errorf("cannot query files table: %w", err)
 			}
 			searchMode = false
 		}
@@ -145,80 +334,282 @@ func (f *FS) addRegularFileNode(tx *sqlx.Tx, fname string) (int, error) {
 			if i < len(components)-1 {
 				return DirectoryType
 			}
-			return RegularFileType
+			return nodeType
 		}()
-		row := tx.QueryRow(`
-			INSERT INTO github_dgsb_dbfs_files (fname, full_path, parent, type)
-			VALUES (?, ?, ?, ?)
-			RETURNING inode`, components[i], path.Join(components[:i+1]...), parentInode, componentType)
+		generation, err := f.nextGeneration(ctx, tx)
+		if err != nil {
+			return 0, false, err
+		}
+		row := tx.QueryRowContext(ctx, f.query(`
+			INSERT INTO github_dgsb_dbfs_files (fname, full_path, parent, type, root, modified_at, generation)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			RETURNING inode`),
+			components[i], path.Join(components[:i+1]...), parentInode, componentType, f.rootInode,
+			time.Now().UnixMilli(), generation)
 		if err := row.Scan(&parentInode); err != nil {
-			return 0, fmt.Errorf(
+			return 0, false, fmt.Errorf(
 				"cannot insert node %s as child of %d: %w", components[i], parentInode, err)
 		}
+		if err := f.logChange(ctx, tx, CreateEvent, parentInode, path.Join(components[:i+1]...), "", componentType); err != nil {
+			return 0, false, err
+		}
+		if i == len(components)-1 {
+			return parentInode, true, nil
+		}
 	}
 
-	return parentInode, nil
+	return parentInode, false, nil
 }
 
+// UpsertStatus reports what an upsert did to a file.
+type UpsertStatus string
+
+const (
+	// Created is reported for a file which did not exist.
+	Created UpsertStatus = "created"
+	// Updated is reported for an existing file whose content has changed.
+	Updated UpsertStatus = "updated"
+	// Unchanged is reported for an existing file which already had the same content.
+	Unchanged UpsertStatus = "unchanged"
+)
+
 // UpsertFile inserts or updates a file with the data content given as parameter.
-// The file data will be split in chunkSize.
+// The file data will be split in chunkSize, or in the chunk size
+// of the file system if chunkSize is lower or equal to 0.
 // Files in the database can have different chunk sizes.
-func (fs *FS) UpsertFile(fname string, chunkSize int, data []byte) (ret error) {
-	return fs.UpsertFiles(map[string][]byte{fname: data}, chunkSize)
+// The write only happens if all the preconditions hold,
+// a ConflictErr is returned otherwise.
+func (fs *FS) UpsertFile(fname string, chunkSize int, data []byte, conds ...Precondition) (ret error) {
+	return fs.UpsertFileContext(context.Background(), fname, chunkSize, data, conds...)
+}
+
+// UpsertFileContext is UpsertFile honouring the ctx cancellation.
+func (fs *FS) UpsertFileContext(
+	ctx context.Context, fname string, chunkSize int, data []byte, conds ...Precondition,
+) error {
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := fs.writeFile(ctx, tx, fname, chunkSize, data, conds...)
+		return err
+	})
 }
 
 // UpsertFiles inserts or updates many files atomically.
 // The files parameter is map whose string is the name of the file to upsert
 // and the []byte value is the data to be associated with this file.
 func (fs *FS) UpsertFiles(files map[string][]byte, chunkSize int) (ret error) {
+	return fs.UpsertFilesContext(context.Background(), files, chunkSize)
+}
+
+// UpsertFilesContext is UpsertFiles honouring the ctx cancellation.
+func (fs *FS) UpsertFilesContext(ctx context.Context, files map[string][]byte, chunkSize int) error {
+	_, err := fs.UpsertFilesWithStatusContext(ctx, files, chunkSize)
+	return err
+}
+
+// UpsertFilesWithStatus behaves as UpsertFiles and reports for every
+// file whether it has been created, updated or left unchanged.
+// Files whose content is identical to the stored one are not rewritten
+// and only the chunks which differ are rewritten for updated files.
+// The content is compared with the stored chunk checksums without reading
+// the stored data: a chunk corrupted behind the file system keeps its
+// checksum and is not repaired by writing the same content again.
+// Scrub reports such chunks. Deleting the file before writing it
+// again replaces all its chunks.
+func (fs *FS) UpsertFilesWithStatus(
+	files map[string][]byte, chunkSize int,
+) (map[string]UpsertStatus, error) {
+	return fs.UpsertFilesWithStatusContext(context.Background(), files, chunkSize)
+}
+
+// UpsertFilesWithStatusContext is UpsertFilesWithStatus honouring the ctx cancellation.
+func (fs *FS) UpsertFilesWithStatusContext(
+	ctx context.Context, files map[string][]byte, chunkSize int,
+) (status map[string]UpsertStatus, ret error) {
+
+	status = make(map[string]UpsertStatus, len(files))
+	if err := fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		for fname, data := range files {
+			fileStatus, err := fs.writeFile(ctx, tx, fname, chunkSize, data)
+			if err != nil {
+				return err
+			}
+			status[fname] = fileStatus
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// writeFile stores data as the content of the regular file fname.
+func (fs *FS) writeFile(
+	ctx context.Context, tx *sqlx.Tx, fname string, chunkSize int, data []byte, conds ...Precondition,
+) (UpsertStatus, error) {
+	return fs.writeNode(ctx, tx, fname, RegularFileType, chunkSize, data, conds...)
+}
 
-	tx, err := fs.db.Beginx()
+// writeNode stores data as the content of the node fname of type ftype,
+// a regular file or the target of a symbolic link.
+func (fs *FS) writeNode(
+	ctx context.Context, tx *sqlx.Tx, fname string, ftype string, chunkSize int, data []byte, conds ...Precondition,
+) (UpsertStatus, error) {
+	fname, err := cleanPath(fname)
 	if err != nil {
-		return fmt.Errorf("cannot start transaction: %w", err)
+		return "", err
+	}
+	if err := fs.checkPreconditions(ctx, tx, fname, conds); err != nil {
+		return "", err
+	}
+
+	inode, created, err := fs.addNode(ctx, tx, fname, ftype)
+	if err != nil {
+		return "", fmt.Errorf("cannot insert file node: %w", err)
 	}
-	defer func() {
-		if err != nil {
-			ret = multierror.Append(ret, tx.Rollback())
-		} else {
-			ret = tx.Commit()
-		}
-	}()
 
-	for fname, data := range files {
-		if path.IsAbs(fname) {
-			return fmt.Errorf("%w: %s", InvalidPathErr, fname)
+	digests := hashData(data)
+	if !created {
+		var stored []byte
+		row := tx.QueryRowxContext(ctx,
+			fs.query("SELECT digest FROM github_dgsb_dbfs_hashes WHERE inode = ? AND algorithm = ?"), inode, SHA256)
+		if err := row.Scan(&stored); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("cannot query stored digest of %s: %w", fname, err)
 		}
-		fname = path.Clean(fname)
+		if bytes.Equal(stored, digests[SHA256]) {
+			return Unchanged, nil
+		}
+	}
 
-		inode, err := fs.addRegularFileNode(tx, fname)
-		if err != nil {
-			return fmt.Errorf("cannot insert file node: %w", err)
+	if chunkSize <= 0 {
+		chunkSize = fs.chunkSize
+	}
+	// the index entry is removed with the content it has been added with
+	if err := fs.unindexContent(ctx, tx, inode); err != nil {
+		return "", err
+	}
+	if err := fs.unshareContent(ctx, tx, inode); err != nil {
+		return "", err
+	}
+	if err := fs.writeChunks(ctx, tx, inode, chunkSize, data); err != nil {
+		return "", fmt.Errorf("cannot write chunks of %s: %w", fname, err)
+	}
+
+	if err := fs.writeHashes(ctx, tx, inode, digests); err != nil {
+		return "", err
+	}
+	if ftype == RegularFileType {
+		if err := fs.indexContent(ctx, tx, inode, fname, data); err != nil {
+			return "", err
 		}
+	}
+
+	if created {
+		return Created, nil
+	}
+	if err := fs.bumpGeneration(ctx, tx, inode); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx,
+		fs.query("UPDATE github_dgsb_dbfs_files SET modified_at = ? WHERE inode = ?"),
+		time.Now().UnixMilli(), inode); err != nil {
+		return "", fmt.Errorf("cannot update modification time of %s: %w", fname, err)
+	}
+	if err := fs.logChange(ctx, tx, ModifyEvent, inode, fname, "", ftype); err != nil {
+		return "", err
+	}
+	return Updated, nil
+}
 
-		if _, err := tx.Exec(`DELETE FROM github_dgsb_dbfs_chunks WHERE inode = ?`, inode); err != nil {
-			return fmt.Errorf("cannot delete previous chunks of the same file %s: %w", fname, err)
+// writeChunks replaces the chunks of inode with data split in chunkSize.
+// Chunks already stored at the same position with the same size and
+// checksum are left untouched.
+func (fs *FS) writeChunks(ctx context.Context, tx *sqlx.Tx, inode int, chunkSize int, data []byte) error {
+	type storedChunk struct {
+		size     int
+		checksum []byte
+	}
+	stored := map[int]storedChunk{}
+	rows, err := tx.QueryxContext(ctx,
+		fs.query("SELECT position, size, checksum FROM github_dgsb_dbfs_chunks WHERE inode = ?"), inode)
+	if err != nil {
+		return fmt.Errorf("cannot query stored chunks: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			position int
+			chunk    storedChunk
+		)
+		if err := rows.Scan(&position, &chunk.size, &chunk.checksum); err != nil {
+			return fmt.Errorf("cannot scan stored chunk: %w", err)
 		}
+		stored[position] = chunk
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("cannot iterate over stored chunks: %w", err)
+	}
 
-		for i, position := 0, 0; i < len(data); i, position = i+chunkSize, position+1 {
-			toWrite := func() int {
-				remaining := len(data) - i
-				if remaining < chunkSize {
-					return remaining
-				}
-				return chunkSize
-			}()
-			_, err := tx.Exec(`
-			INSERT INTO github_dgsb_dbfs_chunks (inode, position, data, size)
-			VALUES (?, ?, ?, ?)`, inode, position, data[i:i+toWrite], toWrite)
-			if err != nil {
-				return fmt.Errorf("cannot insert file chunk in database: %w", err)
+	position := 0
+	for i := 0; i < len(data); i, position = i+chunkSize, position+1 {
+		toWrite := func() int {
+			remaining := len(data) - i
+			if remaining < chunkSize {
+				return remaining
 			}
+			return chunkSize
+		}()
+		checksum := chunkChecksum(data[i : i+toWrite])
+		if chunk, ok := stored[position]; ok && chunk.size == toWrite && bytes.Equal(chunk.checksum, checksum) {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, fs.query(`
+			INSERT INTO github_dgsb_dbfs_chunks (inode, position, data, size, checksum)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (inode, position) DO UPDATE SET
+				data = excluded.data,
+				size = excluded.size,
+				checksum = excluded.checksum`),
+			inode, position, data[i:i+toWrite], toWrite, checksum)
+		if err != nil {
+			return fmt.Errorf("cannot insert file chunk in database: %w", err)
 		}
 	}
+
+	if _, err := tx.ExecContext(ctx,
+		fs.query("DELETE FROM github_dgsb_dbfs_chunks WHERE inode = ? AND position >= ?"), inode, position); err != nil {
+		return fmt.Errorf("cannot delete trailing chunks: %w", err)
+	}
+
 	return nil
 }
 
-func (fs *FS) namei(tx *sqlx.Tx, fname string) (int, string, error) {
+// underDir returns the SQL condition selecting the paths of column which
+// are under the directory dir, with its arguments. dirLength is the length
+// of dir as counted by substr.
+func underDir(column, dir string) (string, []any) {
+	return "substr(" + column + ", 1, ?) = ?", []any{dirLength(dir) + 1, dir + "/"}
+}
+
+// dirLength returns the length of dir as counted by the sqlite substr
+// function, which counts characters and not bytes.
+func dirLength(dir string) int {
+	return utf8.RuneCountInString(dir)
+}
+
+// cleanPath validates and cleans the name of a file to be modified.
+// The root directory cannot be modified.
+func cleanPath(fname string) (string, error) {
+	if path.IsAbs(fname) {
+		return "", fmt.Errorf("%w: %s", InvalidPathErr, fname)
+	}
+	cleaned := path.Clean(fname)
+	if cleaned == "." || !fs.ValidPath(cleaned) {
+		return "", fmt.Errorf("%w: %s", InvalidPathErr, fname)
+	}
+	return cleaned, nil
+}
+
+func (fs *FS) namei(ctx context.Context, tx *sqlx.Tx, fname string) (int, string, error) {
 	if path.IsAbs(fname) {
 		return 0, "", fmt.Errorf("%w: %s", InvalidPathErr, fname)
 	}
@@ -230,7 +621,7 @@ func (fs *FS) namei(tx *sqlx.Tx, fname string) (int, string, error) {
 		ftype string
 	)
 
-	row := tx.Stmtx(fs.nameiStmt).QueryRowx(fname)
+	row := tx.StmtxContext(ctx, fs.nameiStmt).QueryRowxContext(ctx, fs.rootInode, fname)
 	if err := row.Scan(&inode, &ftype); errors.Is(err, sql.ErrNoRows) {
 		return 0, "", fmt.Errorf("%w: %s", InodeNotFoundErr, fname)
 	} else if err != nil {
@@ -240,87 +631,175 @@ func (fs *FS) namei(tx *sqlx.Tx, fname string) (int, string, error) {
 	return inode, ftype, nil
 }
 
-func (fsys *FS) DeleteFile(fname string) (ret error) {
-	tx, err := fsys.db.Beginx()
+// DeleteFile deletes a regular file or an empty directory.
+// The deletion only happens if all the preconditions hold,
+// a ConflictErr is returned otherwise.
+func (fsys *FS) DeleteFile(fname string, conds ...Precondition) (ret error) {
+	return fsys.DeleteFileContext(context.Background(), fname, conds...)
+}
+
+// DeleteFileContext is DeleteFile honouring the ctx cancellation.
+func (fsys *FS) DeleteFileContext(ctx context.Context, fname string, conds ...Precondition) error {
+	return fsys.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		return fsys.deleteFile(ctx, tx, fname, conds...)
+	})
+}
+
+func (fsys *FS) deleteFile(ctx context.Context, tx *sqlx.Tx, fname string, conds ...Precondition) error {
+	fname, err := cleanPath(fname)
 	if err != nil {
-		return fmt.Errorf("cannot start transaction: %w", err)
+		return err
 	}
-	defer func() {
-		if ret == nil {
-			ret = tx.Commit()
-		} else {
-			ret = multierror.Append(ret, tx.Rollback())
-		}
-	}()
-
-	inode, _, err := fsys.namei(tx, fname)
+	if err := fsys.checkPreconditions(ctx, tx, fname, conds); err != nil {
+		return err
+	}
+	inode, ftype, err := fsys.namei(ctx, tx, fname)
 	if err != nil {
 		return fmt.Errorf("cannot find inode for %s: %w", fname, err)
 	}
 
 	// Check this is not a directory tree with children
 	var childCount int
-	row := tx.QueryRow("SELECT count(1) FROM github_dgsb_dbfs_files WHERE parent = ?", inode)
+	row := tx.QueryRowContext(ctx, fsys.query("SELECT count(1) FROM github_dgsb_dbfs_files WHERE parent = ?"), inode)
 	if err := row.Scan(&childCount); err != nil {
 		return fmt.Errorf("cannot count children: %w", err)
 	}
 	if childCount > 0 {
-		return fmt.Errorf("%w: %s", err, fname)
+		return fmt.Errorf("%w: %s", DirNotEmptyErr, fname)
 	}
 
-	if _, err := tx.Exec("DELETE FROM github_dgsb_dbfs_chunks WHERE inode = ?", inode); err != nil {
+	if err := fsys.unindexContent(ctx, tx, inode); err != nil {
+		return err
+	}
+	if err := fsys.unshareContent(ctx, tx, inode); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fsys.query("DELETE FROM github_dgsb_dbfs_chunks WHERE inode = ?"), inode); err != nil {
 		return fmt.Errorf("cannot delete file chunks: %w", err)
 	}
 
-	if _, err := tx.Exec("DELETE FROM github_dgsb_dbfs_files WHERE inode = ?", inode); err != nil {
+	if _, err := tx.ExecContext(ctx, fsys.query("DELETE FROM github_dgsb_dbfs_hashes WHERE inode = ?"), inode); err != nil {
+		return fmt.Errorf("cannot delete file hashes: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, fsys.query("DELETE FROM github_dgsb_dbfs_xattrs WHERE inode = ?"), inode); err != nil {
+		return fmt.Errorf("cannot delete extended attributes: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, fsys.query("DELETE FROM github_dgsb_dbfs_files WHERE inode = ?"), inode); err != nil {
 		return fmt.Errorf("cannot delete file entry: %w", err)
 	}
 
-	return nil
+	return fsys.logChange(ctx, tx, DeleteEvent, inode, fname, "", ftype)
 }
 
-func (fsys *FS) Open(fname string) (retFile fs.File, retError error) {
+func (fsys *FS) Open(fname string) (fs.File, error) {
+	return fsys.OpenContext(context.Background(), fname)
+}
 
+// OpenContext opens the named file for reading.
+// The returned File issues all its queries with ctx so that
+// reading can be bounded by the deadline of the caller.
+// The File holds a read transaction, and so a connection of the pool,
+// until it is closed: it keeps reading the content it had when opened.
+// When the pool is bounded, by WithMaxOpenConns or by the db given to New,
+// the open files, the views and the watchers hold at most all the
+// connections but one, which is left to the writers. OpenContext then
+// waits for a file to be closed, or for ctx to be done, before opening.
+func (fsys *FS) OpenContext(ctx context.Context, fname string) (retFile fs.File, retError error) {
 	if !fs.ValidPath(fname) {
 		return nil, fmt.Errorf("path to open is invalid: %s", fname)
 	}
-	f := &File{fs: fsys, name: fname}
 
-	if strings.HasPrefix(fname, "./") {
-		fname, _ = strings.CutPrefix(fname, ".")
+	tx, err := fsys.beginHeldRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
 	}
-	fname = path.Clean(fname)
+	defer func() {
+		if retError != nil {
+			tx.Rollback()
+			fsys.releaseConn()
+		}
+	}()
 
-	tx, err := fsys.db.Beginx()
+	f, err := fsys.openFile(ctx, tx, fname)
 	if err != nil {
-		fmt.Errorf("cannot start transaction: %w", err)
+		return nil, err
 	}
-	defer tx.Commit()
+	f.ownsTx = true
+	return f, nil
+}
+
+// openFile opens fname reading it through tx.
+// The symbolic links are followed.
+func (fsys *FS) openFile(ctx context.Context, tx *sqlx.Tx, fname string) (*File, error) {
+	return fsys.openNode(ctx, tx, fname, true)
+}
 
-	inode, ftype, err := fsys.namei(tx, fname)
+// openNode opens fname reading it through tx. The symbolic links met
+// in the parent directories are followed, fname itself is only followed
+// if follow is true.
+func (fsys *FS) openNode(ctx context.Context, tx *sqlx.Tx, fname string, follow bool) (*File, error) {
+	if !fs.ValidPath(fname) {
+		return nil, fmt.Errorf("path to open is invalid: %s", fname)
+	}
+	f := &File{fs: fsys, ctx: ctx, tx: tx, name: fname}
+
+	if strings.HasPrefix(fname, "./") {
+		fname, _ = strings.CutPrefix(fname, ".")
+	}
+	fname = path.Clean(fname)
+
+	inode, ftype, err := fsys.resolve(ctx, tx, fname, follow)
 	if err != nil {
 		return nil, fmt.Errorf("namei on %s: %w", fname, err)
 	}
 	f.inode = inode
 	f.ftype = ftype
 
-	row := tx.Stmtx(fsys.fileSizeStmt).QueryRowx(f.inode)
+	row := tx.QueryRowxContext(ctx, fsys.query(`
+		SELECT generation, COALESCE(content, inode), COALESCE(modified_at, 0)
+		FROM github_dgsb_dbfs_files
+		WHERE inode = ?`), f.inode)
+	if err := row.Scan(&f.generation, &f.content, &f.modifiedAt); err != nil {
+		return nil, fmt.Errorf("cannot query generation of %s: %w", fname, err)
+	}
+
+	row = tx.StmtxContext(ctx, fsys.fileSizeStmt).QueryRowxContext(ctx, f.content)
 	if err := row.Scan(&f.size); err != nil {
 		return nil, fmt.Errorf("file chunks not found: %d, %w", inode, err)
 	}
 
+	if f.hashes, err = fsys.readHashes(ctx, tx, f.inode); err != nil {
+		return nil, err
+	}
+
 	return f, nil
 }
 
 type File struct {
 	fs     *FS
+	ctx    context.Context
+	tx     *sqlx.Tx
+	ownsTx bool
 	ftype  string
 	name   string
 	inode  int
-	offset int64
-	size   int64
-	closed bool
-	eof    bool
+	// content is the inode whose chunks hold the content of the file,
+	// the inode of the source of a clone which has not been written yet.
+	content    int
+	offset     int64
+	size       int64
+	hashes     map[HashAlgorithm][]byte
+	generation int64
+	// modifiedAt is the last modification time in unix milliseconds.
+	modifiedAt int64
+	closed     bool
+	eof        bool
+	// chunk is the last chunk read, starting at offset chunkStart in the file.
+	// It serves the small reads without querying the database again.
+	chunk      []byte
+	chunkStart int64
 }
 
 func (f *File) Read(out []byte) (int, error) {
@@ -340,31 +819,47 @@ func (f *File) Read(out []byte) (int, error) {
 		return b
 	}(f.size-f.offset, int64(len(out)))
 
-	rows, err := f.fs.readChunksStmt.Queryx(map[string]interface{}{
-		"inode":  f.inode,
+	copied := int64(0)
+	if f.offset >= f.chunkStart && f.offset < f.chunkStart+int64(len(f.chunk)) {
+		numByte := int64(copy(out[:toRead], f.chunk[f.offset-f.chunkStart:]))
+		copied += numByte
+		f.offset += numByte
+		if copied >= toRead {
+			return int(copied), nil
+		}
+	}
+
+	rows, err := f.tx.NamedStmtContext(f.ctx, f.fs.readChunksStmt).QueryxContext(f.ctx, map[string]interface{}{
+		"inode":  f.content,
 		"offset": f.offset,
-		"size":   toRead,
+		"size":   toRead - copied,
 	})
 	if err != nil {
 		return 0, fmt.Errorf("cannot query the database: %w", err)
 	}
 	defer rows.Close()
 
-	copied := int64(0)
 	for rows.Next() {
 		var (
 			position int
 			buf      []byte
 			size     int64
 			offset   int64
+			checksum []byte
 		)
-		if err := rows.Scan(&position, &buf, &size, &offset); err != nil {
+		if err := rows.Scan(&position, &buf, &size, &offset, &checksum); err != nil {
 			return 0, fmt.Errorf("cannot retrieve file chunk: %w", err)
 		}
+		if !f.fs.skipChecksums.Load() {
+			if err := verifyChunk(f.content, position, buf, checksum); err != nil {
+				return 0, err
+			}
+		}
 
-		numByte := int64(copy(out[copied:], buf[f.offset-offset:]))
+		numByte := int64(copy(out[copied:toRead], buf[f.offset-offset:]))
 		copied += numByte
 		f.offset += numByte
+		f.chunk, f.chunkStart = buf, offset
 		if copied >= toRead {
 			break
 		}
@@ -373,20 +868,39 @@ func (f *File) Read(out []byte) (int, error) {
 		return 0, fmt.Errorf("cannot iterate over file chunks: %w", err)
 	}
 
-	return int(toRead), nil
+	return int(copied), nil
 }
 
+// Close releases the read transaction held by the file.
 func (f *File) Close() error {
+	fsys := f.fs
 	f.fs = nil
 	f.closed = true
+	f.chunk = nil
+	if f.tx != nil && f.ownsTx {
+		tx := f.tx
+		f.tx = nil
+		// The transaction is already rolled back if the context has been cancelled.
+		err := tx.Rollback()
+		fsys.releaseConn()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			return fmt.Errorf("cannot release read transaction: %w", err)
+		}
+	}
 	return nil
 }
 
 func (f *File) Stat() (fs.FileInfo, error) {
 	return FileInfo{
-		name:  f.name,
-		size:  f.size,
-		ftype: f.ftype,
+		name:    f.name,
+		size:    f.size,
+		ftype:   f.ftype,
+		modTime: time.UnixMilli(f.modifiedAt),
+		sys: SysInfo{
+			Inode:      f.inode,
+			Hashes:     f.hashes,
+			Generation: f.generation,
+		},
 	}, nil
 }
 
@@ -402,28 +916,33 @@ func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
 	}
 	query := `
 		SELECT
-			github_dgsb_dbfs_files.inode,
-			fname,
-			type,
-			SUM(COALESCE(size, 0)) size
-		FROM github_dgsb_dbfs_files LEFT JOIN github_dgsb_dbfs_chunks USING (inode)
-		WHERE parent = ? AND inode > ?
-		GROUP BY github_dgsb_dbfs_files.inode, fname, type
-		ORDER BY inode`
+			f.inode,
+			f.fname,
+			f.type,
+			f.generation,
+			COALESCE(f.modified_at, 0),
+			SUM(COALESCE(c.size, 0)) AS size
+		FROM github_dgsb_dbfs_files f
+			LEFT JOIN github_dgsb_dbfs_chunks c ON c.inode = COALESCE(f.content, f.inode)
+		WHERE f.parent = ? AND f.inode > ?
+		GROUP BY f.inode, f.fname, f.type, f.generation, f.modified_at
+		ORDER BY f.inode`
 	if n > 0 {
 		query += fmt.Sprintf(` LIMIT %d`, n)
 	}
-	rows, err := f.fs.db.Queryx(query, f.inode, f.offset)
+	rows, err := f.tx.QueryxContext(f.ctx, f.fs.query(query), f.inode, f.offset)
 	if err != nil {
 		return []fs.DirEntry{}, fmt.Errorf("cannot not query file table: %w", err)
 	}
 	defer rows.Close()
 
+	after := int(f.offset)
 	files := []File{}
 	for rows.Next() {
 		var entry File
 
-		if err := rows.Scan(&entry.inode, &entry.name, &entry.ftype, &entry.size); err != nil {
+		if err := rows.Scan(
+			&entry.inode, &entry.name, &entry.ftype, &entry.generation, &entry.modifiedAt, &entry.size); err != nil {
 			return []fs.DirEntry{}, fmt.Errorf("cannot scan database row: %w", err)
 		}
 		files = append(files, entry)
@@ -433,6 +952,18 @@ func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
 		return []fs.DirEntry{}, fmt.Errorf("cannot browse file table: %w", err)
 	}
 
+	if len(files) > 0 {
+		hashes, err := f.fs.readChildrenHashes(f.ctx, f.tx, f.inode, after, int(f.offset))
+		if err != nil {
+			return []fs.DirEntry{}, err
+		}
+		for i := range files {
+			if files[i].hashes = hashes[files[i].inode]; files[i].hashes == nil {
+				files[i].hashes = map[HashAlgorithm][]byte{}
+			}
+		}
+	}
+
 	entries := make([]fs.DirEntry, 0, len(files))
 	for _, v := range files {
 		if fi, err := v.Stat(); err != nil {
@@ -450,9 +981,24 @@ func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
 }
 
 type FileInfo struct {
-	name  string
-	ftype string
-	size  int64
+	name    string
+	ftype   string
+	size    int64
+	modTime time.Time
+	sys     SysInfo
+}
+
+// SysInfo is the underlying data source of a FileInfo
+// as returned by its Sys method.
+type SysInfo struct {
+	Inode int
+	// Hashes holds the whole file digests computed at write time.
+	Hashes map[HashAlgorithm][]byte
+	// Generation changes on every change of the file. The generations
+	// only increase across the database, a file deleted and created
+	// again never gets back a generation it had.
+	// It is the value expected by the IfMatch precondition.
+	Generation int64
 }
 
 func (fi FileInfo) Name() string {
@@ -467,12 +1013,18 @@ func (fi FileInfo) Mode() fs.FileMode {
 	if fi.ftype == DirectoryType {
 		return 0444 | fs.ModeDir
 	}
+	if fi.ftype == SymlinkType {
+		return 0444 | fs.ModeSymlink
+	}
 
 	return 0444
 }
 
+// ModTime returns the time the content of a file or a link has last been
+// written or the time a directory has been created. It is the unix epoch
+// for the nodes whose modification time is not known.
 func (fi FileInfo) ModTime() time.Time {
-	return time.Unix(0, 0)
+	return fi.modTime
 }
 
 func (fi FileInfo) IsDir() bool {
@@ -480,5 +1032,5 @@ func (fi FileInfo) IsDir() bool {
 }
 
 func (fi FileInfo) Sys() any {
-	return nil
+	return fi.sys
 }
@@ -1,6 +1,7 @@
 package dbfs_test
 
 import (
+	"context"
 	_ "embed"
 	"io/fs"
 	"math/rand"
@@ -13,19 +14,13 @@ import (
 	"testing/quick"
 
 	. "github.com/dgsb/dbfs"
-	"github.com/mattn/go-sqlite3"
+	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/require"
 )
 
 //go:embed testdata/le_lac.txt
 var leLac string
 
-func TestSqlite3Version(t *testing.T) {
-	_, num, _ := sqlite3.Version()
-	require.Equal(t, 3, num/1000_000)
-	require.Equal(t, 42, (num%1000_000)/1000)
-}
-
 func Test_FSCreate(t *testing.T) {
 	fs, err := NewSqliteFS(":memory:")
 	require.NoError(t, err)
@@ -68,6 +63,9 @@ func Test_DeleteFile(t *testing.T) {
 	sqliteFS, err := NewSqliteFS(":memory:")
 	require.NoError(t, err)
 	require.NotNil(t, sqliteFS)
+	t.Cleanup(func() {
+		sqliteFS.Close()
+	})
 
 	err = sqliteFS.UpsertFile("a/test/file/to/delete/later", 2, []byte("just something"))
 	require.NoError(t, err)
@@ -82,6 +80,91 @@ func Test_DeleteFile(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func Test_UpsertFilesWithStatus(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "upsert.db")
+	sqliteFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	status, err := sqliteFS.UpsertFilesWithStatus(map[string][]byte{
+		"a/file":       []byte("0123456789"),
+		"another/file": []byte("bonjour"),
+	}, 4)
+	require.NoError(t, err)
+	require.Equal(t, map[string]UpsertStatus{"a/file": Created, "another/file": Created}, status)
+
+	// Zero the first chunk behind the file system back keeping its checksum:
+	// the stored data is not read, so the chunk is only rewritten once its
+	// expected content changes or once the file has been deleted.
+	db, err := sqlx.Open(sqliteDriver, dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	_, err = db.Exec(`
+		UPDATE github_dgsb_dbfs_chunks
+		SET data = zeroblob(size)
+		WHERE position = 0
+			AND inode = (SELECT inode FROM github_dgsb_dbfs_files WHERE full_path = 'a/file')`)
+	require.NoError(t, err)
+
+	status, err = sqliteFS.UpsertFilesWithStatus(map[string][]byte{
+		"a/file":       []byte("0123abcd"),
+		"another/file": []byte("bonjour"),
+		"new/file":     []byte("hello"),
+	}, 4)
+	require.NoError(t, err)
+	require.Equal(t, map[string]UpsertStatus{
+		"a/file":       Updated,
+		"another/file": Unchanged,
+		"new/file":     Created,
+	}, status)
+
+	_, err = fs.ReadFile(sqliteFS, "a/file")
+	require.ErrorIs(t, err, CorruptedChunkErr)
+
+	status, err = sqliteFS.UpsertFilesWithStatus(map[string][]byte{"a/file": []byte("wxyzabcd")}, 4)
+	require.NoError(t, err)
+	require.Equal(t, map[string]UpsertStatus{"a/file": Updated}, status)
+	data, err := fs.ReadFile(sqliteFS, "a/file")
+	require.NoError(t, err)
+	require.Equal(t, "wxyzabcd", string(data))
+
+	var chunks int
+	require.NoError(t, db.Get(&chunks, `
+		SELECT count(1)
+		FROM github_dgsb_dbfs_chunks
+		WHERE inode = (SELECT inode FROM github_dgsb_dbfs_files WHERE full_path = 'a/file')`))
+	require.Equal(t, 2, chunks)
+
+	_, err = db.Exec(`
+		UPDATE github_dgsb_dbfs_chunks
+		SET data = zeroblob(size)
+		WHERE position = 0
+			AND inode = (SELECT inode FROM github_dgsb_dbfs_files WHERE full_path = 'a/file')`)
+	require.NoError(t, err)
+	status, err = sqliteFS.UpsertFilesWithStatus(map[string][]byte{"a/file": []byte("wxyzabcd")}, 4)
+	require.NoError(t, err)
+	require.Equal(t, map[string]UpsertStatus{"a/file": Unchanged}, status)
+	report, err := sqliteFS.Scrub(context.Background())
+	require.NoError(t, err)
+	require.Len(t, report.Corrupted, 1)
+	require.NoError(t, sqliteFS.DeleteFile("a/file"))
+	status, err = sqliteFS.UpsertFilesWithStatus(map[string][]byte{"a/file": []byte("wxyzabcd")}, 4)
+	require.NoError(t, err)
+	require.Equal(t, map[string]UpsertStatus{"a/file": Created}, status)
+	data, err = fs.ReadFile(sqliteFS, "a/file")
+	require.NoError(t, err)
+	require.Equal(t, "wxyzabcd", string(data))
+
+	_, err = sqliteFS.UpsertFilesWithStatus(map[string][]byte{"a/file/below": []byte("x")}, 4)
+	require.ErrorIs(t, err, IncorrectTypeErr)
+	_, err = fs.Stat(sqliteFS, "new/file")
+	require.NoError(t, err)
+}
+
 func TestCompliance_EmptyFS(t *testing.T) {
 	sqlitefs, err := NewSqliteFS(":memory:")
 	require.NoError(t, err)
@@ -211,7 +294,7 @@ func TestQuick(t *testing.T) {
 			case deleteOp:
 				require.NoError(t, fsys.DeleteFile(o.Path))
 			case checkOp:
-				require.NoError(t, fstest.TestFS(fsys, existingFilesArray...))
+				require.NoError(t, fstest.TestFS(fsys, expectedEntries(t, fsys, existingFilesArray)...))
 				for k, v := range existingFilesMap {
 					data, err := fs.ReadFile(fsys, k)
 					require.NoError(t, err)
@@ -223,7 +306,7 @@ func TestQuick(t *testing.T) {
 			MaxCount: 200,
 			Values:   generator,
 		})
-		require.NoError(t, fstest.TestFS(fsys, existingFilesArray...))
+		require.NoError(t, fstest.TestFS(fsys, expectedEntries(t, fsys, existingFilesArray)...))
 		for k, v := range existingFilesMap {
 			data, err := fs.ReadFile(fsys, k)
 			require.NoError(t, err)
@@ -232,6 +315,22 @@ func TestQuick(t *testing.T) {
 	})
 }
 
+// expectedEntries returns the names TestFS must find in fsys: the existing
+// files or, when all of them have been deleted, the directories they left
+// behind since TestFS requires an empty file system when given no name.
+func expectedEntries(t *testing.T, fsys fs.FS, files []string) []string {
+	if len(files) > 0 {
+		return files
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	require.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
 func generateData(b *testing.B) ([]string, map[string][]byte) {
 	files := map[string][]byte{}
 	fileList := []string{}
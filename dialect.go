@@ -0,0 +1,118 @@
+package dbfs
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/GuiaBolso/darwin"
+	"github.com/jmoiron/sqlx"
+)
+
+// dialect isolates what differs between the supported databases.
+// The queries of the package are written for sqlite with ? placeholders
+// and are adapted to the database by FS.query.
+type dialect interface {
+	// bindType is the sqlx placeholder style of the database driver.
+	bindType() int
+	// migrationDialect is the darwin dialect recording the applied migrations.
+	migrationDialect() darwin.Dialect
+	// migrationDir is the directory of the embedded migration scripts.
+	migrationDir() string
+	// writeLockQuery takes the database write lock for the rest of the transaction.
+	writeLockQuery() string
+	// changeVersionQuery returns a number which changes when another
+	// connection may have committed a change.
+	changeVersionQuery() string
+	// readTxOptions are the options of the read transactions
+	// which must see a single snapshot of the database.
+	readTxOptions() *sql.TxOptions
+	// isBusy reports whether err is a transient locking error
+	// after which the transaction can be retried.
+	isBusy(err error) bool
+	// fullTextIndexQueries create the full text index of the files.
+	// They are nil when the database has no full text index.
+	fullTextIndexQueries() []string
+}
+
+// query adapts q, written for sqlite with the default table prefix,
+// to the database and the tables of fs.
+func (fs *FS) query(q string) string {
+	if fs.tablePrefix != defaultTablePrefix {
+		q = strings.ReplaceAll(q, defaultTablePrefix, fs.tablePrefix)
+	}
+	return sqlx.Rebind(fs.dialect.bindType(), q)
+}
+
+// dialectOf returns the dialect and the sqlx driver name of db.
+func dialectOf(db *sql.DB) (dialect, string, error) {
+	switch drv := db.Driver(); {
+	case isSqliteDriver(drv):
+		return sqliteDialect{}, sqliteDriverName, nil
+	case isPostgresDriver(drv):
+		return postgresDialect{}, "postgres", nil
+	default:
+		return nil, "", fmt.Errorf("unsupported database driver %T", drv)
+	}
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) bindType() int {
+	return sqlx.QUESTION
+}
+
+func (sqliteDialect) migrationDialect() darwin.Dialect {
+	return darwin.SqliteDialect{}
+}
+
+func (sqliteDialect) migrationDir() string {
+	return "migrations"
+}
+
+// writeLockQuery is a dummy write. sqlite transactions are started in
+// deferred mode and only take the write lock on their first write.
+func (sqliteDialect) writeLockQuery() string {
+	return "UPDATE github_dgsb_dbfs_files SET inode = inode WHERE 0"
+}
+
+// changeVersionQuery relies on data_version which only changes
+// on commits made by other connections.
+func (sqliteDialect) changeVersionQuery() string {
+	return "PRAGMA data_version"
+}
+
+// readTxOptions is nil as sqlite transactions are always serializable.
+func (sqliteDialect) readTxOptions() *sql.TxOptions {
+	return nil
+}
+
+func (sqliteDialect) isBusy(err error) bool {
+	return isSqliteBusy(err)
+}
+
+// fullTextIndexQueries create an FTS5 table whose rowid is the inode of
+// the indexed file. It is an external content table reading the content
+// of the files from their chunks, through a view of the indexed files,
+// so the index does not hold a second copy of the files. The chunks are
+// concatenated in the order of their positions, given by the subquery.
+func (sqliteDialect) fullTextIndexQueries() []string {
+	return []string{
+		`CREATE VIEW github_dgsb_dbfs_fulltext_content AS
+		SELECT i.inode AS inode, (
+			SELECT group_concat(c.data, '') FROM (
+				SELECT data FROM github_dgsb_dbfs_chunks
+				WHERE inode = COALESCE(f.content, f.inode)
+				ORDER BY position
+			) c
+		) AS content
+		FROM github_dgsb_dbfs_fulltext_files i
+			JOIN github_dgsb_dbfs_files f ON f.inode = i.inode`,
+		`CREATE VIRTUAL TABLE github_dgsb_dbfs_fulltext USING fts5(
+			content,
+			content = 'github_dgsb_dbfs_fulltext_content',
+			content_rowid = 'inode',
+			tokenize = 'unicode61 remove_diacritics 2'
+		)`,
+	}
+}
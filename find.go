@@ -0,0 +1,275 @@
+package dbfs
+
+import (
+	"context"
+	"fmt"
+	iofs "io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// defaultFindPageSize is the number of nodes read at once by a FindIterator
+// when the Query does not give a page size.
+const defaultFindPageSize = 256
+
+// Query selects the nodes returned by Find. The zero value of each field
+// does not restrict the result, the nodes match all the given conditions.
+type Query struct {
+	// Prefix restricts the result to the nodes under the directory Prefix.
+	Prefix string
+	// Pattern is a path.Match pattern the full path of the nodes must match.
+	Pattern string
+	// Types restricts the result to the nodes of these types.
+	Types []string
+	// MinSize and MaxSize bound the size of the nodes, inclusive.
+	MinSize, MaxSize *int64
+	// ModifiedAfter and ModifiedBefore bound the modification
+	// time of the nodes, inclusive.
+	ModifiedAfter, ModifiedBefore time.Time
+	// Xattrs are conditions on the extended attributes of the nodes.
+	Xattrs []XattrCondition
+	// After resumes a previous search after the node of this path.
+	After string
+	// PageSize is the number of nodes read from the database at once.
+	PageSize int
+}
+
+// XattrCondition requires the extended attribute Name to be set,
+// with the value Value unless Value is nil.
+type XattrCondition struct {
+	Name  string
+	Value []byte
+}
+
+// FindIterator walks over the nodes selected by Find in the order of their path.
+// Each page of nodes is read in a read transaction of its own so a long
+// iteration does not hold a transaction, the nodes changed while iterating
+// may or may not be returned.
+type FindIterator struct {
+	fs     *FS
+	ctx    context.Context
+	query  Query
+	page   []FileInfo
+	last   string
+	done   bool
+	err    error
+	info   FileInfo
+	prefix string
+}
+
+// Find returns an iterator over the nodes matching q.
+// The errors found in q are reported by the Err method of the iterator.
+func (fs *FS) Find(ctx context.Context, q Query) *FindIterator {
+	it := &FindIterator{fs: fs, ctx: ctx, query: q, last: q.After}
+	if it.query.PageSize <= 0 {
+		it.query.PageSize = defaultFindPageSize
+	}
+	if q.Prefix != "" && q.Prefix != "." {
+		if it.prefix, it.err = cleanPath(q.Prefix); it.err != nil {
+			it.done = true
+		}
+	}
+	if q.Pattern != "" {
+		if _, err := path.Match(q.Pattern, ""); err != nil {
+			it.err = fmt.Errorf("invalid pattern %s: %w", q.Pattern, err)
+			it.done = true
+		}
+	}
+	return it
+}
+
+// Next advances to the next node. It returns false at the end
+// of the result or on error, Err tells them apart.
+func (it *FindIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done {
+			return false
+		}
+		if err := it.readPage(); err != nil {
+			it.err = err
+			it.done = true
+			return false
+		}
+	}
+	it.info, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Path returns the full path of the current node.
+// It can be given as Query.After to resume the search after this node.
+func (it *FindIterator) Path() string {
+	return it.info.name
+}
+
+// Info returns the FileInfo of the current node.
+func (it *FindIterator) Info() iofs.FileInfo {
+	return it.info
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *FindIterator) Err() error {
+	return it.err
+}
+
+// readPage reads the next nodes matching the query. The nodes rejected
+// by the pattern, which is only approximated in SQL, are skipped.
+func (it *FindIterator) readPage() error {
+	fs := it.fs
+	tx, err := fs.beginRead(it.ctx)
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query, args := it.sql()
+	rows, err := tx.QueryxContext(it.ctx, fs.query(query), args...)
+	if err != nil {
+		return fmt.Errorf("cannot query files table: %w", err)
+	}
+	var page []FileInfo
+	for rows.Next() {
+		var (
+			info       FileInfo
+			modifiedAt int64
+		)
+		if err := rows.Scan(
+			&info.sys.Inode, &info.name, &info.ftype, &info.sys.Generation, &modifiedAt, &info.size); err != nil {
+			rows.Close()
+			return fmt.Errorf("cannot scan files table: %w", err)
+		}
+		info.modTime = time.UnixMilli(modifiedAt)
+		page = append(page, info)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("cannot iterate over files table: %w", err)
+	}
+
+	if len(page) < it.query.PageSize {
+		it.done = true
+	}
+	if len(page) > 0 {
+		it.last = page[len(page)-1].name
+	}
+	for _, info := range page {
+		if it.query.Pattern != "" {
+			if matched, _ := path.Match(it.query.Pattern, info.name); !matched {
+				continue
+			}
+		}
+		if info.sys.Hashes, err = fs.readHashes(it.ctx, tx, info.sys.Inode); err != nil {
+			return err
+		}
+		it.page = append(it.page, info)
+	}
+	return nil
+}
+
+// sql returns the query reading the next page of nodes and its arguments.
+func (it *FindIterator) sql() (string, []any) {
+	q := it.query
+	conditions := []string{"f.root = ?", "f.inode <> ?", "f.full_path > ?"}
+	args := []any{it.fs.rootInode, it.fs.rootInode, it.last}
+
+	if it.prefix != "" {
+		children, childrenArgs := underDir("f.full_path", it.prefix)
+		conditions = append(conditions, children)
+		args = append(args, childrenArgs...)
+	}
+	if q.Pattern != "" {
+		conditions = append(conditions, `f.full_path LIKE ? ESCAPE '\'`)
+		args = append(args, globToLike(q.Pattern))
+	}
+	if len(q.Types) > 0 {
+		conditions = append(conditions, "f.type IN (?"+strings.Repeat(", ?", len(q.Types)-1)+")")
+		for _, ftype := range q.Types {
+			args = append(args, ftype)
+		}
+	}
+	if !q.ModifiedAfter.IsZero() {
+		conditions = append(conditions, "COALESCE(f.modified_at, 0) >= ?")
+		args = append(args, q.ModifiedAfter.UnixMilli())
+	}
+	if !q.ModifiedBefore.IsZero() {
+		conditions = append(conditions, "COALESCE(f.modified_at, 0) <= ?")
+		args = append(args, q.ModifiedBefore.UnixMilli())
+	}
+	for _, cond := range q.Xattrs {
+		if cond.Value == nil {
+			conditions = append(conditions, `EXISTS (
+				SELECT 1 FROM github_dgsb_dbfs_xattrs x WHERE x.inode = f.inode AND x.name = ?)`)
+			args = append(args, cond.Name)
+		} else {
+			conditions = append(conditions, `EXISTS (
+				SELECT 1 FROM github_dgsb_dbfs_xattrs x WHERE x.inode = f.inode AND x.name = ? AND x.value = ?)`)
+			args = append(args, cond.Name, cond.Value)
+		}
+	}
+
+	sizeConditions := []string{"1 = 1"}
+	if q.MinSize != nil {
+		sizeConditions = append(sizeConditions, "size >= ?")
+		args = append(args, *q.MinSize)
+	}
+	if q.MaxSize != nil {
+		sizeConditions = append(sizeConditions, "size <= ?")
+		args = append(args, *q.MaxSize)
+	}
+	args = append(args, q.PageSize)
+
+	return `
+		SELECT inode, full_path, type, generation, modified_at, size
+		FROM (
+			SELECT
+				f.inode,
+				f.full_path,
+				f.type,
+				f.generation,
+				COALESCE(f.modified_at, 0) AS modified_at,
+				(
+					SELECT COALESCE(sum(c.size), 0)
+					FROM github_dgsb_dbfs_chunks c
+					WHERE c.inode = COALESCE(f.content, f.inode)
+				) AS size
+			FROM github_dgsb_dbfs_files f
+			WHERE ` + strings.Join(conditions, " AND ") + `
+		) nodes
+		WHERE ` + strings.Join(sizeConditions, " AND ") + `
+		ORDER BY full_path
+		LIMIT ?`, args
+}
+
+// globToLike returns a LIKE pattern matching at least
+// the paths matched by the path.Match pattern.
+func globToLike(pattern string) string {
+	var like strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			like.WriteByte('%')
+		case '?':
+			like.WriteByte('_')
+		case '[':
+			// a character class matches a single character
+			like.WriteByte('_')
+			for i < len(pattern) && pattern[i] != ']' {
+				if pattern[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			fallthrough
+		default:
+			if c := pattern[i]; c == '%' || c == '_' || c == '\\' {
+				like.WriteByte('\\')
+			}
+			like.WriteByte(pattern[i])
+		}
+	}
+	return like.String()
+}
@@ -0,0 +1,130 @@
+package dbfs_test
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+// findPaths returns the paths of all the nodes found by q.
+func findPaths(t *testing.T, fsys *FS, q Query) []string {
+	paths := []string{}
+	it := fsys.Find(context.Background(), q)
+	for it.Next() {
+		paths = append(paths, it.Path())
+	}
+	require.NoError(t, it.Err())
+	return paths
+}
+
+func Test_Find(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(path.Join(t.TempDir(), "find.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	files := map[string][]byte{
+		"docs/readme.md":       []byte("readme"),
+		"docs/guide/intro.md":  []byte("introduction"),
+		"docs/guide/setup.txt": []byte("setup"),
+		"docs_old/readme.md":   []byte("old"),
+		"src/main.go":          []byte("package main"),
+		"src/100%_done.go":     []byte("package main // done"),
+	}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("logs/%02d.log", i)] = make([]byte, i*10)
+	}
+	require.NoError(t, sqliteFS.UpsertFiles(files, 16))
+	require.NoError(t, sqliteFS.Symlink("readme.md", "docs/index.md"))
+	require.NoError(t, sqliteFS.SetXattr("docs/readme.md", "owner", []byte("docs-team")))
+	require.NoError(t, sqliteFS.SetXattr("docs/guide/intro.md", "owner", []byte("alice")))
+	require.NoError(t, sqliteFS.SetXattr("src/main.go", "commit", []byte("4687ed1")))
+
+	// the modification times are recorded in milliseconds
+	time.Sleep(5 * time.Millisecond)
+	before := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, sqliteFS.UpsertFile("docs/guide/setup.txt", 16, []byte("setup v2")))
+	info, err := fs.Stat(sqliteFS, "docs/guide/setup.txt")
+	require.NoError(t, err)
+	require.True(t, info.ModTime().After(before))
+	info, err = fs.Stat(sqliteFS, "docs/readme.md")
+	require.NoError(t, err)
+	require.True(t, info.ModTime().Before(before))
+
+	require.Len(t, findPaths(t, sqliteFS, Query{}), len(files)+6)
+	require.Equal(t, []string{
+		"docs/guide", "docs/guide/intro.md", "docs/guide/setup.txt", "docs/index.md", "docs/readme.md",
+	}, findPaths(t, sqliteFS, Query{Prefix: "docs"}))
+	require.Equal(t, []string{"docs/index.md", "docs/readme.md", "docs_old/readme.md"},
+		findPaths(t, sqliteFS, Query{Pattern: "*/*.md"}))
+	require.Equal(t, []string{"docs/readme.md", "docs_old/readme.md"},
+		findPaths(t, sqliteFS, Query{Pattern: "*/*.md", Types: []string{RegularFileType}}))
+	require.Equal(t, []string{"docs/index.md"}, findPaths(t, sqliteFS, Query{Types: []string{SymlinkType}}))
+	require.Equal(t, []string{"docs", "docs/guide", "docs_old", "logs", "src"},
+		findPaths(t, sqliteFS, Query{Types: []string{DirectoryType}}))
+	require.Equal(t, []string{"src/100%_done.go"}, findPaths(t, sqliteFS, Query{Pattern: "src/*%_*"}))
+	require.Equal(t, []string{"logs/01.log", "logs/11.log"}, findPaths(t, sqliteFS, Query{Pattern: "logs/[01]1.log"}))
+	require.Equal(t, []string{"docs/guide/setup.txt"},
+		findPaths(t, sqliteFS, Query{ModifiedAfter: before}))
+	require.NotContains(t, findPaths(t, sqliteFS, Query{ModifiedBefore: before}), "docs/guide/setup.txt")
+
+	minSize, maxSize := int64(150), int64(170)
+	require.Equal(t, []string{"logs/15.log", "logs/16.log", "logs/17.log"},
+		findPaths(t, sqliteFS, Query{MinSize: &minSize, MaxSize: &maxSize}))
+	empty := int64(0)
+	require.Equal(t, []string{"logs/00.log"},
+		findPaths(t, sqliteFS, Query{MaxSize: &empty, Types: []string{RegularFileType}}))
+
+	require.Equal(t, []string{"docs/guide/intro.md", "docs/readme.md"},
+		findPaths(t, sqliteFS, Query{Xattrs: []XattrCondition{{Name: "owner"}}}))
+	require.Equal(t, []string{"docs/guide/intro.md"},
+		findPaths(t, sqliteFS, Query{Xattrs: []XattrCondition{{Name: "owner", Value: []byte("alice")}}}))
+	require.Empty(t, findPaths(t, sqliteFS, Query{Xattrs: []XattrCondition{
+		{Name: "owner", Value: []byte("alice")}, {Name: "commit"},
+	}}))
+
+	// the iteration goes on page after page and can be resumed
+	logs := findPaths(t, sqliteFS, Query{Prefix: "logs", PageSize: 3})
+	require.Len(t, logs, 20)
+	require.Equal(t, logs, findPaths(t, sqliteFS, Query{Pattern: "logs/*.log", PageSize: 7}))
+	it := sqliteFS.Find(context.Background(), Query{Prefix: "logs", PageSize: 4})
+	for i := 0; i < 5; i++ {
+		require.True(t, it.Next())
+		require.Equal(t, logs[i], it.Path())
+		require.Equal(t, path.Base(logs[i]), it.Info().Name())
+		require.Equal(t, int64(i*10), it.Info().Size())
+	}
+	require.Equal(t, logs[5:], findPaths(t, sqliteFS, Query{Prefix: "logs", After: it.Path()}))
+
+	// the FileInfo of the result is the one of Stat
+	it = sqliteFS.Find(context.Background(), Query{Prefix: "docs/guide"})
+	for it.Next() {
+		info, err := fs.Stat(sqliteFS, it.Path())
+		require.NoError(t, err)
+		require.Equal(t, info.Mode(), it.Info().Mode())
+		require.Equal(t, info.Size(), it.Info().Size())
+		require.Equal(t, info.ModTime(), it.Info().ModTime())
+		require.Equal(t, info.Sys(), it.Info().Sys())
+	}
+	require.NoError(t, it.Err())
+
+	it = sqliteFS.Find(context.Background(), Query{Pattern: "[docs"})
+	require.False(t, it.Next())
+	require.ErrorIs(t, it.Err(), path.ErrBadPattern)
+	it = sqliteFS.Find(context.Background(), Query{Prefix: "../docs"})
+	require.False(t, it.Next())
+	require.ErrorIs(t, it.Err(), InvalidPathErr)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	it = sqliteFS.Find(ctx, Query{})
+	require.False(t, it.Next())
+	require.ErrorIs(t, it.Err(), context.Canceled)
+}
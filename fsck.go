@@ -0,0 +1,570 @@
+package dbfs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/jmoiron/sqlx"
+)
+
+// ProblemKind identifies the class of inconsistency found by Check.
+type ProblemKind string
+
+const (
+	// OrphanChunk is a chunk row whose inode does not exist in the files table.
+	OrphanChunk ProblemKind = "orphan-chunk"
+	// ChunkGap is a file whose chunk positions are not a contiguous sequence starting at 0.
+	ChunkGap ProblemKind = "chunk-gap"
+	// DuplicateChunk is a file having several chunks at the same position.
+	DuplicateChunk ProblemKind = "duplicate-chunk"
+	// ChunkSizeMismatch is a chunk whose size column does not match the length of its data.
+	ChunkSizeMismatch ProblemKind = "chunk-size-mismatch"
+	// FullPathMismatch is a file whose full_path is inconsistent with its parent/fname chain.
+	FullPathMismatch ProblemKind = "full-path-mismatch"
+	// DanglingParent is a file whose parent inode does not exist.
+	DanglingParent ProblemKind = "dangling-parent"
+	// NonDirectoryParent is a file which is not a directory but has children.
+	NonDirectoryParent ProblemKind = "non-directory-parent"
+	// UnreachableNode is a file which cannot be reached from a root directory
+	// through its parents, its parent chain looping back on itself.
+	UnreachableNode ProblemKind = "unreachable-node"
+	// DanglingContent is a clone whose content inode does not exist
+	// or is itself a clone.
+	DanglingContent ProblemKind = "dangling-content"
+	// RootMismatch is a file whose volume root differs from the one of its
+	// parent, or a root directory which is not the root of its own volume.
+	RootMismatch ProblemKind = "root-mismatch"
+)
+
+// Problem describes a single inconsistency found in the database.
+type Problem struct {
+	Kind ProblemKind
+	// Inode is the inode the problem relates to.
+	Inode int
+	// Position is the chunk position for chunk related problems, -1 otherwise.
+	Position int
+	// Path is the full path stored for the inode if any.
+	Path   string
+	Detail string
+	// Repaired is true when the problem has been fixed by a repair run.
+	Repaired bool
+}
+
+// Report is the result of a consistency check.
+type Report struct {
+	Problems []Problem
+}
+
+// Clean returns true if no problem has been found.
+func (r Report) Clean() bool {
+	return len(r.Problems) == 0
+}
+
+// Unrepaired returns the problems which are still present in the database.
+func (r Report) Unrepaired() []Problem {
+	problems := []Problem{}
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// CheckOptions controls the behaviour of Check.
+type CheckOptions struct {
+	// Repair fixes the problems which can be fixed without losing data:
+	// orphan chunks are deleted, chunk sizes are set to the length of
+	// their data and full paths are recomputed from the parent/fname chain.
+	// Other problems are only reported.
+	Repair bool
+}
+
+// Check verifies the consistency of the database content,
+// the files of all the volumes included.
+// Everything is done in a single transaction so the report describes
+// one point in time. When opts.Repair is set, the fixable problems
+// are repaired in that same transaction.
+func (fs *FS) Check(ctx context.Context, opts CheckOptions) (report Report, ret error) {
+	var (
+		tx  *sqlx.Tx
+		err error
+	)
+	if opts.Repair {
+		tx, err = fs.beginWrite(ctx)
+	} else {
+		tx, err = fs.beginRead(ctx)
+	}
+	if err != nil {
+		return Report{}, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer func() {
+		if ret == nil {
+			ret = tx.Commit()
+		} else {
+			ret = multierror.Append(ret, tx.Rollback())
+		}
+	}()
+
+	checks := []func(context.Context, *sqlx.Tx, bool) ([]Problem, error){
+		fs.checkOrphanChunks,
+		fs.checkChunkPositions,
+		fs.checkChunkSizes,
+		fs.checkFullPaths,
+		fs.checkDanglingParents,
+		fs.checkNonDirectoryParents,
+		fs.checkUnreachableNodes,
+		fs.checkDanglingContents,
+		fs.checkRoots,
+	}
+	for _, check := range checks {
+		problems, err := check(ctx, tx, opts.Repair)
+		if err != nil {
+			return Report{}, err
+		}
+		report.Problems = append(report.Problems, problems...)
+	}
+
+	return report, nil
+}
+
+func (fs *FS) checkOrphanChunks(ctx context.Context, tx *sqlx.Tx, repair bool) ([]Problem, error) {
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT inode, count(1)
+		FROM github_dgsb_dbfs_chunks
+		WHERE inode NOT IN (SELECT inode FROM github_dgsb_dbfs_files)
+		GROUP BY inode
+		ORDER BY inode`))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query orphan chunks: %w", err)
+	}
+	defer rows.Close()
+
+	problems := []Problem{}
+	for rows.Next() {
+		var inode, count int
+		if err := rows.Scan(&inode, &count); err != nil {
+			return nil, fmt.Errorf("cannot scan orphan chunks: %w", err)
+		}
+		problems = append(problems, Problem{
+			Kind:     OrphanChunk,
+			Inode:    inode,
+			Position: -1,
+			Detail:   fmt.Sprintf("%d chunks without file entry", count),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over orphan chunks: %w", err)
+	}
+
+	if repair {
+		for i := range problems {
+			if _, err := tx.ExecContext(ctx,
+				fs.query("DELETE FROM github_dgsb_dbfs_chunks WHERE inode = ?"), problems[i].Inode); err != nil {
+				return nil, fmt.Errorf("cannot delete orphan chunks of inode %d: %w", problems[i].Inode, err)
+			}
+			problems[i].Repaired = true
+		}
+	}
+
+	return problems, nil
+}
+
+func (fs *FS) checkChunkPositions(ctx context.Context, tx *sqlx.Tx, _ bool) ([]Problem, error) {
+	problems := []Problem{}
+
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT inode, position, count(1)
+		FROM github_dgsb_dbfs_chunks
+		GROUP BY inode, position
+		HAVING count(1) > 1
+		ORDER BY inode, position`))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query duplicate chunks: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var inode, position, count int
+		if err := rows.Scan(&inode, &position, &count); err != nil {
+			return nil, fmt.Errorf("cannot scan duplicate chunks: %w", err)
+		}
+		problems = append(problems, Problem{
+			Kind:     DuplicateChunk,
+			Inode:    inode,
+			Position: position,
+			Detail:   fmt.Sprintf("%d chunks at the same position", count),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over duplicate chunks: %w", err)
+	}
+
+	rows, err = tx.QueryxContext(ctx, fs.query(`
+		SELECT inode, count(DISTINCT position), min(position), max(position)
+		FROM github_dgsb_dbfs_chunks
+		GROUP BY inode
+		HAVING min(position) <> 0 OR max(position) <> count(DISTINCT position) - 1
+		ORDER BY inode`))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query chunk gaps: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var inode, count, minPosition, maxPosition int
+		if err := rows.Scan(&inode, &count, &minPosition, &maxPosition); err != nil {
+			return nil, fmt.Errorf("cannot scan chunk gaps: %w", err)
+		}
+		problems = append(problems, Problem{
+			Kind:     ChunkGap,
+			Inode:    inode,
+			Position: -1,
+			Detail: fmt.Sprintf(
+				"%d chunks with positions ranging from %d to %d", count, minPosition, maxPosition),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over chunk gaps: %w", err)
+	}
+
+	return problems, nil
+}
+
+func (fs *FS) checkChunkSizes(ctx context.Context, tx *sqlx.Tx, repair bool) ([]Problem, error) {
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT inode, position, size, COALESCE(length(data), 0)
+		FROM github_dgsb_dbfs_chunks
+		WHERE size IS DISTINCT FROM COALESCE(length(data), 0)
+		ORDER BY inode, position`))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query chunk sizes: %w", err)
+	}
+	defer rows.Close()
+
+	problems := []Problem{}
+	for rows.Next() {
+		var (
+			inode, position, length int
+			size                    *int
+		)
+		if err := rows.Scan(&inode, &position, &size, &length); err != nil {
+			return nil, fmt.Errorf("cannot scan chunk sizes: %w", err)
+		}
+		detail := fmt.Sprintf("size is NULL, data length is %d", length)
+		if size != nil {
+			detail = fmt.Sprintf("size is %d, data length is %d", *size, length)
+		}
+		problems = append(problems, Problem{
+			Kind:     ChunkSizeMismatch,
+			Inode:    inode,
+			Position: position,
+			Detail:   detail,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over chunk sizes: %w", err)
+	}
+
+	if repair {
+		for i := range problems {
+			if _, err := tx.ExecContext(ctx, fs.query(`
+				UPDATE github_dgsb_dbfs_chunks
+				SET size = COALESCE(length(data), 0)
+				WHERE inode = ? AND position = ?`),
+				problems[i].Inode, problems[i].Position); err != nil {
+				return nil, fmt.Errorf(
+					"cannot fix chunk size of inode %d at position %d: %w",
+					problems[i].Inode, problems[i].Position, err)
+			}
+			problems[i].Repaired = true
+		}
+	}
+
+	return problems, nil
+}
+
+func (fs *FS) checkFullPaths(ctx context.Context, tx *sqlx.Tx, repair bool) ([]Problem, error) {
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		WITH RECURSIVE paths (inode, computed) AS (
+			SELECT inode, NULL
+			FROM github_dgsb_dbfs_files
+			WHERE parent IS NULL
+			UNION ALL
+			SELECT
+				github_dgsb_dbfs_files.inode,
+				CASE
+					WHEN paths.computed IS NULL THEN github_dgsb_dbfs_files.fname
+					ELSE paths.computed || '/' || github_dgsb_dbfs_files.fname
+				END
+			FROM github_dgsb_dbfs_files JOIN paths ON github_dgsb_dbfs_files.parent = paths.inode
+		)
+		SELECT inode, full_path, computed
+		FROM github_dgsb_dbfs_files JOIN paths USING (inode)
+		WHERE full_path IS DISTINCT FROM computed
+		ORDER BY inode`))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query full paths: %w", err)
+	}
+	defer rows.Close()
+
+	type mismatch struct {
+		inode    int
+		computed *string
+	}
+	problems := []Problem{}
+	mismatches := []mismatch{}
+	for rows.Next() {
+		var (
+			inode              int
+			fullPath, computed *string
+		)
+		if err := rows.Scan(&inode, &fullPath, &computed); err != nil {
+			return nil, fmt.Errorf("cannot scan full paths: %w", err)
+		}
+		problem := Problem{
+			Kind:     FullPathMismatch,
+			Inode:    inode,
+			Position: -1,
+		}
+		if fullPath != nil {
+			problem.Path = *fullPath
+		}
+		if computed != nil {
+			problem.Detail = fmt.Sprintf("expected full path %s", *computed)
+		} else {
+			problem.Detail = "expected NULL full path"
+		}
+		problems = append(problems, problem)
+		mismatches = append(mismatches, mismatch{inode: inode, computed: computed})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over full paths: %w", err)
+	}
+
+	if repair {
+		// Clear every wrong path first so that swapped paths
+		// do not collide on the unique index while being fixed.
+		for _, m := range mismatches {
+			if _, err := tx.ExecContext(ctx,
+				fs.query("UPDATE github_dgsb_dbfs_files SET full_path = NULL WHERE inode = ?"), m.inode); err != nil {
+				return nil, fmt.Errorf("cannot clear full path of inode %d: %w", m.inode, err)
+			}
+		}
+		for i, m := range mismatches {
+			if _, err := tx.ExecContext(ctx,
+				fs.query("UPDATE github_dgsb_dbfs_files SET full_path = ? WHERE inode = ?"), m.computed, m.inode); err != nil {
+				return nil, fmt.Errorf("cannot fix full path of inode %d: %w", m.inode, err)
+			}
+			problems[i].Repaired = true
+		}
+	}
+
+	return problems, nil
+}
+
+func (fs *FS) checkDanglingParents(ctx context.Context, tx *sqlx.Tx, _ bool) ([]Problem, error) {
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT inode, COALESCE(full_path, fname), parent
+		FROM github_dgsb_dbfs_files
+		WHERE parent IS NOT NULL
+			AND parent NOT IN (SELECT inode FROM github_dgsb_dbfs_files)
+		ORDER BY inode`))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query dangling parents: %w", err)
+	}
+	defer rows.Close()
+
+	problems := []Problem{}
+	for rows.Next() {
+		var (
+			inode, parent int
+			fpath         string
+		)
+		if err := rows.Scan(&inode, &fpath, &parent); err != nil {
+			return nil, fmt.Errorf("cannot scan dangling parents: %w", err)
+		}
+		problems = append(problems, Problem{
+			Kind:     DanglingParent,
+			Inode:    inode,
+			Position: -1,
+			Path:     fpath,
+			Detail:   fmt.Sprintf("parent inode %d does not exist", parent),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over dangling parents: %w", err)
+	}
+
+	return problems, nil
+}
+
+func (fs *FS) checkNonDirectoryParents(ctx context.Context, tx *sqlx.Tx, _ bool) ([]Problem, error) {
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT p.inode, COALESCE(p.full_path, p.fname), p.type, count(1)
+		FROM github_dgsb_dbfs_files p JOIN github_dgsb_dbfs_files c ON c.parent = p.inode
+		WHERE p.type <> ?
+		GROUP BY p.inode, p.full_path, p.fname, p.type
+		ORDER BY p.inode`), DirectoryType)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query non directory parents: %w", err)
+	}
+	defer rows.Close()
+
+	problems := []Problem{}
+	for rows.Next() {
+		var (
+			inode, count int
+			fpath, ftype string
+		)
+		if err := rows.Scan(&inode, &fpath, &ftype, &count); err != nil {
+			return nil, fmt.Errorf("cannot scan non directory parents: %w", err)
+		}
+		problems = append(problems, Problem{
+			Kind:     NonDirectoryParent,
+			Inode:    inode,
+			Position: -1,
+			Path:     fpath,
+			Detail:   fmt.Sprintf("file of type %s has %d children", ftype, count),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over non directory parents: %w", err)
+	}
+
+	return problems, nil
+}
+
+func (fs *FS) checkUnreachableNodes(ctx context.Context, tx *sqlx.Tx, _ bool) ([]Problem, error) {
+	// the files whose parent does not exist are reported by checkDanglingParents
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		WITH RECURSIVE reached (inode) AS (
+			SELECT inode
+			FROM github_dgsb_dbfs_files
+			WHERE parent IS NULL
+			UNION ALL
+			SELECT github_dgsb_dbfs_files.inode
+			FROM github_dgsb_dbfs_files JOIN reached ON github_dgsb_dbfs_files.parent = reached.inode
+		)
+		SELECT inode, COALESCE(full_path, fname), parent
+		FROM github_dgsb_dbfs_files
+		WHERE inode NOT IN (SELECT inode FROM reached)
+			AND parent IN (SELECT inode FROM github_dgsb_dbfs_files)
+		ORDER BY inode`))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query unreachable nodes: %w", err)
+	}
+	defer rows.Close()
+
+	problems := []Problem{}
+	for rows.Next() {
+		var (
+			inode, parent int
+			fpath         string
+		)
+		if err := rows.Scan(&inode, &fpath, &parent); err != nil {
+			return nil, fmt.Errorf("cannot scan unreachable nodes: %w", err)
+		}
+		problems = append(problems, Problem{
+			Kind:     UnreachableNode,
+			Inode:    inode,
+			Position: -1,
+			Path:     fpath,
+			Detail:   fmt.Sprintf("parent inode %d is not reachable from a root directory", parent),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over unreachable nodes: %w", err)
+	}
+
+	return problems, nil
+}
+
+func (fs *FS) checkDanglingContents(ctx context.Context, tx *sqlx.Tx, _ bool) ([]Problem, error) {
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT f.inode, COALESCE(f.full_path, f.fname), f.content, c.inode IS NOT NULL
+		FROM github_dgsb_dbfs_files f
+			LEFT JOIN github_dgsb_dbfs_files c ON c.inode = f.content
+		WHERE f.content IS NOT NULL AND (c.inode IS NULL OR c.content IS NOT NULL)
+		ORDER BY f.inode`))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query dangling contents: %w", err)
+	}
+	defer rows.Close()
+
+	problems := []Problem{}
+	for rows.Next() {
+		var (
+			inode, content int
+			fpath          string
+			exists         bool
+		)
+		if err := rows.Scan(&inode, &fpath, &content, &exists); err != nil {
+			return nil, fmt.Errorf("cannot scan dangling contents: %w", err)
+		}
+		detail := fmt.Sprintf("content inode %d does not exist", content)
+		if exists {
+			detail = fmt.Sprintf("content inode %d is itself a clone", content)
+		}
+		problems = append(problems, Problem{
+			Kind:     DanglingContent,
+			Inode:    inode,
+			Position: -1,
+			Path:     fpath,
+			Detail:   detail,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over dangling contents: %w", err)
+	}
+
+	return problems, nil
+}
+
+func (fs *FS) checkRoots(ctx context.Context, tx *sqlx.Tx, _ bool) ([]Problem, error) {
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT f.inode, COALESCE(f.full_path, f.fname), f.root, p.root
+		FROM github_dgsb_dbfs_files f
+			JOIN github_dgsb_dbfs_files p ON p.inode = f.parent
+		WHERE f.root IS DISTINCT FROM p.root
+		UNION ALL
+		SELECT inode, fname, root, inode
+		FROM github_dgsb_dbfs_files
+		WHERE parent IS NULL AND root IS DISTINCT FROM inode
+		ORDER BY 1`))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query volume roots: %w", err)
+	}
+	defer rows.Close()
+
+	problems := []Problem{}
+	for rows.Next() {
+		var (
+			inode    int
+			fpath    string
+			root     *int
+			expected *int
+		)
+		if err := rows.Scan(&inode, &fpath, &root, &expected); err != nil {
+			return nil, fmt.Errorf("cannot scan volume roots: %w", err)
+		}
+		detail := "root is NULL"
+		if root != nil {
+			detail = fmt.Sprintf("root is %d", *root)
+		}
+		if expected != nil {
+			detail += fmt.Sprintf(", expected %d", *expected)
+		}
+		problems = append(problems, Problem{
+			Kind:     RootMismatch,
+			Inode:    inode,
+			Position: -1,
+			Path:     fpath,
+			Detail:   detail,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over volume roots: %w", err)
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,107 @@
+package dbfs_test
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Check(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "fsck.db")
+	sqliteFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	require.NoError(t, sqliteFS.UpsertFiles(map[string][]byte{
+		"a/b/c":   []byte("some content"),
+		"a/d":     []byte("other content"),
+		"e/f/g/h": []byte("yet another content"),
+		"i/j":     []byte("a clone to be"),
+	}, 4))
+
+	report, err := sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Problems)
+
+	// corrupt the database through a raw connection without foreign keys enforcement
+	db, err := sqlx.Open(sqliteDriver, dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+
+	var cInode, dInode, gInode, jInode int
+	require.NoError(t, db.Get(&cInode, "SELECT inode FROM github_dgsb_dbfs_files WHERE full_path = 'a/b/c'"))
+	require.NoError(t, db.Get(&dInode, "SELECT inode FROM github_dgsb_dbfs_files WHERE full_path = 'a/d'"))
+	require.NoError(t, db.Get(&gInode, "SELECT inode FROM github_dgsb_dbfs_files WHERE full_path = 'e/f/g'"))
+	require.NoError(t, db.Get(&jInode, "SELECT inode FROM github_dgsb_dbfs_files WHERE full_path = 'i/j'"))
+	for _, stmt := range []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT INTO github_dgsb_dbfs_chunks (inode, position, data, size) VALUES (9999, 0, x'00', 1)", nil},
+		{"UPDATE github_dgsb_dbfs_chunks SET size = 42 WHERE inode = ? AND position = 1", []any{cInode}},
+		{"DELETE FROM github_dgsb_dbfs_chunks WHERE inode = ? AND position = 1", []any{dInode}},
+		{"UPDATE github_dgsb_dbfs_files SET full_path = 'x/y' WHERE inode = ?", []any{gInode}},
+		{"INSERT INTO github_dgsb_dbfs_files (fname, full_path, parent, type) VALUES ('lost', 'lost', 8888, 'f')", nil},
+		{"INSERT INTO github_dgsb_dbfs_files (fname, full_path, parent, type) VALUES ('child', 'a/d/child', ?, 'f')", []any{dInode}},
+		{"INSERT INTO github_dgsb_dbfs_files (inode, fname, full_path, parent, type) VALUES (7001, 'p', 'q/p', 7002, 'd')", nil},
+		{"INSERT INTO github_dgsb_dbfs_files (inode, fname, full_path, parent, type) VALUES (7002, 'q', 'p/q', 7001, 'd')", nil},
+		{"DELETE FROM github_dgsb_dbfs_chunks WHERE inode = ?", []any{jInode}},
+		{"UPDATE github_dgsb_dbfs_files SET content = 7777 WHERE inode = ?", []any{jInode}},
+	} {
+		_, err := db.Exec(stmt.query, stmt.args...)
+		require.NoError(t, err, stmt.query)
+	}
+
+	report, err = sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	kinds := map[ProblemKind]int{}
+	for _, p := range report.Problems {
+		require.False(t, p.Repaired)
+		kinds[p.Kind]++
+	}
+	require.Equal(t, map[ProblemKind]int{
+		OrphanChunk:        1,
+		ChunkSizeMismatch:  1,
+		ChunkGap:           1,
+		FullPathMismatch:   1,
+		DanglingParent:     1,
+		NonDirectoryParent: 1,
+		UnreachableNode:    2,
+		DanglingContent:    1,
+		RootMismatch:       1,
+	}, kinds)
+
+	report, err = sqliteFS.Check(context.Background(), CheckOptions{Repair: true})
+	require.NoError(t, err)
+	unrepaired := map[ProblemKind]int{}
+	for _, p := range report.Unrepaired() {
+		unrepaired[p.Kind]++
+	}
+	require.Equal(t, map[ProblemKind]int{
+		ChunkGap:           1,
+		DanglingParent:     1,
+		NonDirectoryParent: 1,
+		UnreachableNode:    2,
+		DanglingContent:    1,
+		RootMismatch:       1,
+	}, unrepaired)
+
+	report, err = sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 7)
+
+	data, err := fs.ReadFile(sqliteFS, "a/b/c")
+	require.NoError(t, err)
+	require.Equal(t, "some content", string(data))
+	require.NoError(t, fstest.TestFS(sqliteFS, "a/b/c", "e/f/g/h"))
+}
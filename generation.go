@@ -0,0 +1,95 @@
+package dbfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ConflictErr is returned when the precondition of a write does not hold.
+var ConflictErr = fmt.Errorf("precondition failed")
+
+// Precondition is a condition on the current state of a file
+// checked in the transaction of a write before applying it.
+type Precondition struct {
+	generation int64
+	notExists  bool
+}
+
+// IfMatch requires the file to exist with the given generation.
+// The generation of a file is exposed in the SysInfo of its FileInfo.
+func IfMatch(generation int64) Precondition {
+	return Precondition{generation: generation}
+}
+
+// IfNotExists requires the file not to exist.
+func IfNotExists() Precondition {
+	return Precondition{notExists: true}
+}
+
+// checkPreconditions verifies all the conditions on fname
+// and returns a ConflictErr on the first one which does not hold.
+func (fs *FS) checkPreconditions(ctx context.Context, tx *sqlx.Tx, fname string, conds []Precondition) error {
+	if len(conds) == 0 {
+		return nil
+	}
+
+	exists := true
+	inode, _, err := fs.namei(ctx, tx, fname)
+	if errors.Is(err, InodeNotFoundErr) {
+		exists = false
+	} else if err != nil {
+		return err
+	}
+
+	var generation int64
+	if exists {
+		if err := tx.GetContext(ctx, &generation,
+			fs.query("SELECT generation FROM github_dgsb_dbfs_files WHERE inode = ?"), inode); err != nil {
+			return fmt.Errorf("cannot query generation of %s: %w", fname, err)
+		}
+	}
+
+	for _, cond := range conds {
+		switch {
+		case cond.notExists && exists:
+			return fmt.Errorf("%w: %s already exists", ConflictErr, fname)
+		case !cond.notExists && !exists:
+			return fmt.Errorf("%w: %s does not exist", ConflictErr, fname)
+		case !cond.notExists && generation != cond.generation:
+			return fmt.Errorf("%w: %s is at generation %d, expected %d",
+				ConflictErr, fname, generation, cond.generation)
+		}
+	}
+	return nil
+}
+
+// bumpGeneration records a change of inode.
+func (fs *FS) bumpGeneration(ctx context.Context, tx *sqlx.Tx, inode int) error {
+	generation, err := fs.nextGeneration(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		fs.query("UPDATE github_dgsb_dbfs_files SET generation = ? WHERE inode = ?"), generation, inode); err != nil {
+		return fmt.Errorf("cannot increment generation of inode %d: %w", inode, err)
+	}
+	return nil
+}
+
+// nextGeneration returns a generation never given before in the database.
+// A per inode counter would give a file deleted and created again the
+// generations of the former file, which a stale writer may still hold.
+// The writers being serialized, the counter is incremented without conflict.
+func (fs *FS) nextGeneration(ctx context.Context, tx *sqlx.Tx) (int64, error) {
+	var generation int64
+	if err := tx.QueryRowxContext(ctx, fs.query(`
+		UPDATE github_dgsb_dbfs_generations SET value = value + 1
+		WHERE id = 1
+		RETURNING value`)).Scan(&generation); err != nil {
+		return 0, fmt.Errorf("cannot allocate a generation: %w", err)
+	}
+	return generation, nil
+}
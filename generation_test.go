@@ -0,0 +1,74 @@
+package dbfs_test
+
+import (
+	"io/fs"
+	"testing"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Preconditions(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	generation := func(name string) int64 {
+		fi, err := fs.Stat(sqliteFS, name)
+		require.NoError(t, err)
+		return fi.Sys().(SysInfo).Generation
+	}
+
+	require.NoError(t, sqliteFS.UpsertFile("shared/manifest", 16, []byte("v1"), IfNotExists()))
+	require.ErrorIs(t, sqliteFS.UpsertFile("shared/manifest", 16, []byte("v1"), IfNotExists()), ConflictErr)
+	require.Positive(t, generation("shared/manifest"))
+
+	// two workers read the same generation, only the first one can write
+	seen := generation("shared/manifest")
+	require.NoError(t, sqliteFS.UpsertFile("shared/manifest", 16, []byte("v2 worker 1"), IfMatch(seen)))
+	require.ErrorIs(t, sqliteFS.UpsertFile("shared/manifest", 16, []byte("v2 worker 2"), IfMatch(seen)), ConflictErr)
+	written := generation("shared/manifest")
+	require.Greater(t, written, seen)
+	data, err := fs.ReadFile(sqliteFS, "shared/manifest")
+	require.NoError(t, err)
+	require.Equal(t, "v2 worker 1", string(data))
+
+	// writing the same content is not a change
+	require.NoError(t, sqliteFS.UpsertFile("shared/manifest", 16, []byte("v2 worker 1")))
+	require.Equal(t, written, generation("shared/manifest"))
+
+	require.NoError(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.Rename("shared/manifest", "shared/manifest.json")
+	}))
+	moved := generation("shared/manifest.json")
+	require.Greater(t, moved, written)
+
+	entries, err := fs.ReadDir(sqliteFS, "shared")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	fi, err := entries[0].Info()
+	require.NoError(t, err)
+	require.Equal(t, moved, fi.Sys().(SysInfo).Generation)
+
+	require.ErrorIs(t, sqliteFS.DeleteFile("shared/manifest.json", IfMatch(seen)), ConflictErr)
+	require.ErrorIs(t, sqliteFS.DeleteFile("shared/manifest.json", IfNotExists()), ConflictErr)
+	require.ErrorIs(t, sqliteFS.DeleteFile("shared/other", IfMatch(1)), ConflictErr)
+	require.NoError(t, sqliteFS.DeleteFile("shared/manifest.json", IfMatch(moved)))
+	_, err = fs.Stat(sqliteFS, "shared/manifest.json")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+
+	// a file deleted and created again does not match the generations
+	// of the former file held by a stale writer
+	require.NoError(t, sqliteFS.UpsertFile("shared/lease", 16, []byte("worker 1")))
+	stale := generation("shared/lease")
+	require.NoError(t, sqliteFS.DeleteFile("shared/lease", IfMatch(stale)))
+	require.NoError(t, sqliteFS.UpsertFile("shared/lease", 16, []byte("worker 2"), IfNotExists()))
+	require.Greater(t, generation("shared/lease"), stale)
+	require.ErrorIs(t, sqliteFS.UpsertFile("shared/lease", 16, []byte("worker 1 again"), IfMatch(stale)), ConflictErr)
+	require.ErrorIs(t, sqliteFS.DeleteFile("shared/lease", IfMatch(stale)), ConflictErr)
+	data, err = fs.ReadFile(sqliteFS, "shared/lease")
+	require.NoError(t, err)
+	require.Equal(t, "worker 2", string(data))
+}
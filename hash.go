@@ -0,0 +1,154 @@
+package dbfs
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// HashAlgorithm names a whole file digest algorithm.
+type HashAlgorithm string
+
+const (
+	SHA256 HashAlgorithm = "sha256"
+	MD5    HashAlgorithm = "md5"
+)
+
+var (
+	UnknownHashErr  = fmt.Errorf("unknown hash algorithm")
+	HashNotFoundErr = fmt.Errorf("hash not found")
+)
+
+// hashAlgorithms lists the digests computed for every file written.
+var hashAlgorithms = map[HashAlgorithm]func() hash.Hash{
+	SHA256: sha256.New,
+	MD5:    md5.New,
+}
+
+func hashData(data []byte) map[HashAlgorithm][]byte {
+	digests := make(map[HashAlgorithm][]byte, len(hashAlgorithms))
+	for algo, newHash := range hashAlgorithms {
+		h := newHash()
+		h.Write(data)
+		digests[algo] = h.Sum(nil)
+	}
+	return digests
+}
+
+func (fs *FS) writeHashes(ctx context.Context, tx *sqlx.Tx, inode int, digests map[HashAlgorithm][]byte) error {
+	for algo, digest := range digests {
+		if _, err := tx.ExecContext(ctx, fs.query(`
+			INSERT INTO github_dgsb_dbfs_hashes (inode, algorithm, digest)
+			VALUES (?, ?, ?)
+			ON CONFLICT (inode, algorithm) DO UPDATE SET digest = excluded.digest`),
+			inode, algo, digest); err != nil {
+			return fmt.Errorf("cannot store %s digest of inode %d: %w", algo, inode, err)
+		}
+	}
+	return nil
+}
+
+func (fs *FS) readHashes(ctx context.Context, q sqlx.QueryerContext, inode int) (map[HashAlgorithm][]byte, error) {
+	rows, err := q.QueryxContext(ctx,
+		fs.query("SELECT algorithm, digest FROM github_dgsb_dbfs_hashes WHERE inode = ?"), inode)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query hashes of inode %d: %w", inode, err)
+	}
+	defer rows.Close()
+
+	digests := map[HashAlgorithm][]byte{}
+	for rows.Next() {
+		var (
+			algo   HashAlgorithm
+			digest []byte
+		)
+		if err := rows.Scan(&algo, &digest); err != nil {
+			return nil, fmt.Errorf("cannot scan hash of inode %d: %w", inode, err)
+		}
+		digests[algo] = digest
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over hashes of inode %d: %w", inode, err)
+	}
+	return digests, nil
+}
+
+// readChildrenHashes returns the hashes of the children of the directory
+// parent whose inode is in the range (after, last], by inode, in a single query.
+func (fs *FS) readChildrenHashes(
+	ctx context.Context, q sqlx.QueryerContext, parent, after, last int,
+) (map[int]map[HashAlgorithm][]byte, error) {
+	rows, err := q.QueryxContext(ctx, fs.query(`
+		SELECT h.inode, h.algorithm, h.digest
+		FROM github_dgsb_dbfs_hashes h JOIN github_dgsb_dbfs_files f ON f.inode = h.inode
+		WHERE f.parent = ? AND f.inode > ? AND f.inode <= ?`), parent, after, last)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query hashes of the children of inode %d: %w", parent, err)
+	}
+	defer rows.Close()
+
+	digests := map[int]map[HashAlgorithm][]byte{}
+	for rows.Next() {
+		var (
+			inode  int
+			algo   HashAlgorithm
+			digest []byte
+		)
+		if err := rows.Scan(&inode, &algo, &digest); err != nil {
+			return nil, fmt.Errorf("cannot scan hash of the children of inode %d: %w", parent, err)
+		}
+		if digests[inode] == nil {
+			digests[inode] = map[HashAlgorithm][]byte{}
+		}
+		digests[inode][algo] = digest
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over hashes of the children of inode %d: %w", parent, err)
+	}
+	return digests, nil
+}
+
+// Hash returns the digest of the content of the named file
+// as computed when the file has been written.
+// The file content is not read.
+func (fs *FS) Hash(name string, algo HashAlgorithm) ([]byte, error) {
+	return fs.HashContext(context.Background(), name, algo)
+}
+
+// HashContext is Hash honouring the ctx cancellation.
+func (fs *FS) HashContext(ctx context.Context, name string, algo HashAlgorithm) ([]byte, error) {
+	if _, ok := hashAlgorithms[algo]; !ok {
+		return nil, fmt.Errorf("%w: %s", UnknownHashErr, algo)
+	}
+
+	tx, err := fs.beginRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Commit()
+
+	inode, ftype, err := fs.namei(ctx, tx, name)
+	if err != nil {
+		return nil, fmt.Errorf("namei on %s: %w", name, err)
+	}
+	if ftype != RegularFileType {
+		return nil, fmt.Errorf("%w: %s", IncorrectTypeErr, ftype)
+	}
+
+	var digest []byte
+	row := tx.QueryRowxContext(ctx,
+		fs.query("SELECT digest FROM github_dgsb_dbfs_hashes WHERE inode = ? AND algorithm = ?"), inode, algo)
+	if err := row.Scan(&digest); errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s %s", HashNotFoundErr, algo, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot query %s digest of %s: %w", algo, name, err)
+	}
+
+	return digest, nil
+}
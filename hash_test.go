@@ -0,0 +1,62 @@
+package dbfs_test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"io/fs"
+	"testing"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Hash(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	require.NoError(t, sqliteFS.UpsertFile("poésie/lamartine/le_lac", 32, []byte(leLac)))
+	sha256Sum := sha256.Sum256([]byte(leLac))
+	md5Sum := md5.Sum([]byte(leLac))
+
+	digest, err := sqliteFS.Hash("poésie/lamartine/le_lac", SHA256)
+	require.NoError(t, err)
+	require.Equal(t, sha256Sum[:], digest)
+
+	digest, err = sqliteFS.Hash("poésie/lamartine/le_lac", MD5)
+	require.NoError(t, err)
+	require.Equal(t, md5Sum[:], digest)
+
+	_, err = sqliteFS.Hash("poésie/lamartine/le_lac", "crc32")
+	require.ErrorIs(t, err, UnknownHashErr)
+	_, err = sqliteFS.Hash("poésie/lamartine", SHA256)
+	require.ErrorIs(t, err, IncorrectTypeErr)
+	_, err = sqliteFS.Hash("poésie/hugo", SHA256)
+	require.ErrorIs(t, err, InodeNotFoundErr)
+
+	fi, err := fs.Stat(sqliteFS, "poésie/lamartine/le_lac")
+	require.NoError(t, err)
+	sys, ok := fi.Sys().(SysInfo)
+	require.True(t, ok)
+	require.Equal(t, sha256Sum[:], sys.Hashes[SHA256])
+	require.Equal(t, md5Sum[:], sys.Hashes[MD5])
+
+	entries, err := fs.ReadDir(sqliteFS, "poésie/lamartine")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	fi, err = entries[0].Info()
+	require.NoError(t, err)
+	require.Equal(t, sha256Sum[:], fi.Sys().(SysInfo).Hashes[SHA256])
+
+	require.NoError(t, sqliteFS.UpsertFile("poésie/lamartine/le_lac", 32, []byte("bonjour")))
+	sha256Sum = sha256.Sum256([]byte("bonjour"))
+	digest, err = sqliteFS.Hash("poésie/lamartine/le_lac", SHA256)
+	require.NoError(t, err)
+	require.Equal(t, sha256Sum[:], digest)
+
+	require.NoError(t, sqliteFS.DeleteFile("poésie/lamartine/le_lac"))
+	_, err = sqliteFS.Hash("poésie/lamartine/le_lac", SHA256)
+	require.ErrorIs(t, err, InodeNotFoundErr)
+}
@@ -0,0 +1,209 @@
+package dbfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// LockMode is the mode of an advisory lock.
+type LockMode string
+
+const (
+	// SharedLock can be held by several owners at once.
+	SharedLock LockMode = "shared"
+	// ExclusiveLock can only be held by a single owner.
+	ExclusiveLock LockMode = "exclusive"
+)
+
+var (
+	LockedErr      = fmt.Errorf("lock held by another owner")
+	LockNotHeldErr = fmt.Errorf("lock not held")
+	InvalidTTLErr  = fmt.Errorf("lease duration must be positive")
+)
+
+// LockInfo describes a lease on an advisory lock.
+type LockInfo struct {
+	Name    string
+	Owner   string
+	Mode    LockMode
+	Expires time.Time
+}
+
+// Lock takes an exclusive advisory lock on name for owner.
+// Locks are stored in the database so that several processes
+// sharing it can coordinate. They are not enforced by the
+// file system operations. The lock is a lease which expires
+// after ttl unless renewed. An expired lease is reclaimed by
+// the next owner trying to take the lock.
+// Locking again a lock already held by owner changes its mode
+// and extends its lease.
+// LockedErr is returned if the lock is held by another owner
+// and InvalidTTLErr if ttl is not positive.
+func (fs *FS) Lock(name, owner string, ttl time.Duration) (LockInfo, error) {
+	return fs.LockContext(context.Background(), name, owner, ExclusiveLock, ttl)
+}
+
+// LockShared takes a shared advisory lock on name for owner.
+// A shared lock can be held by several owners as long as
+// no other owner holds it exclusively.
+func (fs *FS) LockShared(name, owner string, ttl time.Duration) (LockInfo, error) {
+	return fs.LockContext(context.Background(), name, owner, SharedLock, ttl)
+}
+
+// LockContext takes an advisory lock on name for owner in the given mode.
+func (fs *FS) LockContext(
+	ctx context.Context, name, owner string, mode LockMode, ttl time.Duration,
+) (LockInfo, error) {
+	if mode != SharedLock && mode != ExclusiveLock {
+		return LockInfo{}, fmt.Errorf("unknown lock mode %s", mode)
+	}
+	if ttl <= 0 {
+		return LockInfo{}, fmt.Errorf("%w: %s", InvalidTTLErr, ttl)
+	}
+
+	now := time.Now()
+	info := LockInfo{Name: name, Owner: owner, Mode: mode, Expires: now.Add(ttl)}
+	err := fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx,
+			fs.query("DELETE FROM github_dgsb_dbfs_locks WHERE root = ? AND name = ? AND expires_at <= ?"),
+			fs.rootInode, name, now.UnixMilli()); err != nil {
+			return fmt.Errorf("cannot reclaim expired leases of %s: %w", name, err)
+		}
+
+		holders, err := fs.lockHolders(ctx, tx, name, now)
+		if err != nil {
+			return err
+		}
+		for _, holder := range holders {
+			if holder.Owner == owner {
+				continue
+			}
+			if mode == ExclusiveLock || holder.Mode == ExclusiveLock {
+				return fmt.Errorf("%w: %s is held %s by %s", LockedErr, name, holder.Mode, holder.Owner)
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, fs.query(`
+			INSERT INTO github_dgsb_dbfs_locks (root, name, owner, mode, expires_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (root, name, owner) DO UPDATE SET
+				mode = excluded.mode,
+				expires_at = excluded.expires_at`),
+			fs.rootInode, name, owner, mode, info.Expires.UnixMilli()); err != nil {
+			return fmt.Errorf("cannot store lease of %s: %w", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return LockInfo{}, err
+	}
+	return info, nil
+}
+
+// Renew extends the lease held by owner on name for ttl from now.
+// LockNotHeldErr is returned if owner does not hold the lock
+// or if its lease has already expired, InvalidTTLErr if ttl is not positive.
+func (fs *FS) Renew(name, owner string, ttl time.Duration) (LockInfo, error) {
+	return fs.RenewContext(context.Background(), name, owner, ttl)
+}
+
+// RenewContext is Renew honouring the ctx cancellation.
+func (fs *FS) RenewContext(ctx context.Context, name, owner string, ttl time.Duration) (LockInfo, error) {
+	if ttl <= 0 {
+		return LockInfo{}, fmt.Errorf("%w: %s", InvalidTTLErr, ttl)
+	}
+	now := time.Now()
+	info := LockInfo{Name: name, Owner: owner, Expires: now.Add(ttl)}
+	err := fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		row := tx.QueryRowxContext(ctx, fs.query(`
+			UPDATE github_dgsb_dbfs_locks
+			SET expires_at = ?
+			WHERE root = ? AND name = ? AND owner = ? AND expires_at > ?
+			RETURNING mode`), info.Expires.UnixMilli(), fs.rootInode, name, owner, now.UnixMilli())
+		if err := row.Scan(&info.Mode); errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s by %s", LockNotHeldErr, name, owner)
+		} else if err != nil {
+			return fmt.Errorf("cannot renew lease of %s: %w", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return LockInfo{}, err
+	}
+	return info, nil
+}
+
+// Unlock releases the lock held by owner on name.
+// LockNotHeldErr is returned if owner does not hold the lock.
+func (fs *FS) Unlock(name, owner string) error {
+	return fs.UnlockContext(context.Background(), name, owner)
+}
+
+// UnlockContext is Unlock honouring the ctx cancellation.
+func (fs *FS) UnlockContext(ctx context.Context, name, owner string) error {
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, fs.query(`
+			DELETE FROM github_dgsb_dbfs_locks
+			WHERE root = ? AND name = ? AND owner = ? AND expires_at > ?`),
+			fs.rootInode, name, owner, time.Now().UnixMilli())
+		if err != nil {
+			return fmt.Errorf("cannot release lock %s: %w", name, err)
+		}
+		if count, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("cannot count released locks: %w", err)
+		} else if count == 0 {
+			return fmt.Errorf("%w: %s by %s", LockNotHeldErr, name, owner)
+		}
+		return nil
+	})
+}
+
+// Locks returns the leases currently held on name.
+func (fs *FS) Locks(name string) ([]LockInfo, error) {
+	return fs.LocksContext(context.Background(), name)
+}
+
+// LocksContext is Locks honouring the ctx cancellation.
+func (fs *FS) LocksContext(ctx context.Context, name string) (ret []LockInfo, retErr error) {
+	tx, err := fs.beginRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Commit()
+
+	return fs.lockHolders(ctx, tx, name, time.Now())
+}
+
+func (fs *FS) lockHolders(ctx context.Context, tx *sqlx.Tx, name string, now time.Time) ([]LockInfo, error) {
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT owner, mode, expires_at
+		FROM github_dgsb_dbfs_locks
+		WHERE root = ? AND name = ? AND expires_at > ?
+		ORDER BY owner`), fs.rootInode, name, now.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("cannot query leases of %s: %w", name, err)
+	}
+	defer rows.Close()
+
+	holders := []LockInfo{}
+	for rows.Next() {
+		var (
+			info    = LockInfo{Name: name}
+			expires int64
+		)
+		if err := rows.Scan(&info.Owner, &info.Mode, &expires); err != nil {
+			return nil, fmt.Errorf("cannot scan lease of %s: %w", name, err)
+		}
+		info.Expires = time.UnixMilli(expires)
+		holders = append(holders, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over leases of %s: %w", name, err)
+	}
+	return holders, nil
+}
@@ -0,0 +1,79 @@
+package dbfs_test
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Locks(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "locks.db")
+	fs1, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, fs1.Close())
+	})
+	// a second handle on the same database stands for another process
+	fs2, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, fs2.Close())
+	})
+
+	_, err = fs1.Lock("manifest", "worker-1", 0)
+	require.ErrorIs(t, err, InvalidTTLErr)
+	info, err := fs1.Lock("manifest", "worker-1", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, ExclusiveLock, info.Mode)
+	_, err = fs1.Renew("manifest", "worker-1", -time.Second)
+	require.ErrorIs(t, err, InvalidTTLErr)
+
+	_, err = fs2.Lock("manifest", "worker-2", time.Minute)
+	require.ErrorIs(t, err, LockedErr)
+	_, err = fs2.LockShared("manifest", "worker-2", time.Minute)
+	require.ErrorIs(t, err, LockedErr)
+	require.ErrorIs(t, fs2.Unlock("manifest", "worker-2"), LockNotHeldErr)
+
+	holders, err := fs2.Locks("manifest")
+	require.NoError(t, err)
+	require.Len(t, holders, 1)
+	require.Equal(t, "worker-1", holders[0].Owner)
+	require.Equal(t, ExclusiveLock, holders[0].Mode)
+
+	// downgrade to a shared lock so that other readers can join
+	_, err = fs1.LockShared("manifest", "worker-1", time.Minute)
+	require.NoError(t, err)
+	_, err = fs2.LockShared("manifest", "worker-2", time.Minute)
+	require.NoError(t, err)
+	_, err = fs2.Lock("manifest", "worker-2", time.Minute)
+	require.ErrorIs(t, err, LockedErr)
+	holders, err = fs1.Locks("manifest")
+	require.NoError(t, err)
+	require.Len(t, holders, 2)
+
+	require.NoError(t, fs1.Unlock("manifest", "worker-1"))
+	info, err = fs2.Lock("manifest", "worker-2", 50*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, ExclusiveLock, info.Mode)
+
+	renewed, err := fs2.Renew("manifest", "worker-2", 100*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, renewed.Expires.After(info.Expires))
+	_, err = fs1.Lock("manifest", "worker-1", time.Minute)
+	require.ErrorIs(t, err, LockedErr)
+
+	// the expired lease is reclaimed
+	time.Sleep(150 * time.Millisecond)
+	holders, err = fs1.Locks("manifest")
+	require.NoError(t, err)
+	require.Empty(t, holders)
+	_, err = fs2.Renew("manifest", "worker-2", time.Minute)
+	require.ErrorIs(t, err, LockNotHeldErr)
+	_, err = fs1.Lock("manifest", "worker-1", time.Minute)
+	require.NoError(t, err)
+	require.ErrorIs(t, fs2.Unlock("manifest", "worker-2"), LockNotHeldErr)
+	require.NoError(t, fs1.Unlock("manifest", "worker-1"))
+}
@@ -10,8 +10,17 @@ func Build() error {
 	return sh.Run("go", "build", "./")
 }
 
+// Test runs the tests with the cgo sqlite driver, built with FTS5
+// for the full text index, then with the pure Go one.
 func Test() error {
-	return sh.Run("go", "test", "./...")
+	if err := sh.Run("go", "test", "-tags", "sqlite_fts5", "./..."); err != nil {
+		return err
+	}
+	return sh.Run("go", "test", "-tags", "dbfs_purego", "./...")
+}
+
+func Race() error {
+	return sh.Run("go", "test", "-race", "./...")
 }
 
 func Bench() error {
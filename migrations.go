@@ -1,19 +1,27 @@
 package dbfs
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
 	"embed"
 	"fmt"
 	"io/fs"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/GuiaBolso/darwin"
 	"github.com/hashicorp/go-multierror"
 	"github.com/jmoiron/sqlx"
 )
 
-//go:embed migrations/*.sql
+//go:embed migrations/*.sql migrations/postgres/*.sql
 var migrationFiles embed.FS
 
-func getMigrations() (migrations []darwin.Migration, ret error) {
+func getMigrations(dir string) (migrations []darwin.Migration, ret error) {
 	defer func() {
 		if ret != nil {
 			migrations = nil
@@ -36,25 +44,373 @@ func getMigrations() (migrations []darwin.Migration, ret error) {
 		{
 			Version:     1.0,
 			Description: "base database structure for a read only fs implementation",
-			Script:      string(readFile("migrations/01_base_sqlite.sql")),
+			Script:      string(readFile(path.Join(dir, "01_base.sql"))),
+		},
+		{
+			Version:     2.0,
+			Description: "sha256 checksum of each file chunk",
+			Script:      string(readFile(path.Join(dir, "02_chunk_checksums.sql"))),
+		},
+		{
+			Version:     3.0,
+			Description: "whole file digests computed at write time",
+			Script:      string(readFile(path.Join(dir, "03_file_hashes.sql"))),
+		},
+		{
+			Version:     4.0,
+			Description: "generation number of each inode for optimistic concurrency control",
+			Script:      string(readFile(path.Join(dir, "04_generations.sql"))),
+		},
+		{
+			Version:     5.0,
+			Description: "advisory locks and leases",
+			Script:      string(readFile(path.Join(dir, "05_locks.sql"))),
+		},
+		{
+			Version:     6.0,
+			Description: "log of the changes made to the file system",
+			Script:      string(readFile(path.Join(dir, "06_changes.sql"))),
+		},
+		{
+			Version:     7.0,
+			Description: "replication of the change log to follower databases",
+			Script:      string(readFile(path.Join(dir, "07_replication.sql"))),
+		},
+		{
+			Version:     8.0,
+			Description: "instance identifier and two-way synchronisation markers",
+			Script:      string(readFile(path.Join(dir, "08_sync.sql"))),
+		},
+		{
+			Version:     9.0,
+			Description: "independent volumes each with its own root directory",
+			Script:      string(readFile(path.Join(dir, "09_volumes.sql"))),
+		},
+		{
+			Version:     10.0,
+			Description: "backfill of the checksums and digests of the data written before them",
+		},
+		{
+			Version:     11.0,
+			Description: "copy-on-write clones sharing the chunks of another file",
+			Script:      string(readFile(path.Join(dir, "11_clones.sql"))),
+		},
+		{
+			Version:     12.0,
+			Description: "extended attributes of the nodes",
+			Script:      string(readFile(path.Join(dir, "12_xattrs.sql"))),
+		},
+		{
+			Version:     13.0,
+			Description: "modification time of each node",
+			Script:      string(readFile(path.Join(dir, "13_modification_times.sql"))),
+		},
+		{
+			Version:     14.0,
+			Description: "position of the last change pruned from the change log",
+			Script:      string(readFile(path.Join(dir, "14_change_retention.sql"))),
+		},
+		{
+			Version:     15.0,
+			Description: "database wide counter of the generations",
+			Script:      string(readFile(path.Join(dir, "15_generation_counter.sql"))),
+		},
+		{
+			Version:     16.0,
+			Description: "path reached by the snapshot of a follower",
+			Script:      string(readFile(path.Join(dir, "16_snapshot_cursor.sql"))),
+		},
+		{
+			Version:     17.0,
+			Description: "selection of the files of the full text index",
+			Script:      string(readFile(path.Join(dir, "17_fulltext_selection.sql"))),
 		},
 	}
 
 	return
 }
 
-func runMigrations(db *sqlx.DB) (ret error) {
-	migrations, err := getMigrations()
+// SchemaTooNewErr is returned when opening a database migrated
+// by a more recent version of the package.
+var SchemaTooNewErr = fmt.Errorf("database schema is newer than the library")
+
+// backfills are the data migrations run after the SQL script of the migration
+// of the same version. A backfill updates the existing data in batches of
+// backfillBatchSize, each in a write transaction of its own, so that the
+// writers of the other processes are not blocked for long on a large
+// database. The migration is only recorded as applied once its backfill
+// is complete: an interrupted backfill is run again from the start and
+// must then skip the data it has already updated.
+var backfills = map[float64]func(ctx context.Context, fs *FS) error{
+	10.0: func(ctx context.Context, fs *FS) error {
+		if err := fs.backfillChunkChecksums(ctx); err != nil {
+			return err
+		}
+		return fs.backfillFileHashes(ctx)
+	},
+}
+
+const backfillBatchSize = 256
+
+// migrationDriver returns the darwin driver and the migrations of fs.
+func (fs *FS) migrationDriver() (darwin.Driver, []darwin.Migration, error) {
+	migrations, err := getMigrations(fs.dialect.migrationDir())
 	if err != nil {
-		return fmt.Errorf("cannot get migrations: %w", err)
+		return nil, nil, fmt.Errorf("cannot get migrations: %w", err)
 	}
 
-	if err := darwin.Migrate(
-		darwin.NewGenericDriver(db.DB, darwin.SqliteDialect{}),
-		migrations,
-		nil,
-	); err != nil {
-		return fmt.Errorf("cannot run database migrations: %w", err)
+	migrationDialect := fs.dialect.migrationDialect()
+	if fs.tablePrefix != defaultTablePrefix {
+		for i := range migrations {
+			migrations[i].Script = strings.ReplaceAll(migrations[i].Script, defaultTablePrefix, fs.tablePrefix)
+		}
+		migrationDialect = prefixedMigrationDialect{
+			Dialect: migrationDialect,
+			table:   fs.tablePrefix + "darwin_migrations",
+		}
+	}
+	return darwin.NewGenericDriver(fs.db.DB, migrationDialect), migrations, nil
+}
+
+// appliedMigrations returns the versions of the migrations applied to the
+// database. SchemaTooNewErr is returned if one of them is unknown to the package.
+func appliedMigrations(driver darwin.Driver, migrations []darwin.Migration) (map[float64]bool, error) {
+	records, err := driver.All()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read applied migrations: %w", err)
+	}
+	latest := migrations[len(migrations)-1].Version
+	applied := map[float64]bool{}
+	for _, record := range records {
+		if record.Version > latest {
+			return nil, fmt.Errorf("%w: version %v, supported version %v", SchemaTooNewErr, record.Version, latest)
+		}
+		applied[record.Version] = true
+	}
+	return applied, nil
+}
+
+// migrate upgrades the database schema of fs in place. The migrations not
+// applied yet are run in version order, the SQL script first then the backfill.
+func (fs *FS) migrate(ctx context.Context) error {
+	driver, migrations, err := fs.migrationDriver()
+	if err != nil {
+		return err
+	}
+	if err := driver.Create(); err != nil {
+		return fmt.Errorf("cannot create migrations table: %w", err)
+	}
+	applied, err := appliedMigrations(driver, migrations)
+	if err != nil {
+		return err
+	}
+	if err := darwin.Validate(driver, migrations); err != nil {
+		return fmt.Errorf("invalid database migrations: %w", err)
+	}
+
+	for _, migration := range migrations {
+		if applied[migration.Version] {
+			continue
+		}
+		start := time.Now()
+		if migration.Script != "" {
+			if _, err := driver.Exec(migration.Script); err != nil {
+				return fmt.Errorf("cannot run database migration %v: %w", migration.Version, err)
+			}
+		}
+		if backfill := backfills[migration.Version]; backfill != nil {
+			if err := backfill(ctx, fs); err != nil {
+				return fmt.Errorf("cannot backfill database migration %v: %w", migration.Version, err)
+			}
+		}
+		if err := driver.Insert(darwin.MigrationRecord{
+			Version:       migration.Version,
+			Description:   migration.Description,
+			Checksum:      migration.Checksum(),
+			AppliedAt:     time.Now(),
+			ExecutionTime: time.Since(start),
+		}); err != nil {
+			return fmt.Errorf("cannot record database migration %v: %w", migration.Version, err)
+		}
 	}
 	return nil
 }
+
+// verifyMigrations checks without writing anything that all
+// the migrations have been applied to the database and are unchanged.
+func (fs *FS) verifyMigrations() error {
+	driver, migrations, err := fs.migrationDriver()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(driver, migrations)
+	if err != nil {
+		return err
+	}
+	if err := darwin.Validate(driver, migrations); err != nil {
+		return fmt.Errorf("invalid database migrations: %w", err)
+	}
+	for _, migration := range migrations {
+		if !applied[migration.Version] {
+			return fmt.Errorf("database migration %v (%s) is not applied", migration.Version, migration.Description)
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the latest migration applied to the database.
+func (fs *FS) SchemaVersion() (float64, error) {
+	driver, migrations, err := fs.migrationDriver()
+	if err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations(driver, migrations)
+	if err != nil {
+		return 0, err
+	}
+	var version float64
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// Migrate runs the schema migrations of a file system in db
+// without creating it. It is meant for the file systems
+// created by New with the migrations disabled.
+func Migrate(db *sql.DB, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	d, driverName, err := dialectOf(db)
+	if err != nil {
+		return err
+	}
+	fs := &FS{db: sqlx.NewDb(db, driverName), dialect: d, tablePrefix: cfg.tablePrefix}
+	return fs.migrate(context.Background())
+}
+
+// backfillChunkChecksums computes the checksums of the chunks
+// written before the checksums were recorded.
+func (fs *FS) backfillChunkChecksums(ctx context.Context) error {
+	for {
+		done := false
+		if err := fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+			rows, err := tx.QueryxContext(ctx, fs.query(`
+				SELECT inode, position, data
+				FROM github_dgsb_dbfs_chunks
+				WHERE checksum IS NULL
+				LIMIT ?`), backfillBatchSize)
+			if err != nil {
+				return fmt.Errorf("cannot query chunks without checksum: %w", err)
+			}
+			type chunk struct {
+				inode, position int
+				data            []byte
+			}
+			var chunks []chunk
+			for rows.Next() {
+				var c chunk
+				if err := rows.Scan(&c.inode, &c.position, &c.data); err != nil {
+					rows.Close()
+					return fmt.Errorf("cannot scan chunk without checksum: %w", err)
+				}
+				chunks = append(chunks, c)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("cannot iterate over chunks without checksum: %w", err)
+			}
+
+			for _, c := range chunks {
+				if _, err := tx.ExecContext(ctx,
+					fs.query("UPDATE github_dgsb_dbfs_chunks SET checksum = ? WHERE inode = ? AND position = ?"),
+					chunkChecksum(c.data), c.inode, c.position); err != nil {
+					return fmt.Errorf("cannot store checksum of inode %d at position %d: %w", c.inode, c.position, err)
+				}
+			}
+			done = len(chunks) < backfillBatchSize
+			return nil
+		}); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// backfillFileHashes computes the digests of the files
+// written before the digests were recorded.
+func (fs *FS) backfillFileHashes(ctx context.Context) error {
+	for {
+		done := false
+		if err := fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+			var inodes []int
+			if err := tx.SelectContext(ctx, &inodes, fs.query(`
+				SELECT inode
+				FROM github_dgsb_dbfs_files f
+				WHERE type = ?
+					AND NOT EXISTS (
+						SELECT 1 FROM github_dgsb_dbfs_hashes h
+						WHERE h.inode = f.inode AND h.algorithm = ?
+					)
+				LIMIT ?`), RegularFileType, SHA256, backfillBatchSize); err != nil {
+				return fmt.Errorf("cannot query files without digest: %w", err)
+			}
+
+			for _, inode := range inodes {
+				// the files do not share their chunks yet at this version of the schema
+				var chunks [][]byte
+				if err := tx.SelectContext(ctx, &chunks, fs.query(
+					"SELECT data FROM github_dgsb_dbfs_chunks WHERE inode = ? ORDER BY position"), inode); err != nil {
+					return fmt.Errorf("cannot query chunks of inode %d: %w", inode, err)
+				}
+				// the statement and the algorithms are those of version 10,
+				// the later versions of the schema must not change them
+				data := bytes.Join(chunks, nil)
+				sha256Sum, md5Sum := sha256.Sum256(data), md5.Sum(data)
+				for algo, digest := range map[string][]byte{"sha256": sha256Sum[:], "md5": md5Sum[:]} {
+					if _, err := tx.ExecContext(ctx, fs.query(`
+						INSERT INTO github_dgsb_dbfs_hashes (inode, algorithm, digest)
+						VALUES (?, ?, ?)
+						ON CONFLICT (inode, algorithm) DO UPDATE SET digest = excluded.digest`),
+						inode, algo, digest); err != nil {
+						return fmt.Errorf("cannot store %s digest of inode %d: %w", algo, inode, err)
+					}
+				}
+			}
+			done = len(inodes) < backfillBatchSize
+			return nil
+		}); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// prefixedMigrationDialect records the applied migrations in a table
+// of its own so that the file systems sharing a database are migrated
+// independently. The file systems with the default table prefix keep
+// using the darwin_migrations table.
+type prefixedMigrationDialect struct {
+	darwin.Dialect
+	table string
+}
+
+func (d prefixedMigrationDialect) CreateTableSQL() string {
+	return strings.ReplaceAll(d.Dialect.CreateTableSQL(), "darwin_migrations", d.table)
+}
+
+func (d prefixedMigrationDialect) InsertSQL() string {
+	return strings.ReplaceAll(d.Dialect.InsertSQL(), "darwin_migrations", d.table)
+}
+
+func (d prefixedMigrationDialect) AllSQL() string {
+	return strings.ReplaceAll(d.Dialect.AllSQL(), "darwin_migrations", d.table)
+}
@@ -0,0 +1 @@
+ALTER TABLE github_dgsb_dbfs_chunks ADD COLUMN checksum BLOB;
@@ -0,0 +1,7 @@
+CREATE TABLE github_dgsb_dbfs_hashes (
+    inode INTEGER,
+    algorithm TEXT NOT NULL,
+    digest BLOB NOT NULL,
+    PRIMARY KEY(inode, algorithm),
+    FOREIGN KEY(inode) REFERENCES github_dgsb_dbfs_files(inode)
+);
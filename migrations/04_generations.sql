@@ -0,0 +1 @@
+ALTER TABLE github_dgsb_dbfs_files ADD COLUMN generation INTEGER NOT NULL DEFAULT 1;
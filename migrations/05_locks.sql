@@ -0,0 +1,7 @@
+CREATE TABLE github_dgsb_dbfs_locks (
+    name TEXT NOT NULL,
+    owner TEXT NOT NULL,
+    mode TEXT NOT NULL,
+    expires_at INTEGER NOT NULL,
+    PRIMARY KEY(name, owner)
+);
@@ -0,0 +1,6 @@
+ALTER TABLE github_dgsb_dbfs_changes ADD COLUMN inode INTEGER;
+
+CREATE TABLE github_dgsb_dbfs_replication (
+    source TEXT PRIMARY KEY,
+    seq INTEGER NOT NULL
+);
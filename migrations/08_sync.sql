@@ -0,0 +1,13 @@
+CREATE TABLE github_dgsb_dbfs_meta (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);
+
+INSERT INTO github_dgsb_dbfs_meta (key, value) VALUES ('instance_id', lower(hex(randomblob(16))));
+
+CREATE TABLE github_dgsb_dbfs_sync (
+    peer TEXT NOT NULL,
+    path TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    PRIMARY KEY(peer, path)
+);
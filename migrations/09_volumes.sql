@@ -0,0 +1,62 @@
+CREATE TABLE github_dgsb_dbfs_volumes (
+    name TEXT PRIMARY KEY,
+    root INTEGER NOT NULL UNIQUE,
+    instance_id TEXT NOT NULL,
+    FOREIGN KEY(root) REFERENCES github_dgsb_dbfs_files(inode)
+);
+
+INSERT INTO github_dgsb_dbfs_volumes (name, root, instance_id)
+SELECT
+    'default',
+    inode,
+    (SELECT value FROM github_dgsb_dbfs_meta WHERE key = 'instance_id')
+FROM github_dgsb_dbfs_files
+WHERE fname = '/' AND parent IS NULL;
+
+ALTER TABLE github_dgsb_dbfs_files ADD COLUMN root INTEGER REFERENCES github_dgsb_dbfs_files(inode);
+UPDATE github_dgsb_dbfs_files SET root = (SELECT root FROM github_dgsb_dbfs_volumes);
+DROP INDEX github_dgsb_dbfs_files_full_path;
+CREATE UNIQUE INDEX github_dgsb_dbfs_files_full_path ON github_dgsb_dbfs_files(root, full_path);
+
+ALTER TABLE github_dgsb_dbfs_changes ADD COLUMN root INTEGER;
+UPDATE github_dgsb_dbfs_changes SET root = (SELECT root FROM github_dgsb_dbfs_volumes);
+CREATE INDEX github_dgsb_dbfs_changes_root ON github_dgsb_dbfs_changes(root, seq);
+
+CREATE TABLE github_dgsb_dbfs_volume_locks (
+    root INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    owner TEXT NOT NULL,
+    mode TEXT NOT NULL,
+    expires_at INTEGER NOT NULL,
+    PRIMARY KEY(root, name, owner)
+);
+INSERT INTO github_dgsb_dbfs_volume_locks (root, name, owner, mode, expires_at)
+SELECT (SELECT root FROM github_dgsb_dbfs_volumes), name, owner, mode, expires_at
+FROM github_dgsb_dbfs_locks;
+DROP TABLE github_dgsb_dbfs_locks;
+ALTER TABLE github_dgsb_dbfs_volume_locks RENAME TO github_dgsb_dbfs_locks;
+
+CREATE TABLE github_dgsb_dbfs_volume_replication (
+    root INTEGER NOT NULL,
+    source TEXT NOT NULL,
+    seq INTEGER NOT NULL,
+    PRIMARY KEY(root, source)
+);
+INSERT INTO github_dgsb_dbfs_volume_replication (root, source, seq)
+SELECT (SELECT root FROM github_dgsb_dbfs_volumes), source, seq
+FROM github_dgsb_dbfs_replication;
+DROP TABLE github_dgsb_dbfs_replication;
+ALTER TABLE github_dgsb_dbfs_volume_replication RENAME TO github_dgsb_dbfs_replication;
+
+CREATE TABLE github_dgsb_dbfs_volume_sync (
+    root INTEGER NOT NULL,
+    peer TEXT NOT NULL,
+    path TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    PRIMARY KEY(root, peer, path)
+);
+INSERT INTO github_dgsb_dbfs_volume_sync (root, peer, path, fingerprint)
+SELECT (SELECT root FROM github_dgsb_dbfs_volumes), peer, path, fingerprint
+FROM github_dgsb_dbfs_sync;
+DROP TABLE github_dgsb_dbfs_sync;
+ALTER TABLE github_dgsb_dbfs_volume_sync RENAME TO github_dgsb_dbfs_sync;
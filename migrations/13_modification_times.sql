@@ -0,0 +1,7 @@
+ALTER TABLE github_dgsb_dbfs_files ADD COLUMN modified_at INTEGER;
+UPDATE github_dgsb_dbfs_files SET modified_at = (
+    SELECT max(changed_at)
+    FROM github_dgsb_dbfs_changes c
+    WHERE c.inode = github_dgsb_dbfs_files.inode AND c.op IN ('create', 'modify')
+);
+CREATE INDEX github_dgsb_dbfs_files_modified_at ON github_dgsb_dbfs_files(root, modified_at);
@@ -0,0 +1 @@
+ALTER TABLE github_dgsb_dbfs_volumes ADD COLUMN pruned_seq INTEGER NOT NULL DEFAULT 0;
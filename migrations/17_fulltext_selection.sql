@@ -0,0 +1,10 @@
+CREATE TABLE github_dgsb_dbfs_fulltext_filters (
+    kind TEXT NOT NULL,
+    filter TEXT NOT NULL,
+    PRIMARY KEY(kind, filter)
+);
+
+CREATE TABLE github_dgsb_dbfs_fulltext_files (
+    inode INTEGER PRIMARY KEY,
+    FOREIGN KEY(inode) REFERENCES github_dgsb_dbfs_files(inode)
+);
@@ -0,0 +1,8 @@
+CREATE TABLE github_dgsb_dbfs_changes (
+    seq BIGSERIAL PRIMARY KEY,
+    op TEXT NOT NULL,
+    path TEXT NOT NULL,
+    old_path TEXT,
+    type TEXT NOT NULL,
+    changed_at BIGINT NOT NULL
+);
@@ -0,0 +1,41 @@
+CREATE TABLE github_dgsb_dbfs_volumes (
+    name TEXT PRIMARY KEY,
+    root BIGINT NOT NULL UNIQUE,
+    instance_id TEXT NOT NULL,
+    FOREIGN KEY(root) REFERENCES github_dgsb_dbfs_files(inode)
+);
+
+INSERT INTO github_dgsb_dbfs_volumes (name, root, instance_id)
+SELECT
+    'default',
+    inode,
+    (SELECT value FROM github_dgsb_dbfs_meta WHERE key = 'instance_id')
+FROM github_dgsb_dbfs_files
+WHERE fname = '/' AND parent IS NULL;
+
+ALTER TABLE github_dgsb_dbfs_files ADD COLUMN root BIGINT REFERENCES github_dgsb_dbfs_files(inode);
+UPDATE github_dgsb_dbfs_files SET root = (SELECT root FROM github_dgsb_dbfs_volumes);
+DROP INDEX github_dgsb_dbfs_files_full_path;
+CREATE UNIQUE INDEX github_dgsb_dbfs_files_full_path ON github_dgsb_dbfs_files(root, full_path);
+
+ALTER TABLE github_dgsb_dbfs_changes ADD COLUMN root BIGINT;
+UPDATE github_dgsb_dbfs_changes SET root = (SELECT root FROM github_dgsb_dbfs_volumes);
+CREATE INDEX github_dgsb_dbfs_changes_root ON github_dgsb_dbfs_changes(root, seq);
+
+ALTER TABLE github_dgsb_dbfs_locks ADD COLUMN root BIGINT;
+UPDATE github_dgsb_dbfs_locks SET root = (SELECT root FROM github_dgsb_dbfs_volumes);
+ALTER TABLE github_dgsb_dbfs_locks ALTER COLUMN root SET NOT NULL;
+ALTER TABLE github_dgsb_dbfs_locks DROP CONSTRAINT github_dgsb_dbfs_locks_pkey;
+ALTER TABLE github_dgsb_dbfs_locks ADD PRIMARY KEY (root, name, owner);
+
+ALTER TABLE github_dgsb_dbfs_replication ADD COLUMN root BIGINT;
+UPDATE github_dgsb_dbfs_replication SET root = (SELECT root FROM github_dgsb_dbfs_volumes);
+ALTER TABLE github_dgsb_dbfs_replication ALTER COLUMN root SET NOT NULL;
+ALTER TABLE github_dgsb_dbfs_replication DROP CONSTRAINT github_dgsb_dbfs_replication_pkey;
+ALTER TABLE github_dgsb_dbfs_replication ADD PRIMARY KEY (root, source);
+
+ALTER TABLE github_dgsb_dbfs_sync ADD COLUMN root BIGINT;
+UPDATE github_dgsb_dbfs_sync SET root = (SELECT root FROM github_dgsb_dbfs_volumes);
+ALTER TABLE github_dgsb_dbfs_sync ALTER COLUMN root SET NOT NULL;
+ALTER TABLE github_dgsb_dbfs_sync DROP CONSTRAINT github_dgsb_dbfs_sync_pkey;
+ALTER TABLE github_dgsb_dbfs_sync ADD PRIMARY KEY (root, peer, path);
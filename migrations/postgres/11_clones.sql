@@ -0,0 +1,2 @@
+ALTER TABLE github_dgsb_dbfs_files ADD COLUMN content BIGINT REFERENCES github_dgsb_dbfs_files(inode);
+CREATE INDEX github_dgsb_dbfs_files_content ON github_dgsb_dbfs_files(content);
@@ -0,0 +1,7 @@
+CREATE TABLE github_dgsb_dbfs_xattrs (
+    inode BIGINT NOT NULL,
+    name TEXT NOT NULL,
+    value BYTEA NOT NULL,
+    PRIMARY KEY(inode, name),
+    FOREIGN KEY(inode) REFERENCES github_dgsb_dbfs_files(inode)
+);
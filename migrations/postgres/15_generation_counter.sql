@@ -0,0 +1,7 @@
+CREATE TABLE github_dgsb_dbfs_generations (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    value BIGINT NOT NULL
+);
+
+INSERT INTO github_dgsb_dbfs_generations (id, value)
+SELECT 1, COALESCE(max(generation), 0) FROM github_dgsb_dbfs_files;
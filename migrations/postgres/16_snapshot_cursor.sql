@@ -0,0 +1 @@
+ALTER TABLE github_dgsb_dbfs_replication ADD COLUMN snapshot_after TEXT;
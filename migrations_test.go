@@ -0,0 +1,211 @@
+package dbfs_test
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/GuiaBolso/darwin"
+	. "github.com/dgsb/dbfs"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SchemaUpgrade(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "upgrade.db")
+	sqliteFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	version, err := sqliteFS.SchemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, 17.0, version)
+
+	files := map[string][]byte{"big/file": []byte(strings.Repeat("0123456789", 100))}
+	for i := 0; i < 300; i++ {
+		files[fmt.Sprintf("small/%03d", i)] = []byte(fmt.Sprintf("file %d", i))
+	}
+	require.NoError(t, sqliteFS.UpsertFiles(files, 1))
+	require.NoError(t, sqliteFS.Close())
+
+	// Turn the database back into one written before
+	// the chunk checksums and the file digests.
+	db, err := sqlx.Open(sqliteDriver, dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	var expectedChecksums []byte
+	require.NoError(t, db.Get(&expectedChecksums, `
+		SELECT group_concat(hex(checksum), '') FROM (
+			SELECT checksum FROM github_dgsb_dbfs_chunks ORDER BY inode, position
+		)`))
+	for _, q := range []string{
+		"UPDATE github_dgsb_dbfs_chunks SET checksum = NULL",
+		"DELETE FROM github_dgsb_dbfs_hashes",
+		"DELETE FROM darwin_migrations WHERE version = 10",
+	} {
+		_, err := db.Exec(q)
+		require.NoError(t, err)
+	}
+
+	_, err = NewSqliteFS(dbName, WithReadOnly())
+	require.Error(t, err)
+	sqliteFS, err = NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+	version, err = sqliteFS.SchemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, 17.0, version)
+
+	var checksums []byte
+	require.NoError(t, db.Get(&checksums, `
+		SELECT group_concat(hex(checksum), '') FROM (
+			SELECT checksum FROM github_dgsb_dbfs_chunks ORDER BY inode, position
+		)`))
+	require.Equal(t, expectedChecksums, checksums)
+	report, err := sqliteFS.Scrub(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, report.Unverified)
+	require.Empty(t, report.Corrupted)
+
+	var digests int
+	require.NoError(t, db.Get(&digests, "SELECT count(1) FROM github_dgsb_dbfs_hashes WHERE algorithm = ?", SHA256))
+	require.Equal(t, len(files), digests)
+	for name, data := range files {
+		digest, err := sqliteFS.Hash(name, SHA256)
+		require.NoError(t, err)
+		sum := sha256.Sum256(data)
+		require.Equal(t, sum[:], digest, name)
+	}
+	data, err := fs.ReadFile(sqliteFS, "big/file")
+	require.NoError(t, err)
+	require.Equal(t, files["big/file"], data)
+}
+
+func Test_SchemaUpgradeFromBaseline(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "baseline.db")
+	db, err := sqlx.Open(sqliteDriver, dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	script, err := os.ReadFile("migrations/01_base.sql")
+	require.NoError(t, err)
+	require.NoError(t, darwin.New(darwin.NewGenericDriver(db.DB, darwin.SqliteDialect{}), []darwin.Migration{{
+		Version:     1.0,
+		Description: "base database structure for a read only fs implementation",
+		Script:      string(script),
+	}}, nil).Migrate())
+
+	// Write the files as the first version of the package did:
+	// one node per path component and the chunks of each file.
+	files := map[string][]byte{
+		"docs/guide/intro.md": []byte("# intro\nbaseline database\n"),
+		"docs/empty":          {},
+		"data.bin":            []byte(strings.Repeat("0123456789", 10)),
+	}
+	chunkSize := 16
+	for name, data := range files {
+		components := strings.Split(name, "/")
+		var parent int
+		require.NoError(t, db.Get(&parent, "SELECT inode FROM github_dgsb_dbfs_files WHERE fname = '/'"))
+		for i, component := range components {
+			ftype := "d"
+			if i == len(components)-1 {
+				ftype = "f"
+			}
+			var inode int
+			err := db.Get(&inode, "SELECT inode FROM github_dgsb_dbfs_files WHERE fname = ? AND parent = ?",
+				component, parent)
+			if err != nil {
+				require.NoError(t, db.Get(&inode, `
+					INSERT INTO github_dgsb_dbfs_files (fname, full_path, parent, type)
+					VALUES (?, ?, ?, ?)
+					RETURNING inode`, component, path.Join(components[:i+1]...), parent, ftype))
+			}
+			parent = inode
+		}
+		for i, position := 0, 0; i < len(data); i, position = i+chunkSize, position+1 {
+			chunk := data[i:]
+			if len(chunk) > chunkSize {
+				chunk = chunk[:chunkSize]
+			}
+			_, err := db.Exec(`
+				INSERT INTO github_dgsb_dbfs_chunks (inode, position, data, size)
+				VALUES (?, ?, ?, ?)`, parent, position, chunk, len(chunk))
+			require.NoError(t, err)
+		}
+	}
+	var chunks int
+	require.NoError(t, db.Get(&chunks, "SELECT count(1) FROM github_dgsb_dbfs_chunks"))
+
+	sqliteFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+	version, err := sqliteFS.SchemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, 17.0, version)
+
+	for name, data := range files {
+		content, err := fs.ReadFile(sqliteFS, name)
+		require.NoError(t, err, name)
+		require.Equal(t, data, content, name)
+
+		digest, err := sqliteFS.Hash(name, SHA256)
+		require.NoError(t, err, name)
+		sha256Sum := sha256.Sum256(data)
+		require.Equal(t, sha256Sum[:], digest, name)
+		digest, err = sqliteFS.Hash(name, MD5)
+		require.NoError(t, err, name)
+		md5Sum := md5.Sum(data)
+		require.Equal(t, md5Sum[:], digest, name)
+	}
+	info, err := fs.Stat(sqliteFS, "docs/guide")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+
+	scrub, err := sqliteFS.Scrub(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, chunks, scrub.Checked)
+	require.Zero(t, scrub.Unverified)
+	require.Empty(t, scrub.Corrupted)
+
+	report, err := sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+}
+
+func Test_SchemaTooNew(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "newer.db")
+	sqliteFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	require.NoError(t, sqliteFS.Close())
+
+	db, err := sqlx.Open(sqliteDriver, dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	_, err = db.Exec(`
+		INSERT INTO darwin_migrations (version, description, checksum, applied_at, execution_time)
+		VALUES (99, 'from the future', '', 0, 0)`)
+	require.NoError(t, err)
+
+	for name, opts := range map[string][]Option{
+		"migrations":    nil,
+		"no migrations": {WithMigrations(false)},
+		"read only":     {WithReadOnly()},
+	} {
+		_, err := NewSqliteFS(dbName, opts...)
+		require.ErrorIs(t, err, SchemaTooNewErr, name)
+	}
+}
@@ -0,0 +1,230 @@
+package dbfs
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultTablePrefix is the prefix of the tables of the package
+	// as written in its queries and migration scripts.
+	defaultTablePrefix = "github_dgsb_dbfs_"
+	// defaultChunkSize is the chunk size of the files written
+	// with a chunk size lower or equal to 0.
+	defaultChunkSize = 64 * 1024
+)
+
+var tablePrefixRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Option configures an FS when it is created.
+// The options tuning the sqlite connections only apply to NewSqliteFS,
+// the database given to New being configured by the caller.
+type Option func(*config)
+
+type config struct {
+	tablePrefix string
+	migrate     bool
+	chunkSize   int
+	// fullTextPatterns and fullTextMIMETypes select the files
+	// of the full text index, which is disabled if both are nil.
+	fullTextPatterns  []string
+	fullTextMIMETypes []string
+
+	readOnly    bool
+	immutable   bool
+	journalMode string
+	synchronous string
+	cacheSize   int
+	busyTimeout time.Duration
+	// pool holds the settings of the connection pool.
+	pool []func(*sql.DB)
+}
+
+func newConfig(opts []Option) (config, error) {
+	cfg := config{
+		tablePrefix: defaultTablePrefix,
+		migrate:     true,
+		chunkSize:   defaultChunkSize,
+		journalMode: "WAL",
+		busyTimeout: busyTimeout,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if !tablePrefixRegexp.MatchString(cfg.tablePrefix) {
+		return config{}, fmt.Errorf("invalid table prefix %q", cfg.tablePrefix)
+	}
+	if cfg.chunkSize <= 0 {
+		return config{}, fmt.Errorf("invalid chunk size %d", cfg.chunkSize)
+	}
+	for _, pattern := range cfg.fullTextPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return config{}, fmt.Errorf("invalid full text pattern %q: %w", pattern, err)
+		}
+	}
+	for _, mimeType := range cfg.fullTextMIMETypes {
+		if !strings.Contains(mimeType, "/") {
+			return config{}, fmt.Errorf("invalid full text MIME type %q", mimeType)
+		}
+	}
+	switch cfg.journalMode {
+	case "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+	default:
+		return config{}, fmt.Errorf("invalid journal mode %q", cfg.journalMode)
+	}
+	switch cfg.synchronous {
+	case "", "OFF", "NORMAL", "FULL", "EXTRA":
+	default:
+		return config{}, fmt.Errorf("invalid synchronous level %q", cfg.synchronous)
+	}
+	if cfg.busyTimeout < 0 {
+		return config{}, fmt.Errorf("invalid busy timeout %s", cfg.busyTimeout)
+	}
+	return cfg, nil
+}
+
+// WithTablePrefix names the tables of the file system with prefix
+// instead of github_dgsb_dbfs_. Several file systems with distinct
+// prefixes are independent from each other in the same database.
+// The prefix is made of letters, digits and underscores.
+func WithTablePrefix(prefix string) Option {
+	return func(cfg *config) {
+		cfg.tablePrefix = prefix
+	}
+}
+
+// WithMigrations controls whether the schema migrations are run when
+// the file system is created, which is the default. When disabled, the
+// schema must have been migrated beforehand, for instance with Migrate.
+func WithMigrations(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.migrate = enabled
+	}
+}
+
+// WithChunkSize sets the chunk size of the files written with
+// a chunk size lower or equal to 0. It defaults to 64 KiB.
+func WithChunkSize(size int) Option {
+	return func(cfg *config) {
+		cfg.chunkSize = size
+	}
+}
+
+// WithFullTextIndex enables the full text index searched by FS.Search
+// and adds the regular files matching one of the path.Match patterns to it.
+// A pattern without a slash is matched against the base name of the files,
+// "*.md" selects all the markdown files, and a pattern with slashes against
+// their full path. The index is stored in a sqlite FTS5 table, which
+// requires the sqlite_fts5 build tag with the cgo driver, and is not
+// supported by PostgreSQL. It reads the content of the files from their
+// chunks instead of holding a copy of it.
+//
+// The selection is stored in the database: all the file systems opened on
+// it maintain the index, whatever their options. A different selection
+// replaces the stored one and rebuilds the index of all the volumes.
+// FS.DropFullTextIndex disables the index.
+func WithFullTextIndex(patterns ...string) Option {
+	return func(cfg *config) {
+		cfg.fullTextPatterns = append(make([]string, 0, len(patterns)), patterns...)
+	}
+}
+
+// WithFullTextMIMETypes enables the full text index as WithFullTextIndex
+// and adds the regular files of these MIME types to it, "text/*" selecting
+// all the text types. The type of a file is given by its extension, from
+// a table of the common extensions built into the package, and detected
+// from its content when the extension is unknown.
+func WithFullTextMIMETypes(types ...string) Option {
+	return func(cfg *config) {
+		cfg.fullTextMIMETypes = append(make([]string, 0, len(types)), types...)
+	}
+}
+
+// WithReadOnly makes the file system read only: its mutating methods
+// fail with fs.ErrPermission without accessing the database, and the
+// migrations are verified instead of being applied. The sqlite database
+// is opened in read only mode and its journal mode is kept. A database
+// in WAL mode can only be read if its -shm file exists or can be created,
+// a database shipped on read only media should then use another journal
+// mode or be opened with WithImmutable.
+func WithReadOnly() Option {
+	return func(cfg *config) {
+		cfg.readOnly = true
+	}
+}
+
+// WithImmutable makes the file system read only as WithReadOnly and tells
+// sqlite it cannot change, which disables all the locking and change
+// detection. It is meant for databases on read only media: the reads
+// are undefined if the database is modified by another process.
+func WithImmutable() Option {
+	return func(cfg *config) {
+		cfg.readOnly = true
+		cfg.immutable = true
+	}
+}
+
+// WithJournalMode sets the sqlite journal mode, WAL by default.
+// Other modes than WAL make the readers and the writer block each other.
+// It is ignored by a read only file system.
+func WithJournalMode(mode string) Option {
+	return func(cfg *config) {
+		cfg.journalMode = strings.ToUpper(mode)
+	}
+}
+
+// WithSynchronous sets the sqlite synchronous level:
+// OFF, NORMAL, FULL or EXTRA. The sqlite default is kept if unset.
+func WithSynchronous(level string) Option {
+	return func(cfg *config) {
+		cfg.synchronous = strings.ToUpper(level)
+	}
+}
+
+// WithCacheSize sets the sqlite page cache size of each connection.
+// As for the cache_size pragma, a positive size is a number of pages
+// and a negative one a number of KiB.
+func WithCacheSize(size int) Option {
+	return func(cfg *config) {
+		cfg.cacheSize = size
+	}
+}
+
+// WithBusyTimeout sets how long sqlite waits on a locked database
+// before failing, 5 seconds by default.
+func WithBusyTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.busyTimeout = timeout
+	}
+}
+
+// WithMaxOpenConns limits the number of open connections to the database.
+// See sql.DB.SetMaxOpenConns. At least 2 connections are needed: the open
+// files, the views and the watchers share all of them but one, which is
+// kept for the writers.
+func WithMaxOpenConns(n int) Option {
+	return func(cfg *config) {
+		cfg.pool = append(cfg.pool, func(db *sql.DB) { db.SetMaxOpenConns(n) })
+	}
+}
+
+// WithMaxIdleConns limits the number of idle connections kept in the pool.
+// See sql.DB.SetMaxIdleConns.
+func WithMaxIdleConns(n int) Option {
+	return func(cfg *config) {
+		cfg.pool = append(cfg.pool, func(db *sql.DB) { db.SetMaxIdleConns(n) })
+	}
+}
+
+// WithConnMaxLifetime limits how long a connection is reused.
+// See sql.DB.SetConnMaxLifetime.
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.pool = append(cfg.pool, func(db *sql.DB) { db.SetConnMaxLifetime(d) })
+	}
+}
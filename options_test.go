@@ -0,0 +1,141 @@
+package dbfs_test
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_New(t *testing.T) {
+	db, err := sql.Open(sqliteDriver, sqliteTestDSN(path.Join(t.TempDir(), "app.db")))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	_, err = db.Exec("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)")
+	require.NoError(t, err)
+
+	docs, err := New(db, WithTablePrefix("docs_"))
+	require.NoError(t, err)
+	assets, err := New(db, WithTablePrefix("assets_"))
+	require.NoError(t, err)
+	require.NoError(t, docs.UpsertFile("index.html", 16, []byte("<h1>docs</h1>")))
+	require.NoError(t, assets.UpsertFile("index.html", 16, []byte("<h1>assets</h1>")))
+	require.NoError(t, assets.UpsertFile("logo.svg", 16, []byte("<svg/>")))
+
+	data, err := fs.ReadFile(docs, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "<h1>docs</h1>", string(data))
+	data, err = fs.ReadFile(assets, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "<h1>assets</h1>", string(data))
+	_, err = fs.Stat(docs, "logo.svg")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+
+	var tables []string
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name")
+	require.NoError(t, err)
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		tables = append(tables, name)
+	}
+	require.NoError(t, rows.Err())
+	require.Contains(t, tables, "users")
+	require.Contains(t, tables, "docs_files")
+	require.Contains(t, tables, "docs_darwin_migrations")
+	require.Contains(t, tables, "assets_chunks")
+	require.NotContains(t, tables, "github_dgsb_dbfs_files")
+	require.NotContains(t, tables, "darwin_migrations")
+
+	report, err := docs.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Problems)
+
+	// the database handle belongs to the caller
+	require.NoError(t, docs.Close())
+	require.NoError(t, assets.Close())
+	require.NoError(t, db.Ping())
+
+	// the migrations can be run separately
+	_, err = New(db, WithTablePrefix("media_"), WithMigrations(false))
+	require.Error(t, err)
+	require.NoError(t, Migrate(db, WithTablePrefix("media_")))
+	media, err := New(db, WithTablePrefix("media_"), WithMigrations(false))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, media.Close())
+	})
+	require.NoError(t, media.UpsertFile("video.mp4", 16, []byte("mp4")))
+
+	_, err = New(db, WithTablePrefix("docs; DROP TABLE users"))
+	require.Error(t, err)
+}
+
+func Test_NewSqliteFSOptions(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "options.db")
+	sqliteFS, err := NewSqliteFS(dbName,
+		WithChunkSize(4),
+		WithJournalMode("delete"),
+		WithSynchronous("normal"),
+		WithCacheSize(-4096),
+		WithBusyTimeout(time.Second),
+		WithMaxOpenConns(4),
+		WithMaxIdleConns(2),
+		WithConnMaxLifetime(time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, sqliteFS.UpsertFile("default/chunks", 0, []byte("0123456789")))
+	require.NoError(t, sqliteFS.UpsertFile("explicit/chunks", 8, []byte("0123456789")))
+	require.NoError(t, sqliteFS.Close())
+
+	db, err := sqlx.Open(sqliteDriver, dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	var journalMode string
+	require.NoError(t, db.Get(&journalMode, "PRAGMA journal_mode"))
+	require.Equal(t, "delete", journalMode)
+	var chunks []int
+	require.NoError(t, db.Select(&chunks, `
+		SELECT count(1)
+		FROM github_dgsb_dbfs_chunks JOIN github_dgsb_dbfs_files USING (inode)
+		GROUP BY full_path
+		ORDER BY full_path`))
+	require.Equal(t, []int{3, 2}, chunks)
+
+	for name, opts := range map[string][]Option{
+		"read only": {WithReadOnly(), WithJournalMode("delete"), WithMigrations(false)},
+		"immutable": {WithImmutable(), WithJournalMode("delete"), WithMigrations(false)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			roFS, err := NewSqliteFS(dbName, opts...)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, roFS.Close())
+			})
+			data, err := fs.ReadFile(roFS, "default/chunks")
+			require.NoError(t, err)
+			require.Equal(t, "0123456789", string(data))
+			require.Error(t, roFS.UpsertFile("another/file", 0, []byte("data")))
+		})
+	}
+
+	for name, opt := range map[string]Option{
+		"chunk size":   WithChunkSize(0),
+		"journal mode": WithJournalMode("sometimes"),
+		"synchronous":  WithSynchronous("always"),
+		"busy timeout": WithBusyTimeout(-time.Second),
+		"table prefix": WithTablePrefix("1st"),
+	} {
+		_, err := NewSqliteFS(":memory:", opt)
+		require.Error(t, err, name)
+	}
+}
@@ -0,0 +1,90 @@
+package dbfs
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/GuiaBolso/darwin"
+	"github.com/hashicorp/go-multierror"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// NewPostgresFS creates a new file system stored in the PostgreSQL
+// database reached with dsn. The schema migrations are run if needed.
+// Several FS, possibly on several servers, can share the same database.
+// The sqlite specific options are ignored.
+func NewPostgresFS(dsn string, opts ...Option) (*FS, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("canot open the database: %w", err)
+	}
+	for _, setup := range cfg.pool {
+		setup(db.DB)
+	}
+	fs := &FS{dialect: postgresDialect{}, ownsDB: true}
+	if err := fs.init(db, cfg); err != nil {
+		return nil, multierror.Append(err, fs.Close())
+	}
+	return fs, nil
+}
+
+func isPostgresDriver(d driver.Driver) bool {
+	_, ok := d.(*pq.Driver)
+	return ok
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) bindType() int {
+	return sqlx.DOLLAR
+}
+
+func (postgresDialect) migrationDialect() darwin.Dialect {
+	return darwin.PostgresDialect{}
+}
+
+func (postgresDialect) migrationDir() string {
+	return "migrations/postgres"
+}
+
+// writeLockQuery takes a transaction level advisory lock
+// keyed on the files table name.
+func (postgresDialect) writeLockQuery() string {
+	return "SELECT pg_advisory_xact_lock(hashtext('github_dgsb_dbfs_files'))"
+}
+
+// changeVersionQuery is the last change logged. The writers being
+// serialized, the changes are committed in sequence order.
+func (postgresDialect) changeVersionQuery() string {
+	return "SELECT COALESCE(max(seq), 0) FROM github_dgsb_dbfs_changes"
+}
+
+// readTxOptions asks for a repeatable read transaction which sees
+// the same snapshot for all its statements.
+func (postgresDialect) readTxOptions() *sql.TxOptions {
+	return &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+}
+
+func (postgresDialect) isBusy(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", "40P01", "55P03":
+			// serialization_failure, deadlock_detected, lock_not_available
+			return true
+		}
+	}
+	return false
+}
+
+// fullTextIndexQueries is nil, the full text index relies on sqlite FTS5.
+func (postgresDialect) fullTextIndexQueries() []string {
+	return nil
+}
@@ -0,0 +1,182 @@
+package dbfs_test
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+// newPostgresFS returns an FS in a schema of its own of the database
+// given by the DBFS_POSTGRES_DSN environment variable.
+// The test is skipped when the variable is not set.
+func newPostgresFS(t *testing.T) *FS {
+	dsn := os.Getenv("DBFS_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("DBFS_POSTGRES_DSN is not set")
+	}
+
+	admin, err := sqlx.Open("postgres", dsn)
+	require.NoError(t, err)
+	schema := fmt.Sprintf("dbfs_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		require.NoError(t, err)
+		require.NoError(t, admin.Close())
+	})
+
+	if u, err := url.Parse(dsn); err == nil && strings.HasPrefix(u.Scheme, "postgres") {
+		params := u.Query()
+		params.Set("search_path", schema)
+		u.RawQuery = params.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+	pgFS, err := NewPostgresFS(dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, pgFS.Close())
+	})
+	return pgFS
+}
+
+func Test_Postgres(t *testing.T) {
+	pgFS := newPostgresFS(t)
+	ctx := context.Background()
+
+	require.NoError(t, pgFS.UpsertFiles(map[string][]byte{
+		"poésie/lamartine/le_lac": []byte(leLac),
+		"notes/todo":              []byte("replicate"),
+	}, 64))
+	require.NoError(t, fstest.TestFS(pgFS, "poésie/lamartine/le_lac", "notes/todo"))
+	data, err := fs.ReadFile(pgFS, "poésie/lamartine/le_lac")
+	require.NoError(t, err)
+	require.Equal(t, leLac, string(data))
+
+	info, err := fs.Stat(pgFS, "notes/todo")
+	require.NoError(t, err)
+	generation := info.Sys().(SysInfo).Generation
+	require.NoError(t, pgFS.UpsertFile("notes/todo", 4, []byte("replicate and sync"), IfMatch(generation)))
+	require.ErrorIs(t, pgFS.UpsertFile("notes/todo", 4, []byte("lost"), IfMatch(generation)), ConflictErr)
+
+	require.NoError(t, pgFS.Update(func(tx *Tx) error {
+		if err := tx.Rename("poésie", "poetry"); err != nil {
+			return err
+		}
+		return tx.Remove("notes/todo")
+	}))
+	data, err = fs.ReadFile(pgFS, "poetry/lamartine/le_lac")
+	require.NoError(t, err)
+	require.Equal(t, leLac, string(data))
+	require.NoError(t, pgFS.Symlink("../poetry/lamartine", "links/lamartine"))
+	data, err = fs.ReadFile(pgFS, "links/lamartine/le_lac")
+	require.NoError(t, err)
+	require.Equal(t, leLac, string(data))
+	target, err := pgFS.ReadLink("links/lamartine")
+	require.NoError(t, err)
+	require.Equal(t, "../poetry/lamartine", target)
+	require.NoError(t, pgFS.Clone("poetry", "clones/poetry"))
+	require.NoError(t, pgFS.UpsertFile("poetry/lamartine/le_lac", 64, []byte("rewritten")))
+	data, err = fs.ReadFile(pgFS, "clones/poetry/lamartine/le_lac")
+	require.NoError(t, err)
+	require.Equal(t, leLac, string(data))
+	require.NoError(t, pgFS.SetXattr("clones/poetry/lamartine/le_lac", "owner", []byte("alphonse")))
+	require.NoError(t, pgFS.SetXattr("clones/poetry/lamartine/le_lac", "owner", []byte("lamartine")))
+	value, err := pgFS.GetXattr("clones/poetry/lamartine/le_lac", "owner")
+	require.NoError(t, err)
+	require.Equal(t, "lamartine", string(value))
+	it := pgFS.Find(ctx, Query{
+		Prefix:  "clones",
+		Pattern: "*/*/*/le_*",
+		Types:   []string{RegularFileType},
+		Xattrs:  []XattrCondition{{Name: "owner", Value: []byte("lamartine")}},
+	})
+	require.True(t, it.Next())
+	require.Equal(t, "clones/poetry/lamartine/le_lac", it.Path())
+	require.Equal(t, int64(len(leLac)), it.Info().Size())
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+	_, err = pgFS.Search("lamartine")
+	require.ErrorIs(t, err, FullTextDisabledErr)
+	require.NoError(t, pgFS.DeleteFile("clones/poetry/lamartine/le_lac"))
+	require.NoError(t, pgFS.UpsertFile("poetry/lamartine/le_lac", 64, []byte(leLac)))
+	_, err = fs.Stat(pgFS, "notes/todo")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+
+	view, err := pgFS.View()
+	require.NoError(t, err)
+	require.NoError(t, pgFS.DeleteFile("poetry/lamartine/le_lac"))
+	data, err = fs.ReadFile(view, "poetry/lamartine/le_lac")
+	require.NoError(t, err)
+	require.Equal(t, leLac, string(data))
+	require.NoError(t, view.Close())
+
+	_, err = pgFS.Lock("deploy", "server-1", time.Minute)
+	require.NoError(t, err)
+	_, err = pgFS.Lock("deploy", "server-2", time.Minute)
+	require.ErrorIs(t, err, LockedErr)
+
+	set, err := pgFS.ChangesSince(0)
+	require.NoError(t, err)
+	require.NotEmpty(t, set.Changes)
+
+	require.NoError(t, pgFS.CreateVolume("tenant"))
+	tenant, err := pgFS.OpenVolume("tenant")
+	require.NoError(t, err)
+	require.NoError(t, tenant.UpsertFile("poetry/lamartine/le_lac", 64, []byte("tenant")))
+	data, err = fs.ReadFile(tenant, "poetry/lamartine/le_lac")
+	require.NoError(t, err)
+	require.Equal(t, "tenant", string(data))
+	_, err = fs.Stat(pgFS, "poetry/lamartine/le_lac")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+	require.NoError(t, pgFS.DeleteVolume("tenant"))
+
+	report, err := pgFS.Check(ctx, CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Problems)
+	scrub, err := pgFS.Scrub(ctx)
+	require.NoError(t, err)
+	require.Empty(t, scrub.Corrupted)
+}
+
+func Test_PostgresReplication(t *testing.T) {
+	primary := newPostgresFS(t)
+	follower, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, follower.Close())
+	})
+
+	require.NoError(t, primary.UpsertFiles(map[string][]byte{
+		"a/b/c": []byte("abc"),
+		"d":     []byte("d"),
+	}, 2))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	events := primary.Watch(ctx, "a")
+	require.NoError(t, primary.UpsertFile("a/b/c", 2, []byte("abcd")))
+	select {
+	case event := <-events:
+		require.Equal(t, ModifyEvent, event.Op)
+		require.Equal(t, "a/b/c", event.Path)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "missing event")
+	}
+
+	_, err = NewReplicator("primary", primary, follower).CatchUp(ctx)
+	require.NoError(t, err)
+	require.Equal(t, fsContent(t, primary), fsContent(t, follower))
+}
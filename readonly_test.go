@@ -0,0 +1,119 @@
+package dbfs_test
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ReadOnly(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "bundle.db")
+	rwFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	require.NoError(t, rwFS.UpsertFiles(map[string][]byte{
+		"assets/index.html": []byte("<h1>bundle</h1>"),
+		"assets/app.js":     []byte("console.log('bundle')"),
+	}, 8))
+	require.NoError(t, rwFS.Close())
+
+	for name, opt := range map[string]Option{
+		"read only": WithReadOnly(),
+		"immutable": WithImmutable(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			roFS, err := NewSqliteFS(dbName, opt)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, roFS.Close())
+			})
+
+			require.NoError(t, fstest.TestFS(roFS, "assets/index.html", "assets/app.js"))
+			data, err := fs.ReadFile(roFS, "assets/index.html")
+			require.NoError(t, err)
+			require.Equal(t, "<h1>bundle</h1>", string(data))
+			report, err := roFS.Check(context.Background(), CheckOptions{})
+			require.NoError(t, err)
+			require.True(t, report.Clean(), "%v", report.Problems)
+
+			mutations := map[string]func() error{
+				"upsert file": func() error {
+					return roFS.UpsertFile("assets/index.html", 8, []byte("changed"))
+				},
+				"upsert files": func() error {
+					return roFS.UpsertFiles(map[string][]byte{"new/file": []byte("new")}, 8)
+				},
+				"delete file": func() error {
+					return roFS.DeleteFile("assets/app.js")
+				},
+				"update": func() error {
+					return roFS.Update(func(tx *Tx) error {
+						return tx.Mkdir("new")
+					})
+				},
+				"repair": func() error {
+					_, err := roFS.Check(context.Background(), CheckOptions{Repair: true})
+					return err
+				},
+				"lock": func() error {
+					_, err := roFS.Lock("deploy", "me", time.Minute)
+					return err
+				},
+				"sync": func() error {
+					other, err := NewSqliteFS(":memory:")
+					require.NoError(t, err)
+					defer other.Close()
+					_, err = Sync(other, roFS, SyncOptions{})
+					return err
+				},
+				"replication": func() error {
+					source, err := NewSqliteFS(":memory:")
+					require.NoError(t, err)
+					defer source.Close()
+					_, err = NewReplicator("source", source, roFS).CatchUp(context.Background())
+					return err
+				},
+			}
+			for name, mutate := range mutations {
+				require.ErrorIs(t, mutate(), fs.ErrPermission, name)
+			}
+
+			data, err = fs.ReadFile(roFS, "assets/app.js")
+			require.NoError(t, err)
+			require.Equal(t, "console.log('bundle')", string(data))
+		})
+	}
+}
+
+func Test_ReadOnlyVerifiesMigrations(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "empty.db")
+	db, err := sql.Open(sqliteDriver, sqliteTestDSN(dbName))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	require.NoError(t, db.Ping())
+
+	_, err = NewSqliteFS(dbName, WithReadOnly())
+	require.Error(t, err)
+	_, err = New(db, WithReadOnly())
+	require.Error(t, err)
+
+	var tables int
+	require.NoError(t, db.QueryRow("SELECT count(1) FROM sqlite_master").Scan(&tables))
+	require.Zero(t, tables)
+
+	require.NoError(t, Migrate(db))
+	roFS, err := New(db, WithReadOnly())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, roFS.Close())
+	})
+	require.ErrorIs(t, roFS.UpsertFile("a/file", 8, []byte("data")), fs.ErrPermission)
+}
@@ -0,0 +1,664 @@
+package dbfs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// changeBatchSize bounds the number of changes returned by ChangesSince
+// and by Snapshot, and the number of chunks fetched at once over HTTP.
+const changeBatchSize = 256
+
+// Change is a logged change along with what a follower
+// needs to apply it.
+type Change struct {
+	Event
+	// HasContent reports whether ChunkSize and Checksums describe the
+	// content of the file. The content is only sent with the first change
+	// of a file in a ChangeSet and is the content the file has when the
+	// ChangeSet is built. It is not sent for a file deleted since.
+	HasContent bool
+	ChunkSize  int
+	// Checksums holds the checksum of each chunk of the content. The data
+	// of the chunks is read with ChunksContext from Inode, the inode of the
+	// node on the source, so that a follower only fetches the chunks
+	// it does not have yet.
+	Checksums [][]byte
+	Inode     int
+	// Xattrs holds the extended attributes of the node when they are
+	// sent, along with the first change of the node in a ChangeSet.
+	// It is nil when they are not sent.
+	Xattrs map[string][]byte
+}
+
+// ChangeSet is a batch of changes returned by ChangesSince or a page of Snapshot.
+type ChangeSet struct {
+	Changes []Change
+	// Last is the sequence number to give to the next ChangesSince call.
+	Last int64
+}
+
+// ChunkRef designates the chunk at Position in the content of the node Inode.
+type ChunkRef struct {
+	Inode    int
+	Position int
+}
+
+// ChangeSource provides the changes made to a file system.
+// It is implemented by FS and by HTTPChangeSource.
+type ChangeSource interface {
+	SnapshotContext(ctx context.Context, after string) (ChangeSet, error)
+	ChangesSinceContext(ctx context.Context, seq int64) (ChangeSet, error)
+	ChunksContext(ctx context.Context, refs []ChunkRef) ([][]byte, error)
+}
+
+// ChangesSince returns the changes logged after the sequence number seq.
+// The changes are returned in batches, the call must be repeated with the
+// Last sequence number of the previous ChangeSet until no change is returned.
+// ChangesPrunedErr is returned if changes following seq have been pruned.
+func (fs *FS) ChangesSince(seq int64) (ChangeSet, error) {
+	return fs.ChangesSinceContext(context.Background(), seq)
+}
+
+// ChangesSinceContext is ChangesSince honouring the ctx cancellation.
+func (fs *FS) ChangesSinceContext(ctx context.Context, seq int64) (ChangeSet, error) {
+	tx, err := fs.beginRead(ctx)
+	if err != nil {
+		return ChangeSet{}, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	pruned, err := fs.prunedSeq(ctx, tx)
+	if err != nil {
+		return ChangeSet{}, err
+	}
+	if seq < pruned {
+		return ChangeSet{}, fmt.Errorf("%w: changes up to %d are needed after %d", ChangesPrunedErr, pruned, seq)
+	}
+
+	events, err := fs.readChanges(ctx, tx, seq, changeBatchSize)
+	if err != nil {
+		return ChangeSet{}, err
+	}
+
+	set := ChangeSet{Changes: make([]Change, 0, len(events)), Last: seq}
+	sent := map[int]bool{}
+	for _, event := range events {
+		change := Change{Event: event}
+		set.Last = event.Seq
+		if event.Op != DeleteEvent && event.inode != 0 && !sent[event.inode] {
+			sent[event.inode] = true
+			if change, err = fs.describeChange(ctx, tx, event); err != nil {
+				return ChangeSet{}, err
+			}
+		}
+		set.Changes = append(set.Changes, change)
+	}
+	return set, nil
+}
+
+// Snapshot returns a page of the current content of the file system as
+// a set of creations: the nodes whose path follows after, in the order
+// of the paths. The call must be repeated with the Path of the last change
+// of the previous page until an empty page is returned.
+// The Last sequence number of the first page is the position in the change
+// log from which the following changes can be read. Replaying them brings
+// the pages, read at different times, to a consistent state.
+// It is the starting point of a new follower.
+func (fs *FS) Snapshot(after string) (ChangeSet, error) {
+	return fs.SnapshotContext(context.Background(), after)
+}
+
+// SnapshotContext is Snapshot honouring the ctx cancellation.
+func (fs *FS) SnapshotContext(ctx context.Context, after string) (ChangeSet, error) {
+	tx, err := fs.beginRead(ctx)
+	if err != nil {
+		return ChangeSet{}, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	set := ChangeSet{Changes: []Change{}}
+	if err := tx.GetContext(ctx, &set.Last,
+		fs.query("SELECT COALESCE(max(seq), 0) FROM github_dgsb_dbfs_changes WHERE root = ?"), fs.rootInode); err != nil {
+		return ChangeSet{}, fmt.Errorf("cannot query the change log: %w", err)
+	}
+	// the whole change log of the volume may have been pruned
+	pruned, err := fs.prunedSeq(ctx, tx)
+	if err != nil {
+		return ChangeSet{}, err
+	}
+	if pruned > set.Last {
+		set.Last = pruned
+	}
+
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT inode, full_path, type
+		FROM github_dgsb_dbfs_files
+		WHERE root = ? AND inode <> ? AND full_path > ?
+		ORDER BY full_path
+		LIMIT ?`), fs.rootInode, fs.rootInode, after, changeBatchSize)
+	if err != nil {
+		return ChangeSet{}, fmt.Errorf("cannot query files table: %w", err)
+	}
+	var events []Event
+	for rows.Next() {
+		event := Event{Seq: set.Last, Op: CreateEvent, Time: time.Now()}
+		if err := rows.Scan(&event.inode, &event.Path, &event.Type); err != nil {
+			rows.Close()
+			return ChangeSet{}, fmt.Errorf("cannot scan files table: %w", err)
+		}
+		events = append(events, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return ChangeSet{}, fmt.Errorf("cannot iterate over files table: %w", err)
+	}
+
+	for _, event := range events {
+		change, err := fs.describeChange(ctx, tx, event)
+		if err != nil {
+			return ChangeSet{}, err
+		}
+		set.Changes = append(set.Changes, change)
+	}
+	return set, nil
+}
+
+// describeChange returns the change of event along with the checksums
+// of the content and the extended attributes the node has now.
+func (fs *FS) describeChange(ctx context.Context, tx *sqlx.Tx, event Event) (Change, error) {
+	change := Change{Event: event}
+	var err error
+	if hasContent(event.Type) {
+		if change.HasContent, change.ChunkSize, change.Checksums, err = fs.readChecksums(ctx, tx, event.inode); err != nil {
+			return Change{}, err
+		}
+		if change.HasContent {
+			change.Inode = event.inode
+		}
+	}
+	if change.Xattrs, err = fs.readXattrs(ctx, tx, event.inode); err != nil {
+		return Change{}, err
+	}
+	return change, nil
+}
+
+// Chunks returns the data of the chunks designated by refs, as found in
+// the Checksums of the changes. The data is nil for the chunks which do
+// not exist anymore.
+func (fs *FS) Chunks(refs []ChunkRef) ([][]byte, error) {
+	return fs.ChunksContext(context.Background(), refs)
+}
+
+// ChunksContext is Chunks honouring the ctx cancellation.
+func (fs *FS) ChunksContext(ctx context.Context, refs []ChunkRef) ([][]byte, error) {
+	tx, err := fs.beginRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	chunks := make([][]byte, len(refs))
+	for i, ref := range refs {
+		err := tx.GetContext(ctx, &chunks[i], fs.query(`
+			SELECT c.data
+			FROM github_dgsb_dbfs_files f
+				JOIN github_dgsb_dbfs_chunks c ON c.inode = COALESCE(f.content, f.inode)
+			WHERE f.inode = ? AND f.root = ? AND c.position = ?`), ref.Inode, fs.rootInode, ref.Position)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("cannot query chunk %d of inode %d: %w", ref.Position, ref.Inode, err)
+		}
+	}
+	return chunks, nil
+}
+
+// hasContent reports whether the nodes of type ftype have a content
+// stored in chunks: the data of a regular file or the target of a link.
+func hasContent(ftype string) bool {
+	return ftype == RegularFileType || ftype == SymlinkType
+}
+
+// readContent returns the content of the regular file or symbolic link inode
+// and the size of its chunks. It reports false if the inode does not exist anymore.
+func (fs *FS) readContent(ctx context.Context, tx *sqlx.Tx, inode int) (bool, int, []byte, error) {
+	var (
+		ftype   string
+		content int
+	)
+	err := tx.QueryRowxContext(ctx,
+		fs.query("SELECT type, COALESCE(content, inode) FROM github_dgsb_dbfs_files WHERE inode = ?"), inode).
+		Scan(&ftype, &content)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !hasContent(ftype)) {
+		return false, 0, nil, nil
+	} else if err != nil {
+		return false, 0, nil, fmt.Errorf("cannot query inode %d: %w", inode, err)
+	}
+
+	rows, err := tx.QueryxContext(ctx,
+		fs.query("SELECT data, size FROM github_dgsb_dbfs_chunks WHERE inode = ? ORDER BY position"), content)
+	if err != nil {
+		return false, 0, nil, fmt.Errorf("cannot query chunks of inode %d: %w", inode, err)
+	}
+	defer rows.Close()
+
+	var (
+		chunkSize int
+		data      = []byte{}
+	)
+	for rows.Next() {
+		var (
+			chunk []byte
+			size  int
+		)
+		if err := rows.Scan(&chunk, &size); err != nil {
+			return false, 0, nil, fmt.Errorf("cannot scan chunk of inode %d: %w", inode, err)
+		}
+		if size > chunkSize {
+			chunkSize = size
+		}
+		data = append(data, chunk...)
+	}
+	if err := rows.Err(); err != nil {
+		return false, 0, nil, fmt.Errorf("cannot iterate over chunks of inode %d: %w", inode, err)
+	}
+	return true, chunkSize, data, nil
+}
+
+// readChecksums returns the checksums of the chunks of the regular file
+// or symbolic link inode and the size of its chunks. It reports false
+// if the inode does not exist anymore. The data is only read for the
+// chunks written before the checksums were introduced.
+func (fs *FS) readChecksums(ctx context.Context, tx *sqlx.Tx, inode int) (bool, int, [][]byte, error) {
+	var (
+		ftype   string
+		content int
+	)
+	err := tx.QueryRowxContext(ctx,
+		fs.query("SELECT type, COALESCE(content, inode) FROM github_dgsb_dbfs_files WHERE inode = ?"), inode).
+		Scan(&ftype, &content)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !hasContent(ftype)) {
+		return false, 0, nil, nil
+	} else if err != nil {
+		return false, 0, nil, fmt.Errorf("cannot query inode %d: %w", inode, err)
+	}
+
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT size, checksum, CASE WHEN checksum IS NULL THEN data END
+		FROM github_dgsb_dbfs_chunks
+		WHERE inode = ?
+		ORDER BY position`), content)
+	if err != nil {
+		return false, 0, nil, fmt.Errorf("cannot query chunks of inode %d: %w", inode, err)
+	}
+	defer rows.Close()
+
+	var (
+		chunkSize int
+		checksums = [][]byte{}
+	)
+	for rows.Next() {
+		var (
+			size     int
+			checksum []byte
+			data     []byte
+		)
+		if err := rows.Scan(&size, &checksum, &data); err != nil {
+			return false, 0, nil, fmt.Errorf("cannot scan chunk of inode %d: %w", inode, err)
+		}
+		if checksum == nil {
+			checksum = chunkChecksum(data)
+		}
+		if size > chunkSize {
+			chunkSize = size
+		}
+		checksums = append(checksums, checksum)
+	}
+	if err := rows.Err(); err != nil {
+		return false, 0, nil, fmt.Errorf("cannot iterate over chunks of inode %d: %w", inode, err)
+	}
+	return true, chunkSize, checksums, nil
+}
+
+// Replicator applies the changes of a source file system to a follower FS.
+// The position reached in the source change log is stored in the follower
+// database along with the applied changes, so a Replicator can be stopped
+// and restarted at any time. The follower should not be written otherwise.
+type Replicator struct {
+	name   string
+	source ChangeSource
+	target *FS
+}
+
+// NewReplicator creates a Replicator copying source to target.
+// name identifies the source in the replication state of the target.
+func NewReplicator(name string, source ChangeSource, target *FS) *Replicator {
+	return &Replicator{name: name, source: source, target: target}
+}
+
+// CatchUp applies all the pending changes of the source
+// and returns the number of changes applied.
+// The first calls copy the whole content of the source, one page of its
+// snapshot at a time. The path reached is stored along with the pages so
+// that an interrupted copy resumes where it stopped.
+// An error wrapping ChangesPrunedErr is returned when the changes the
+// follower needs have been pruned from the source, see FS.PruneChanges.
+func (r *Replicator) CatchUp(ctx context.Context) (int, error) {
+	if err := r.target.checkWritable(); err != nil {
+		return 0, err
+	}
+	applied := 0
+	for {
+		var (
+			seq   int64
+			after sql.NullString
+			set   ChangeSet
+		)
+		err := r.target.db.QueryRowxContext(ctx, r.target.query(`
+			SELECT seq, snapshot_after FROM github_dgsb_dbfs_replication WHERE root = ? AND source = ?`),
+			r.target.rootInode, r.name).Scan(&seq, &after)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if set, err = r.source.SnapshotContext(ctx, ""); err != nil {
+				return applied, fmt.Errorf("cannot get snapshot of %s: %w", r.name, err)
+			}
+			// the changes made while the snapshot is copied are replayed after it
+			seq = set.Last
+			after.Valid = true
+		case err != nil:
+			return applied, fmt.Errorf("cannot query replication state of %s: %w", r.name, err)
+		case after.Valid:
+			if set, err = r.source.SnapshotContext(ctx, after.String); err != nil {
+				return applied, fmt.Errorf("cannot get snapshot of %s: %w", r.name, err)
+			}
+		default:
+			if set, err = r.source.ChangesSinceContext(ctx, seq); err != nil {
+				return applied, fmt.Errorf("cannot get changes of %s: %w", r.name, err)
+			}
+			if len(set.Changes) == 0 {
+				return applied, nil
+			}
+			seq = set.Last
+		}
+		if after.Valid {
+			if len(set.Changes) == 0 {
+				after.Valid = false
+			} else {
+				after.String = set.Changes[len(set.Changes)-1].Path
+			}
+		}
+
+		contents, err := r.fetchContents(ctx, set.Changes)
+		if err != nil {
+			return applied, err
+		}
+		if err := r.target.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+			for i, change := range set.Changes {
+				if err := r.target.applyChange(ctx, tx, change, contents[i]); err != nil {
+					return fmt.Errorf("cannot apply change %d of %s: %w", change.Seq, r.name, err)
+				}
+			}
+			if _, err := tx.ExecContext(ctx, r.target.query(`
+				INSERT INTO github_dgsb_dbfs_replication (root, source, seq, snapshot_after) VALUES (?, ?, ?, ?)
+				ON CONFLICT (root, source) DO UPDATE SET seq = excluded.seq, snapshot_after = excluded.snapshot_after`),
+				r.target.rootInode, r.name, seq, after); err != nil {
+				return fmt.Errorf("cannot store replication state of %s: %w", r.name, err)
+			}
+			return nil
+		}); err != nil {
+			return applied, err
+		}
+		applied += len(set.Changes)
+	}
+}
+
+// Run catches up with the source every interval until ctx is done.
+func (r *Replicator) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.CatchUp(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchContents returns the contents of the changes carrying one, by the
+// index of the change. The chunks the target already has at the same
+// position of the same file are read locally, only the others are fetched
+// from the source. A content whose chunks have changed on the source since
+// the changes have been read is left out: the change which modified it
+// follows in the change log and carries the new content.
+func (r *Replicator) fetchContents(ctx context.Context, changes []Change) (map[int][]byte, error) {
+	type missingChunk struct {
+		change   int
+		position int
+	}
+	var (
+		chunks  = map[int][][]byte{}
+		missing []missingChunk
+		refs    []ChunkRef
+	)
+	if err := func() error {
+		tx, err := r.target.beginRead(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot start transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		for i, change := range changes {
+			if !change.HasContent {
+				continue
+			}
+			name := change.Path
+			if change.Op == RenameEvent {
+				name = change.OldPath
+			}
+			local, err := r.target.readLocalChunks(ctx, tx, name)
+			if err != nil {
+				return err
+			}
+			chunks[i] = make([][]byte, len(change.Checksums))
+			for position, checksum := range change.Checksums {
+				if chunk, ok := local[position]; ok && bytes.Equal(chunk.checksum, checksum) {
+					chunks[i][position] = chunk.data
+					continue
+				}
+				missing = append(missing, missingChunk{change: i, position: position})
+				refs = append(refs, ChunkRef{Inode: change.Inode, Position: position})
+			}
+		}
+		return nil
+	}(); err != nil {
+		return nil, err
+	}
+
+	if len(refs) > 0 {
+		fetched, err := r.source.ChunksContext(ctx, refs)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get chunks of %s: %w", r.name, err)
+		}
+		if len(fetched) != len(refs) {
+			return nil, fmt.Errorf("%s returned %d chunks instead of %d", r.name, len(fetched), len(refs))
+		}
+		for i, chunk := range missing {
+			if !bytes.Equal(chunkChecksum(fetched[i]), changes[chunk.change].Checksums[chunk.position]) {
+				delete(chunks, chunk.change)
+				continue
+			}
+			if _, ok := chunks[chunk.change]; ok {
+				chunks[chunk.change][chunk.position] = fetched[i]
+			}
+		}
+	}
+
+	contents := make(map[int][]byte, len(chunks))
+	for i, content := range chunks {
+		contents[i] = bytes.Join(content, nil)
+	}
+	return contents, nil
+}
+
+// localChunk is a chunk stored in the target of a Replicator.
+type localChunk struct {
+	checksum []byte
+	data     []byte
+}
+
+// readLocalChunks returns the chunks of the content of the file name by
+// their position, none if it does not exist or has no content.
+func (fs *FS) readLocalChunks(ctx context.Context, tx *sqlx.Tx, name string) (map[int]localChunk, error) {
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT c.position, c.checksum, c.data
+		FROM github_dgsb_dbfs_files f
+			JOIN github_dgsb_dbfs_chunks c ON c.inode = COALESCE(f.content, f.inode)
+		WHERE f.root = ? AND f.full_path = ?`), fs.rootInode, name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query the chunks of %s: %w", name, err)
+	}
+	defer rows.Close()
+
+	chunks := map[int]localChunk{}
+	for rows.Next() {
+		var (
+			position int
+			chunk    localChunk
+		)
+		if err := rows.Scan(&position, &chunk.checksum, &chunk.data); err != nil {
+			return nil, fmt.Errorf("cannot scan the chunks of %s: %w", name, err)
+		}
+		if chunk.checksum == nil {
+			chunk.checksum = chunkChecksum(chunk.data)
+		}
+		chunks[position] = chunk
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over the chunks of %s: %w", name, err)
+	}
+	return chunks, nil
+}
+
+// applyChange replays change in tx, data being its content or nil
+// when it carries none. Changes referring to nodes which do not exist
+// anymore are skipped: their outcome is carried by the later changes.
+// The target may be ahead of change, when the content has been read
+// after it or when a snapshot page has been read after it: the nodes
+// standing in its way are replaced, the later changes restoring them.
+func (fs *FS) applyChange(ctx context.Context, tx *sqlx.Tx, change Change, data []byte) error {
+	if err := fs.applyNodeChange(ctx, tx, change, data); err != nil {
+		return err
+	}
+	if change.Xattrs == nil {
+		return nil
+	}
+	if err := fs.replaceXattrs(ctx, tx, change.Path, change.Xattrs); err != nil && !errors.Is(err, InodeNotFoundErr) {
+		return err
+	}
+	return nil
+}
+
+// applyNodeChange replays the change of the node itself,
+// its extended attributes are left to applyChange.
+func (fs *FS) applyNodeChange(ctx context.Context, tx *sqlx.Tx, change Change, data []byte) error {
+	switch change.Op {
+	case CreateEvent, ModifyEvent:
+		if change.Type != DirectoryType && data == nil {
+			return nil
+		}
+		if err := fs.clearPath(ctx, tx, change.Path, change.Type); err != nil {
+			return err
+		}
+		if change.Type == DirectoryType {
+			return fs.mkdir(ctx, tx, change.Path, true)
+		}
+		_, err := fs.writeNode(ctx, tx, change.Path, change.Type, change.ChunkSize, data)
+		return err
+	case DeleteEvent:
+		return fs.removeTree(ctx, tx, change.Path)
+	case RenameEvent:
+		_, _, err := fs.namei(ctx, tx, change.OldPath)
+		switch {
+		case err == nil && change.OldPath != change.Path:
+			if err := fs.removeTree(ctx, tx, change.Path); err != nil {
+				return err
+			}
+			if err := fs.clearPath(ctx, tx, path.Dir(change.Path), DirectoryType); err != nil {
+				return err
+			}
+			if err := fs.rename(ctx, tx, change.OldPath, change.Path); err != nil &&
+				!errors.Is(err, InodeNotFoundErr) {
+				return err
+			}
+		case err != nil && !errors.Is(err, InodeNotFoundErr):
+			return err
+		}
+		if data == nil {
+			return nil
+		}
+		if err := fs.clearPath(ctx, tx, change.Path, change.Type); err != nil {
+			return err
+		}
+		_, err = fs.writeNode(ctx, tx, change.Path, change.Type, change.ChunkSize, data)
+		return err
+	case XattrEvent:
+		return nil
+	default:
+		return fmt.Errorf("unknown change %s", change.Op)
+	}
+}
+
+// clearPath removes the nodes preventing the creation of the node name
+// of type ftype: a node of another type at name or a node which is not
+// a directory in its parents.
+func (fs *FS) clearPath(ctx context.Context, tx *sqlx.Tx, name string, ftype string) error {
+	if name == "." {
+		return nil
+	}
+	if err := fs.clearPath(ctx, tx, path.Dir(name), DirectoryType); err != nil {
+		return err
+	}
+	_, existing, err := fs.namei(ctx, tx, name)
+	switch {
+	case errors.Is(err, InodeNotFoundErr):
+		return nil
+	case err != nil:
+		return err
+	case existing != ftype:
+		return fs.removeTree(ctx, tx, name)
+	}
+	return nil
+}
+
+// removeTree deletes the node name and all its descendants, if any.
+func (fs *FS) removeTree(ctx context.Context, tx *sqlx.Tx, name string) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+	children, childrenArgs := underDir("full_path", name)
+	var names []string
+	if err := tx.SelectContext(ctx, &names, fs.query(`
+		SELECT full_path FROM github_dgsb_dbfs_files
+		WHERE root = ? AND (full_path = ? OR `+children+`)
+		ORDER BY full_path DESC`), append([]any{fs.rootInode, name}, childrenArgs...)...); err != nil {
+		return fmt.Errorf("cannot query the tree of %s: %w", name, err)
+	}
+	// the descendants of a node sort after it
+	for _, fname := range names {
+		if err := fs.deleteFile(ctx, tx, fname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
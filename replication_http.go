@@ -0,0 +1,183 @@
+package dbfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ChangeFeedHandler serves the change log of fs over HTTP to an HTTPChangeSource.
+// A GET request with a since parameter returns the changes logged after it,
+// or a 410 Gone status when they have been pruned. A GET request with a
+// chunks parameter, a comma separated list of inode:position pairs, returns
+// the data of these chunks. Otherwise a GET request returns the page of
+// the Snapshot following its after parameter.
+func (fs *FS) ChangeFeedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			response any
+			err      error
+		)
+		query := r.URL.Query()
+		if since := query.Get("since"); since != "" {
+			seq, parseErr := strconv.ParseInt(since, 10, 64)
+			if parseErr != nil {
+				http.Error(w, fmt.Sprintf("invalid since parameter: %s", parseErr), http.StatusBadRequest)
+				return
+			}
+			response, err = fs.ChangesSinceContext(r.Context(), seq)
+		} else if chunks := query.Get("chunks"); chunks != "" {
+			refs, parseErr := parseChunkRefs(chunks)
+			if parseErr != nil {
+				http.Error(w, fmt.Sprintf("invalid chunks parameter: %s", parseErr), http.StatusBadRequest)
+				return
+			}
+			response, err = fs.ChunksContext(r.Context(), refs)
+		} else {
+			response, err = fs.SnapshotContext(r.Context(), query.Get("after"))
+		}
+		if errors.Is(err, ChangesPrunedErr) {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// HTTPChangeSource is a ChangeSource reading the changes of a remote
+// file system served by ChangeFeedHandler.
+type HTTPChangeSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPChangeSource creates a ChangeSource reading the change feed served at url.
+// http.DefaultClient is used if client is nil.
+func NewHTTPChangeSource(url string, client *http.Client) *HTTPChangeSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPChangeSource{url: url, client: client}
+}
+
+// SnapshotContext implements ChangeSource.
+func (s *HTTPChangeSource) SnapshotContext(ctx context.Context, after string) (ChangeSet, error) {
+	var set ChangeSet
+	if err := s.get(ctx, url.Values{"after": {after}}, &set); err != nil {
+		return ChangeSet{}, err
+	}
+	return set, nil
+}
+
+// ChangesSinceContext implements ChangeSource.
+func (s *HTTPChangeSource) ChangesSinceContext(ctx context.Context, seq int64) (ChangeSet, error) {
+	var set ChangeSet
+	if err := s.get(ctx, url.Values{"since": {strconv.FormatInt(seq, 10)}}, &set); err != nil {
+		return ChangeSet{}, err
+	}
+	return set, nil
+}
+
+// ChunksContext implements ChangeSource.
+// The chunks are requested changeBatchSize at a time.
+func (s *HTTPChangeSource) ChunksContext(ctx context.Context, refs []ChunkRef) ([][]byte, error) {
+	chunks := make([][]byte, 0, len(refs))
+	for start := 0; start < len(refs); start += changeBatchSize {
+		end := start + changeBatchSize
+		if end > len(refs) {
+			end = len(refs)
+		}
+		var batch [][]byte
+		if err := s.get(ctx, url.Values{"chunks": {formatChunkRefs(refs[start:end])}}, &batch); err != nil {
+			return nil, err
+		}
+		if len(batch) != end-start {
+			return nil, fmt.Errorf("change feed returned %d chunks instead of %d", len(batch), end-start)
+		}
+		chunks = append(chunks, batch...)
+	}
+	return chunks, nil
+}
+
+func (s *HTTPChangeSource) get(ctx context.Context, params url.Values, response any) error {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return fmt.Errorf("invalid change feed url %s: %w", s.url, err)
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("cannot create change feed request: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot query change feed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return fmt.Errorf("%w: change feed returned %s", ChangesPrunedErr, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("change feed returned %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("cannot decode change feed: %w", err)
+	}
+	return nil
+}
+
+// formatChunkRefs encodes refs as the chunks parameter of the change feed.
+func formatChunkRefs(refs []ChunkRef) string {
+	encoded := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		encoded = append(encoded, strconv.Itoa(ref.Inode)+":"+strconv.Itoa(ref.Position))
+	}
+	return strings.Join(encoded, ",")
+}
+
+// parseChunkRefs decodes the chunks parameter of the change feed,
+// which designates at most changeBatchSize chunks.
+func parseChunkRefs(param string) ([]ChunkRef, error) {
+	encoded := strings.Split(param, ",")
+	if len(encoded) > changeBatchSize {
+		return nil, fmt.Errorf("%d chunks requested, at most %d", len(encoded), changeBatchSize)
+	}
+	refs := make([]ChunkRef, 0, len(encoded))
+	for _, e := range encoded {
+		inode, position, ok := strings.Cut(e, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid chunk %q", e)
+		}
+		var (
+			ref ChunkRef
+			err error
+		)
+		if ref.Inode, err = strconv.Atoi(inode); err != nil {
+			return nil, fmt.Errorf("invalid inode in chunk %q: %w", e, err)
+		}
+		if ref.Position, err = strconv.Atoi(position); err != nil {
+			return nil, fmt.Errorf("invalid position in chunk %q: %w", e, err)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
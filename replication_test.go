@@ -0,0 +1,415 @@
+package dbfs_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+// fsContent returns the content of all the regular files of fsys,
+// directories are mapped to a nil content.
+func fsContent(t *testing.T, fsys fs.FS) map[string][]byte {
+	content := map[string][]byte{}
+	require.NoError(t, fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		if d.IsDir() {
+			content[name] = nil
+			return nil
+		}
+		if d.Type() == fs.ModeSymlink {
+			target, err := fsys.(interface{ ReadLink(string) (string, error) }).ReadLink(name)
+			content[name] = []byte("-> " + target)
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		content[name] = data
+		return err
+	}))
+	return content
+}
+
+// observedSource is a ChangeSource recording the chunks fetched, calling
+// beforePage before each snapshot page but the first and beforeChunks
+// before fetching chunks.
+type observedSource struct {
+	*FS
+	beforePage   func()
+	beforeChunks func()
+	pages        int
+	fetched      []ChunkRef
+}
+
+func (s *observedSource) SnapshotContext(ctx context.Context, after string) (ChangeSet, error) {
+	if s.pages > 0 && s.beforePage != nil {
+		s.beforePage()
+	}
+	s.pages++
+	return s.FS.SnapshotContext(ctx, after)
+}
+
+func (s *observedSource) ChunksContext(ctx context.Context, refs []ChunkRef) ([][]byte, error) {
+	if s.beforeChunks != nil {
+		s.beforeChunks()
+	}
+	s.fetched = append(s.fetched, refs...)
+	return s.FS.ChunksContext(ctx, refs)
+}
+
+func Test_Replication(t *testing.T) {
+	for name, newSource := range map[string]func(t *testing.T, primary *FS) ChangeSource{
+		"local": func(t *testing.T, primary *FS) ChangeSource {
+			return primary
+		},
+		"http": func(t *testing.T, primary *FS) ChangeSource {
+			server := httptest.NewServer(primary.ChangeFeedHandler())
+			t.Cleanup(server.Close)
+			return NewHTTPChangeSource(server.URL, server.Client())
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			primary, err := NewSqliteFS(path.Join(dir, "primary.db"))
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, primary.Close())
+			})
+			follower, err := NewSqliteFS(path.Join(dir, "follower.db"))
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, follower.Close())
+			})
+			ctx := context.Background()
+
+			require.NoError(t, primary.UpsertFiles(map[string][]byte{
+				"docs/readme.md":   []byte("# dbfs"),
+				"docs/guide/intro": []byte("an introduction to dbfs"),
+				"empty":            {},
+			}, 8))
+			replicator := NewReplicator("primary", newSource(t, primary), follower)
+			applied, err := replicator.CatchUp(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 5, applied)
+			require.Equal(t, fsContent(t, primary), fsContent(t, follower))
+
+			applied, err = replicator.CatchUp(ctx)
+			require.NoError(t, err)
+			require.Zero(t, applied)
+
+			require.NoError(t, primary.UpsertFile("docs/guide/intro", 8, []byte("a short introduction to dbfs")))
+			require.NoError(t, primary.UpsertFile("docs/guide/intro", 8, []byte("the introduction to dbfs")))
+			require.NoError(t, primary.UpsertFile("docs/guide/advanced", 8, []byte("advanced usage")))
+			require.NoError(t, primary.UpsertFile("tmp/draft", 8, []byte("not for long")))
+			require.NoError(t, primary.Update(func(tx *Tx) error {
+				if err := tx.Rename("docs/guide", "manual"); err != nil {
+					return err
+				}
+				if err := tx.Remove("tmp/draft"); err != nil {
+					return err
+				}
+				return tx.Mkdir("docs/api")
+			}))
+			require.NoError(t, primary.DeleteFile("empty"))
+
+			// a new replicator resumes from the state stored in the follower
+			replicator = NewReplicator("primary", newSource(t, primary), follower)
+			applied, err = replicator.CatchUp(ctx)
+			require.NoError(t, err)
+			require.Positive(t, applied)
+			require.Equal(t, fsContent(t, primary), fsContent(t, follower))
+			data, err := fs.ReadFile(follower, "manual/intro")
+			require.NoError(t, err)
+			require.Equal(t, "the introduction to dbfs", string(data))
+
+			report, err := follower.Check(ctx, CheckOptions{})
+			require.NoError(t, err)
+			require.True(t, report.Clean(), "%v", report.Problems)
+		})
+	}
+}
+
+func Test_ChangesSince(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	snapshot, err := sqliteFS.Snapshot("")
+	require.NoError(t, err)
+	require.Empty(t, snapshot.Changes)
+
+	for i := 0; i < 300; i++ {
+		require.NoError(t, sqliteFS.UpsertFile("counter", 4, []byte{byte(i)}))
+	}
+
+	var (
+		seq     = snapshot.Last
+		changes []Change
+	)
+	for {
+		set, err := sqliteFS.ChangesSince(seq)
+		require.NoError(t, err)
+		if len(set.Changes) == 0 {
+			require.Equal(t, seq, set.Last)
+			break
+		}
+		require.Greater(t, set.Last, seq)
+		require.True(t, set.Changes[0].HasContent)
+		checksum := sha256.Sum256([]byte{byte(299 % 256)})
+		require.Equal(t, [][]byte{checksum[:]}, set.Changes[0].Checksums)
+		chunks, err := sqliteFS.Chunks([]ChunkRef{
+			{Inode: set.Changes[0].Inode, Position: 0},
+			{Inode: set.Changes[0].Inode, Position: 1},
+		})
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{{byte(299 % 256)}, nil}, chunks)
+		for _, change := range set.Changes[1:] {
+			require.False(t, change.HasContent)
+		}
+		changes = append(changes, set.Changes...)
+		seq = set.Last
+	}
+	require.Len(t, changes, 300)
+	require.Equal(t, CreateEvent, changes[0].Op)
+	require.Equal(t, ModifyEvent, changes[299].Op)
+}
+
+func Test_SnapshotPages(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+	files := map[string][]byte{}
+	for i := 0; i < 299; i++ {
+		files[fmt.Sprintf("pages/%03d", i)] = []byte{byte(i)}
+	}
+	require.NoError(t, sqliteFS.UpsertFiles(files, 16))
+
+	var (
+		after string
+		paths []string
+		last  int64
+	)
+	for page := 0; ; page++ {
+		set, err := sqliteFS.Snapshot(after)
+		require.NoError(t, err)
+		if page == 0 {
+			last = set.Last
+		}
+		require.Equal(t, last, set.Last)
+		if len(set.Changes) == 0 {
+			require.Equal(t, 2, page)
+			break
+		}
+		require.LessOrEqual(t, len(set.Changes), 256)
+		for _, change := range set.Changes {
+			require.Greater(t, change.Path, after)
+			after = change.Path
+			paths = append(paths, change.Path)
+		}
+	}
+	require.Len(t, paths, 300)
+}
+
+func Test_ReplicationSnapshotPagesWithChanges(t *testing.T) {
+	dir := t.TempDir()
+	primary, err := NewSqliteFS(path.Join(dir, "primary.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, primary.Close())
+	})
+	follower, err := NewSqliteFS(path.Join(dir, "follower.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, follower.Close())
+	})
+	ctx := context.Background()
+
+	// a and b are in the first page of the snapshot, q and r in the second one
+	files := map[string][]byte{
+		"a/x":   []byte("moved"),
+		"b":     []byte("file then directory"),
+		"q/old": []byte("directory then file"),
+	}
+	for i := 0; i < 300; i++ {
+		files[fmt.Sprintf("m/%03d", i)] = []byte{byte(i)}
+	}
+	require.NoError(t, primary.UpsertFiles(files, 4))
+	require.NoError(t, primary.Update(func(tx *Tx) error {
+		return tx.Mkdir("r")
+	}))
+
+	source := &observedSource{FS: primary}
+	source.beforePage = func() {
+		if source.pages != 1 {
+			return
+		}
+		require.NoError(t, primary.Update(func(tx *Tx) error {
+			write := func(name, data string) func() error {
+				return func() error {
+					_, err := tx.WriteFile(name, 4, []byte(data))
+					return err
+				}
+			}
+			for _, op := range []func() error{
+				func() error { return tx.Rename("a", "z") },
+				func() error { return tx.Remove("b") },
+				write("b/inner", "inner"),
+				func() error { return tx.Remove("q/old") },
+				func() error { return tx.Remove("q") },
+				write("q", "now a file"),
+				func() error { return tx.Remove("r") },
+				write("r/new", "new"),
+			} {
+				if err := op(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+
+	replicator := NewReplicator("primary", source, follower)
+	_, err = replicator.CatchUp(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, source.pages)
+	require.Equal(t, fsContent(t, primary), fsContent(t, follower))
+
+	report, err := follower.Check(ctx, CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Problems)
+}
+
+func Test_ReplicationFetchesChangedChunks(t *testing.T) {
+	dir := t.TempDir()
+	primary, err := NewSqliteFS(path.Join(dir, "primary.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, primary.Close())
+	})
+	follower, err := NewSqliteFS(path.Join(dir, "follower.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, follower.Close())
+	})
+	ctx := context.Background()
+
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ!?")
+	require.NoError(t, primary.UpsertFile("big", 8, data))
+	source := &observedSource{FS: primary}
+	replicator := NewReplicator("primary", source, follower)
+	_, err = replicator.CatchUp(ctx)
+	require.NoError(t, err)
+	require.Len(t, source.fetched, 8)
+
+	// only the rewritten chunk is fetched, even after a move
+	source.fetched = nil
+	data[20] = '_'
+	require.NoError(t, primary.UpsertFile("big", 8, data))
+	require.NoError(t, primary.Update(func(tx *Tx) error {
+		return tx.Rename("big", "moved")
+	}))
+	_, err = replicator.CatchUp(ctx)
+	require.NoError(t, err)
+	require.Len(t, source.fetched, 1)
+	require.Equal(t, 2, source.fetched[0].Position)
+	require.Equal(t, fsContent(t, primary), fsContent(t, follower))
+
+	// a content rewritten again once the changes have been read is
+	// skipped, the next changes carry it
+	source.fetched = nil
+	require.NoError(t, primary.UpsertFile("moved", 8, []byte("short")))
+	source.beforeChunks = func() {
+		source.beforeChunks = nil
+		require.NoError(t, primary.UpsertFile("moved", 8, []byte("shorter")))
+	}
+	_, err = replicator.CatchUp(ctx)
+	require.NoError(t, err)
+	require.Len(t, source.fetched, 2)
+	require.Equal(t, fsContent(t, primary), fsContent(t, follower))
+}
+
+func Test_PruneChanges(t *testing.T) {
+	dir := t.TempDir()
+	primary, err := NewSqliteFS(path.Join(dir, "primary.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, primary.Close())
+	})
+	server := httptest.NewServer(primary.ChangeFeedHandler())
+	t.Cleanup(server.Close)
+	newFollower := func(name string) (*FS, *Replicator) {
+		follower, err := NewSqliteFS(path.Join(dir, name+".db"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, follower.Close())
+		})
+		return follower, NewReplicator("primary", NewHTTPChangeSource(server.URL, server.Client()), follower)
+	}
+	ctx := context.Background()
+
+	require.NoError(t, primary.UpsertFile("notes/a", 8, []byte("a")))
+	late, lateReplicator := newFollower("late")
+	_, err = lateReplicator.CatchUp(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, primary.UpsertFile("notes/b", 8, []byte("b")))
+	follower, replicator := newFollower("follower")
+	_, err = replicator.CatchUp(ctx)
+	require.NoError(t, err)
+	set, err := primary.ChangesSince(0)
+	require.NoError(t, err)
+	require.Len(t, set.Changes, 3)
+	reached := set.Last
+
+	// the changes read by the follower are pruned
+	require.NoError(t, primary.UpsertFile("notes/a", 8, []byte("a v2")))
+	pruned, err := primary.PruneChanges(reached + 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), pruned)
+	_, err = primary.ChangesSince(0)
+	require.ErrorIs(t, err, ChangesPrunedErr)
+	set, err = primary.ChangesSince(reached)
+	require.NoError(t, err)
+	require.Len(t, set.Changes, 1)
+
+	_, err = replicator.CatchUp(ctx)
+	require.NoError(t, err)
+	require.Equal(t, fsContent(t, primary), fsContent(t, follower))
+	_, err = lateReplicator.CatchUp(ctx)
+	require.ErrorIs(t, err, ChangesPrunedErr)
+	require.NotEqual(t, fsContent(t, primary), fsContent(t, late))
+
+	// a new follower starts after the pruned changes even when none is left
+	pruned, err = primary.PruneChanges(math.MaxInt64)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), pruned)
+	pruned, err = primary.PruneChanges(math.MaxInt64)
+	require.NoError(t, err)
+	require.Zero(t, pruned)
+	snapshot, err := primary.Snapshot("")
+	require.NoError(t, err)
+	require.Greater(t, snapshot.Last, reached)
+	fresh, freshReplicator := newFollower("fresh")
+	_, err = freshReplicator.CatchUp(ctx)
+	require.NoError(t, err)
+	require.NoError(t, primary.UpsertFile("notes/c", 8, []byte("c")))
+	for _, r := range []*Replicator{replicator, freshReplicator} {
+		applied, err := r.CatchUp(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, applied)
+	}
+	require.Equal(t, fsContent(t, primary), fsContent(t, fresh))
+	require.Equal(t, fsContent(t, primary), fsContent(t, follower))
+}
@@ -0,0 +1,611 @@
+package dbfs
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// FullTextDisabledErr is returned by Search when the file system
+	// has been created without WithFullTextIndex or WithFullTextMIMETypes.
+	FullTextDisabledErr = fmt.Errorf("full text index is not enabled")
+	// FullTextUnsupportedErr is returned when the full text index is
+	// enabled on a database which does not support it.
+	FullTextUnsupportedErr = fmt.Errorf("full text index is not supported")
+)
+
+// SearchResult is a file matching the query given to Search.
+type SearchResult struct {
+	// Path is the full path of the file.
+	Path string
+	// Snippet is an excerpt of the file around the matches,
+	// which are enclosed in square brackets.
+	Snippet string
+	// Rank is the bm25 relevance of the file, the lower the more relevant.
+	Rank float64
+}
+
+// snippetTokens is the number of tokens of the snippets of the search results.
+const snippetTokens = 16
+
+// Search returns the files of the full text index matching query,
+// the most relevant first. The query follows the sqlite FTS5 syntax:
+// `dbfs sqlite` matches the files containing both words, `"full text"`
+// the phrase, `dbfs OR sqlite` either word and `sql*` the words starting
+// with sql. FullTextDisabledErr is returned if the index is not enabled.
+func (fs *FS) Search(query string) ([]SearchResult, error) {
+	return fs.SearchContext(context.Background(), query)
+}
+
+// SearchContext is Search honouring the ctx cancellation.
+func (fs *FS) SearchContext(ctx context.Context, query string) ([]SearchResult, error) {
+	tx, err := fs.beginRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	selection, err := fs.fullTextSelection(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if selection == nil {
+		return nil, FullTextDisabledErr
+	}
+
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT
+			f.full_path,
+			snippet(github_dgsb_dbfs_fulltext, 0, '[', ']', '...', ?),
+			bm25(github_dgsb_dbfs_fulltext) AS score
+		FROM github_dgsb_dbfs_fulltext
+			JOIN github_dgsb_dbfs_files f ON f.inode = github_dgsb_dbfs_fulltext.rowid
+		WHERE github_dgsb_dbfs_fulltext MATCH ? AND f.root = ?
+		ORDER BY score, f.full_path`), snippetTokens, query, fs.rootInode)
+	if err != nil {
+		return nil, fmt.Errorf("cannot search %q: %w", query, err)
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		if err := rows.Scan(&result.Path, &result.Snippet, &result.Rank); err != nil {
+			return nil, fmt.Errorf("cannot scan the results of %q: %w", query, err)
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot search %q: %w", query, err)
+	}
+	return results, nil
+}
+
+// ReindexFullText rebuilds the full text index of the volume from its files.
+// The index is maintained by every write, it is only needed to repair it.
+func (fs *FS) ReindexFullText() error {
+	return fs.ReindexFullTextContext(context.Background())
+}
+
+// ReindexFullTextContext is ReindexFullText honouring the ctx cancellation.
+func (fs *FS) ReindexFullTextContext(ctx context.Context) error {
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		selection, err := fs.fullTextSelection(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if selection == nil {
+			return FullTextDisabledErr
+		}
+		if err := fs.unindexVolume(ctx, tx, fs.rootInode); err != nil {
+			return err
+		}
+		return fs.reindexTree(ctx, tx, fs.rootInode, "")
+	})
+}
+
+// DropFullTextIndex deletes the full text index
+// and the selection of its files from the database.
+func (fs *FS) DropFullTextIndex() error {
+	return fs.DropFullTextIndexContext(context.Background())
+}
+
+// DropFullTextIndexContext is DropFullTextIndex honouring the ctx cancellation.
+func (fs *FS) DropFullTextIndexContext(ctx context.Context) error {
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		return fs.dropFullTextIndex(ctx, tx)
+	})
+}
+
+// fullTextDropQueries delete the objects created by fullTextIndexQueries.
+var fullTextDropQueries = []string{
+	"DROP TABLE IF EXISTS github_dgsb_dbfs_fulltext",
+	"DROP VIEW IF EXISTS github_dgsb_dbfs_fulltext_content",
+	"DELETE FROM github_dgsb_dbfs_fulltext_files",
+	"DELETE FROM github_dgsb_dbfs_fulltext_filters",
+}
+
+func (fs *FS) dropFullTextIndex(ctx context.Context, tx *sqlx.Tx) error {
+	fs.resetFullTextState(tx)
+	for _, q := range fullTextDropQueries {
+		if _, err := tx.ExecContext(ctx, fs.query(q)); err != nil {
+			return fmt.Errorf("cannot drop the full text index: %w", err)
+		}
+	}
+	return nil
+}
+
+// setupFullText stores the selection of the files of the full text index
+// given by the options and rebuilds the index of all the volumes when it
+// differs from the stored one. The index is then maintained by all the
+// file systems opened on the database, whatever their options.
+// A read only file system relies on the selection stored by its writers.
+func (fs *FS) setupFullText(cfg config) error {
+	if cfg.fullTextPatterns == nil && cfg.fullTextMIMETypes == nil {
+		return nil
+	}
+	queries := fs.dialect.fullTextIndexQueries()
+	if queries == nil {
+		return FullTextUnsupportedErr
+	}
+	if fs.readOnly {
+		return nil
+	}
+
+	selection := newFullTextFilter(cfg.fullTextPatterns, cfg.fullTextMIMETypes)
+	ctx := context.Background()
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		stored, err := fs.fullTextSelection(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if stored.equal(selection) {
+			return nil
+		}
+
+		if err := fs.dropFullTextIndex(ctx, tx); err != nil {
+			return err
+		}
+		for _, q := range queries {
+			if _, err := tx.ExecContext(ctx, fs.query(q)); err != nil {
+				return fmt.Errorf("cannot create the full text index: %w: %w", FullTextUnsupportedErr, err)
+			}
+		}
+		for kind, filters := range map[string][]string{
+			patternFilter:  selection.patterns,
+			mimeTypeFilter: selection.mimeTypes,
+		} {
+			for _, filter := range filters {
+				if _, err := tx.ExecContext(ctx, fs.query(
+					"INSERT INTO github_dgsb_dbfs_fulltext_filters (kind, filter) VALUES (?, ?)"),
+					kind, filter); err != nil {
+					return fmt.Errorf("cannot store the full text index selection: %w", err)
+				}
+			}
+		}
+
+		var roots []int
+		if err := tx.SelectContext(ctx, &roots, fs.query("SELECT root FROM github_dgsb_dbfs_volumes")); err != nil {
+			return fmt.Errorf("cannot query the volumes: %w", err)
+		}
+		for _, root := range roots {
+			if err := fs.reindexTree(ctx, tx, root, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The kinds of the filters of the full text index selection.
+const (
+	patternFilter  = "pattern"
+	mimeTypeFilter = "mime_type"
+)
+
+// fullTextSelection returns the selection of the files of the full text
+// index stored in the database, nil if the index is not enabled.
+func (fs *FS) fullTextSelection(ctx context.Context, q sqlx.QueryerContext) (*fullTextFilter, error) {
+	rows, err := q.QueryxContext(ctx, fs.query("SELECT kind, filter FROM github_dgsb_dbfs_fulltext_filters"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query the full text index selection: %w", err)
+	}
+	defer rows.Close()
+
+	var patterns, mimeTypes []string
+	for rows.Next() {
+		var kind, filter string
+		if err := rows.Scan(&kind, &filter); err != nil {
+			return nil, fmt.Errorf("cannot scan the full text index selection: %w", err)
+		}
+		switch kind {
+		case patternFilter:
+			patterns = append(patterns, filter)
+		case mimeTypeFilter:
+			mimeTypes = append(mimeTypes, filter)
+		default:
+			return nil, fmt.Errorf("unknown full text index filter %s", kind)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over the full text index selection: %w", err)
+	}
+	if patterns == nil && mimeTypes == nil {
+		return nil, nil
+	}
+	return newFullTextFilter(patterns, mimeTypes), nil
+}
+
+// fullTextState is the state of the full text index seen by a write transaction.
+type fullTextState struct {
+	// selection is the stored selection, nil if the index is not enabled.
+	selection *fullTextFilter
+	// indexed is false when no file is in the index.
+	indexed bool
+}
+
+// fullTextIndexState returns the state of the full text index in tx.
+// It is read once per transaction started by withWriteTx, whose writers
+// then skip the index without querying it when it is not enabled.
+func (fs *FS) fullTextIndexState(ctx context.Context, tx *sqlx.Tx) (*fullTextState, error) {
+	cached, tracked := fs.fullTextStates.Load(tx)
+	if state, _ := cached.(*fullTextState); state != nil {
+		return state, nil
+	}
+
+	selection, err := fs.fullTextSelection(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	var indexed int
+	if err := tx.GetContext(ctx, &indexed, fs.query(
+		"SELECT count(1) FROM (SELECT 1 FROM github_dgsb_dbfs_fulltext_files LIMIT 1) i")); err != nil {
+		return nil, fmt.Errorf("cannot query the full text index: %w", err)
+	}
+	state := &fullTextState{selection: selection, indexed: indexed > 0}
+	if tracked {
+		fs.fullTextStates.Store(tx, state)
+	}
+	return state, nil
+}
+
+// resetFullTextState makes the next fullTextIndexState of tx
+// read the full text index again after it has been changed.
+func (fs *FS) resetFullTextState(tx *sqlx.Tx) {
+	if _, tracked := fs.fullTextStates.Load(tx); tracked {
+		fs.fullTextStates.Store(tx, (*fullTextState)(nil))
+	}
+}
+
+// indexContent adds the regular file inode named name whose content is
+// data to the full text index if it is selected. Its previous entry must
+// have been removed by unindexContent before its content has changed.
+func (fs *FS) indexContent(ctx context.Context, tx *sqlx.Tx, inode int, name string, data []byte) error {
+	state, err := fs.fullTextIndexState(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if state.selection == nil || !state.selection.selects(name, data) {
+		return nil
+	}
+	return fs.addToIndex(ctx, tx, state, inode, name)
+}
+
+// addToIndex adds the file inode named name to the full text index,
+// which reads its content from its chunks.
+func (fs *FS) addToIndex(ctx context.Context, tx *sqlx.Tx, state *fullTextState, inode int, name string) error {
+	state.indexed = true
+	if _, err := tx.ExecContext(ctx,
+		fs.query("INSERT INTO github_dgsb_dbfs_fulltext_files (inode) VALUES (?)"), inode); err != nil {
+		return fmt.Errorf("cannot index %s: %w", name, err)
+	}
+	if _, err := tx.ExecContext(ctx, fs.query(`
+		INSERT INTO github_dgsb_dbfs_fulltext (rowid, content)
+		SELECT inode, content FROM github_dgsb_dbfs_fulltext_content WHERE inode = ?`), inode); err != nil {
+		return fmt.Errorf("cannot index %s: %w", name, err)
+	}
+	return nil
+}
+
+// unindexContent removes the file inode from the full text index. It must
+// be called before the content of the file changes: the entry of an
+// external content table is deleted with the content it has been added with.
+func (fs *FS) unindexContent(ctx context.Context, tx *sqlx.Tx, inode int) error {
+	state, err := fs.fullTextIndexState(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if !state.indexed {
+		return nil
+	}
+
+	var count int
+	if err := tx.GetContext(ctx, &count,
+		fs.query("SELECT count(1) FROM github_dgsb_dbfs_fulltext_files WHERE inode = ?"), inode); err != nil {
+		return fmt.Errorf("cannot query the full text index of inode %d: %w", inode, err)
+	}
+	if count == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, fs.query(`
+		INSERT INTO github_dgsb_dbfs_fulltext (github_dgsb_dbfs_fulltext, rowid, content)
+		SELECT 'delete', inode, content FROM github_dgsb_dbfs_fulltext_content WHERE inode = ?`), inode); err != nil {
+		return fmt.Errorf("cannot remove inode %d from the full text index: %w", inode, err)
+	}
+	if _, err := tx.ExecContext(ctx,
+		fs.query("DELETE FROM github_dgsb_dbfs_fulltext_files WHERE inode = ?"), inode); err != nil {
+		return fmt.Errorf("cannot remove inode %d from the full text index: %w", inode, err)
+	}
+	return nil
+}
+
+// unindexVolume removes the files of the volume root from the full text index.
+func (fs *FS) unindexVolume(ctx context.Context, tx *sqlx.Tx, root int) error {
+	state, err := fs.fullTextIndexState(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if !state.indexed {
+		return nil
+	}
+
+	var count int
+	if err := tx.GetContext(ctx, &count, fs.query(`
+		SELECT count(1)
+		FROM github_dgsb_dbfs_fulltext_files i
+			JOIN github_dgsb_dbfs_files f ON f.inode = i.inode
+		WHERE f.root = ?`), root); err != nil {
+		return fmt.Errorf("cannot query the full text index: %w", err)
+	}
+	if count == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, fs.query(`
+		INSERT INTO github_dgsb_dbfs_fulltext (github_dgsb_dbfs_fulltext, rowid, content)
+		SELECT 'delete', c.inode, c.content
+		FROM github_dgsb_dbfs_fulltext_content c
+			JOIN github_dgsb_dbfs_files f ON f.inode = c.inode
+		WHERE f.root = ?`), root); err != nil {
+		return fmt.Errorf("cannot clear the full text index: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, fs.query(`
+		DELETE FROM github_dgsb_dbfs_fulltext_files
+		WHERE inode IN (SELECT inode FROM github_dgsb_dbfs_files WHERE root = ?)`), root); err != nil {
+		return fmt.Errorf("cannot clear the full text index: %w", err)
+	}
+	return nil
+}
+
+// reindexTree updates the full text index entries of the regular files
+// of the tree name of the volume root, the whole volume if name is empty,
+// after they have been moved or cloned there. Their content is only read
+// when their name does not tell they are left out of the index.
+func (fs *FS) reindexTree(ctx context.Context, tx *sqlx.Tx, root int, name string) error {
+	state, err := fs.fullTextIndexState(ctx, tx)
+	if err != nil {
+		return err
+	}
+	selection := state.selection
+	if selection == nil {
+		return nil
+	}
+
+	q := "SELECT inode, full_path FROM github_dgsb_dbfs_files WHERE root = ? AND type = ?"
+	args := []any{root, RegularFileType}
+	if name != "" {
+		children, childrenArgs := underDir("full_path", name)
+		q += " AND (full_path = ? OR " + children + ")"
+		args = append(append(args, name), childrenArgs...)
+	}
+	type file struct {
+		inode    int
+		fullPath string
+	}
+	rows, err := tx.QueryxContext(ctx, fs.query(q), args...)
+	if err != nil {
+		return fmt.Errorf("cannot query the files to index: %w", err)
+	}
+	var files []file
+	for rows.Next() {
+		var f file
+		if err := rows.Scan(&f.inode, &f.fullPath); err != nil {
+			rows.Close()
+			return fmt.Errorf("cannot scan the files to index: %w", err)
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("cannot iterate over the files to index: %w", err)
+	}
+
+	for _, f := range files {
+		if err := fs.unindexContent(ctx, tx, f.inode); err != nil {
+			return err
+		}
+		if !selection.needsContent(f.fullPath) {
+			continue
+		}
+		_, _, data, err := fs.readContent(ctx, tx, f.inode)
+		if err != nil {
+			return err
+		}
+		if selection.selects(f.fullPath, data) {
+			if err := fs.addToIndex(ctx, tx, state, f.inode, f.fullPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fullTextFilter selects the regular files of the full text index
+// by their name or their MIME type.
+type fullTextFilter struct {
+	patterns  []string
+	mimeTypes []string
+}
+
+// newFullTextFilter returns the filter of the patterns and the MIME types,
+// sorted so that equal selections compare equal.
+func newFullTextFilter(patterns, mimeTypes []string) *fullTextFilter {
+	return &fullTextFilter{patterns: sortedSet(patterns), mimeTypes: sortedSet(mimeTypes)}
+}
+
+// sortedSet returns the distinct values sorted.
+func sortedSet(values []string) []string {
+	set := append([]string{}, values...)
+	sort.Strings(set)
+	distinct := set[:0]
+	for i, value := range set {
+		if i == 0 || value != set[i-1] {
+			distinct = append(distinct, value)
+		}
+	}
+	return distinct
+}
+
+// equal reports whether f and other select the same files,
+// both being created by newFullTextFilter or nil.
+func (f *fullTextFilter) equal(other *fullTextFilter) bool {
+	if f == nil || other == nil {
+		return f == other
+	}
+	return equalStrings(f.patterns, other.patterns) && equalStrings(f.mimeTypes, other.mimeTypes)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// selects reports whether the file name with the content data belongs
+// to the index. The content which is not valid UTF-8 text is left out.
+func (f *fullTextFilter) selects(name string, data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	if f.selectsName(name) {
+		return true
+	}
+	return len(f.mimeTypes) > 0 && extensionType(name) == "" && f.selectsType(http.DetectContentType(data))
+}
+
+// needsContent reports whether the content of the file name
+// is needed to decide if it belongs to the index.
+func (f *fullTextFilter) needsContent(name string) bool {
+	return f.selectsName(name) || (len(f.mimeTypes) > 0 && extensionType(name) == "")
+}
+
+// selectsName reports whether the name of the file selects it,
+// by a pattern or by the MIME type of its extension.
+func (f *fullTextFilter) selectsName(name string) bool {
+	for _, pattern := range f.patterns {
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(name)
+		}
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	if mimeType := extensionType(name); mimeType != "" {
+		return f.selectsType(mimeType)
+	}
+	return false
+}
+
+// selectsType reports whether the MIME type mimeType,
+// possibly with parameters, is one of the selected types.
+func (f *fullTextFilter) selectsType(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	for _, selected := range f.mimeTypes {
+		if prefix, ok := strings.CutSuffix(selected, "/*"); ok {
+			if strings.HasPrefix(mediaType, strings.ToLower(prefix)+"/") {
+				return true
+			}
+		} else if strings.EqualFold(mediaType, selected) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesFullPath reports whether the selection of a file depends
+// on the directory it is in, f being nil when the index is disabled.
+func (f *fullTextFilter) matchesFullPath() bool {
+	if f == nil {
+		return false
+	}
+	for _, pattern := range f.patterns {
+		if strings.Contains(pattern, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// extensionTypes are the MIME types of the known extensions. The table is
+// fixed rather than read from the host so that all the file systems sharing
+// a database select the same files.
+var extensionTypes = map[string]string{
+	".c":    "text/x-c",
+	".css":  "text/css; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".gif":  "image/gif",
+	".go":   "text/x-go; charset=utf-8",
+	".h":    "text/x-c",
+	".htm":  "text/html; charset=utf-8",
+	".html": "text/html; charset=utf-8",
+	".ini":  "text/plain; charset=utf-8",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".js":   "text/javascript; charset=utf-8",
+	".json": "application/json",
+	".log":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".mjs":  "text/javascript; charset=utf-8",
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".py":   "text/x-python; charset=utf-8",
+	".rst":  "text/x-rst; charset=utf-8",
+	".sh":   "text/x-shellscript; charset=utf-8",
+	".sql":  "application/sql",
+	".svg":  "image/svg+xml",
+	".toml": "application/toml",
+	".tsv":  "text/tab-separated-values; charset=utf-8",
+	".txt":  "text/plain; charset=utf-8",
+	".wasm": "application/wasm",
+	".webp": "image/webp",
+	".xml":  "text/xml; charset=utf-8",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".zip":  "application/zip",
+}
+
+// extensionType returns the MIME type of the extension of name,
+// empty if it is unknown.
+func extensionType(name string) string {
+	return extensionTypes[strings.ToLower(path.Ext(name))]
+}
@@ -0,0 +1,189 @@
+package dbfs_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"testing"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+// newFullTextFS returns a sqlite FS with the full text index enabled by opts.
+// The test is skipped when sqlite is built without FTS5.
+func newFullTextFS(t *testing.T, dbName string, opts ...Option) *FS {
+	fsys, err := NewSqliteFS(dbName, opts...)
+	if errors.Is(err, FullTextUnsupportedErr) {
+		t.Skip("sqlite is built without FTS5, use the sqlite_fts5 build tag")
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, fsys.Close())
+	})
+	return fsys
+}
+
+// searchPaths returns the paths of the files matching query sorted by name.
+func searchPaths(t *testing.T, fsys *FS, query string) []string {
+	results, err := fsys.Search(query)
+	require.NoError(t, err)
+	paths := []string{}
+	for _, result := range results {
+		paths = append(paths, result.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func Test_Search(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "search.db")
+	sqliteFS := newFullTextFS(t, dbName, WithFullTextIndex("*.md", "guides/*/*.txt"))
+
+	require.NoError(t, sqliteFS.UpsertFiles(map[string][]byte{
+		"docs/readme.md":           []byte("dbfs stores files in sqlite"),
+		"docs/fts.md":              []byte("The full text index relies on sqlite FTS5: sqlite ranks the sqlite files."),
+		"docs/latin1.md":           {'s', 'q', 'l', 'i', 't', 'e', ' ', 0xe9},
+		"guides/setup/install.txt": []byte("Install sqlite with the fts5 build tag."),
+		"notes/todo.txt":           []byte("sqlite todo list"),
+	}, 16))
+
+	results, err := sqliteFS.Search("sqlite")
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	require.Equal(t, "docs/fts.md", results[0].Path)
+	require.Contains(t, results[0].Snippet, "[sqlite]")
+	for i := 1; i < len(results); i++ {
+		require.LessOrEqual(t, results[i-1].Rank, results[i].Rank)
+	}
+	require.Equal(t, []string{"docs/fts.md", "docs/readme.md", "guides/setup/install.txt"},
+		searchPaths(t, sqliteFS, "sqlite"))
+	require.Equal(t, []string{"guides/setup/install.txt"}, searchPaths(t, sqliteFS, `"build tag"`))
+	require.Equal(t, []string{"docs/fts.md", "guides/setup/install.txt"}, searchPaths(t, sqliteFS, "fts*"))
+	require.Empty(t, searchPaths(t, sqliteFS, "todo"))
+	_, err = sqliteFS.Search(`"unterminated`)
+	require.Error(t, err)
+
+	// the index follows the writes, the moves and the deletions
+	require.NoError(t, sqliteFS.UpsertFile("docs/readme.md", 16, []byte("dbfs stores files in postgres")))
+	require.Equal(t, []string{"docs/readme.md"}, searchPaths(t, sqliteFS, "postgres"))
+	require.Equal(t, []string{"docs/fts.md", "guides/setup/install.txt"}, searchPaths(t, sqliteFS, "sqlite"))
+	require.NoError(t, sqliteFS.Update(func(tx *Tx) error {
+		if err := tx.Rename("docs/readme.md", "docs/readme.txt"); err != nil {
+			return err
+		}
+		return tx.Rename("notes/todo.txt", "guides/notes/todo.txt")
+	}))
+	require.Empty(t, searchPaths(t, sqliteFS, "postgres"))
+	require.Equal(t, []string{"guides/notes/todo.txt"}, searchPaths(t, sqliteFS, "todo"))
+	require.NoError(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.Rename("guides", "manuals")
+	}))
+	require.Equal(t, []string{"docs/fts.md"}, searchPaths(t, sqliteFS, "sqlite"))
+	require.NoError(t, sqliteFS.Clone("docs", "archive"))
+	require.Equal(t, []string{"archive/fts.md", "docs/fts.md"}, searchPaths(t, sqliteFS, "sqlite"))
+	require.NoError(t, sqliteFS.DeleteFile("docs/fts.md"))
+	require.Equal(t, []string{"archive/fts.md"}, searchPaths(t, sqliteFS, "sqlite"))
+
+	// a replica with the same selection maintains its own index
+	replica := newFullTextFS(t, ":memory:", WithFullTextIndex("*.md", "guides/*/*.txt"))
+	server := httptest.NewServer(sqliteFS.ChangeFeedHandler())
+	t.Cleanup(server.Close)
+	replicator := NewReplicator("primary", NewHTTPChangeSource(server.URL, server.Client()), replica)
+	_, err = replicator.CatchUp(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"archive/fts.md"}, searchPaths(t, replica, "sqlite"))
+
+	// each volume has its own files in the index
+	require.NoError(t, sqliteFS.CreateVolume("tenant"))
+	tenant, err := sqliteFS.OpenVolume("tenant")
+	require.NoError(t, err)
+	require.NoError(t, tenant.UpsertFile("docs/fts.md", 16, []byte("tenant sqlite")))
+	require.Equal(t, []string{"docs/fts.md"}, searchPaths(t, tenant, "sqlite"))
+	require.Equal(t, []string{"archive/fts.md"}, searchPaths(t, sqliteFS, "sqlite"))
+	require.Empty(t, searchPaths(t, sqliteFS, "tenant"))
+	require.NoError(t, sqliteFS.DeleteVolume("tenant"))
+
+	// a file system opened without the options maintains the stored selection
+	plainFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, plainFS.Close())
+	})
+	require.Equal(t, []string{"archive/fts.md"}, searchPaths(t, plainFS, "sqlite"))
+	require.NoError(t, plainFS.UpsertFile("docs/late.md", 16, []byte("late sqlite notes")))
+	require.Equal(t, []string{"docs/late.md"}, searchPaths(t, sqliteFS, "late"))
+	require.NoError(t, plainFS.UpsertFile("docs/late.md", 16, []byte("late notes")))
+	require.Empty(t, searchPaths(t, sqliteFS, "sqlite late"))
+	require.NoError(t, plainFS.UpsertFile("docs/late.md", 16, []byte("late sqlite notes")))
+	require.NoError(t, plainFS.Update(func(tx *Tx) error {
+		return tx.Rename("docs/late.md", "docs/late.txt")
+	}))
+	require.Empty(t, searchPaths(t, sqliteFS, "late"))
+	require.NoError(t, plainFS.Update(func(tx *Tx) error {
+		return tx.Rename("docs/late.txt", "docs/late.md")
+	}))
+	require.Equal(t, []string{"docs/late.md"}, searchPaths(t, sqliteFS, "late"))
+	require.NoError(t, sqliteFS.CreateVolume("tenant"))
+	tenant, err = sqliteFS.OpenVolume("tenant")
+	require.NoError(t, err)
+	require.NoError(t, tenant.UpsertFile("docs/fts.md", 16, []byte("tenant sqlite")))
+	require.NoError(t, plainFS.DeleteVolume("tenant"))
+	require.NoError(t, sqliteFS.ReindexFullText())
+	require.Equal(t, []string{"archive/fts.md", "docs/late.md"}, searchPaths(t, sqliteFS, "sqlite"))
+
+	report, err := sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Problems)
+
+	_, err = NewSqliteFS(path.Join(t.TempDir(), "invalid.db"), WithFullTextIndex("[docs"))
+	require.ErrorIs(t, err, path.ErrBadPattern)
+}
+
+func Test_SearchSelection(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "selection.db")
+	sqliteFS := newFullTextFS(t, dbName, WithFullTextIndex("*.md"))
+	require.NoError(t, sqliteFS.CreateVolume("tenant"))
+	tenant, err := sqliteFS.OpenVolume("tenant")
+	require.NoError(t, err)
+	require.NoError(t, sqliteFS.UpsertFiles(map[string][]byte{
+		"notes.md":  []byte("markdown sqlite"),
+		"notes.txt": []byte("text sqlite"),
+	}, 4))
+	require.NoError(t, tenant.UpsertFile("tenant.txt", 4, []byte("tenant sqlite")))
+	require.Equal(t, []string{"notes.md"}, searchPaths(t, sqliteFS, "sqlite"))
+
+	// the same selection in another order keeps the index
+	sameFS := newFullTextFS(t, dbName, WithFullTextIndex("*.md", "*.md"))
+	require.Equal(t, []string{"notes.md"}, searchPaths(t, sameFS, "sqlite"))
+
+	// a new selection replaces the stored one in all the volumes,
+	// including for the file systems already opened
+	newFullTextFS(t, dbName, WithFullTextIndex("*.txt"))
+	require.Equal(t, []string{"notes.txt"}, searchPaths(t, sqliteFS, "sqlite"))
+	require.Equal(t, []string{"tenant.txt"}, searchPaths(t, tenant, "sqlite"))
+	require.NoError(t, sqliteFS.UpsertFile("late.md", 4, []byte("late sqlite")))
+	require.NoError(t, sqliteFS.UpsertFile("late.txt", 4, []byte("late sqlite")))
+	require.Equal(t, []string{"late.txt", "notes.txt"}, searchPaths(t, sqliteFS, "sqlite"))
+
+	require.NoError(t, sqliteFS.DropFullTextIndex())
+	_, err = sqliteFS.Search("sqlite")
+	require.ErrorIs(t, err, FullTextDisabledErr)
+	require.NoError(t, sqliteFS.DeleteFile("late.txt"))
+	require.NoError(t, tenant.UpsertFile("tenant.txt", 4, []byte("tenant")))
+}
+
+func Test_SearchMIMETypes(t *testing.T) {
+	sqliteFS := newFullTextFS(t, path.Join(t.TempDir(), "mime.db"), WithFullTextMIMETypes("text/*"))
+
+	require.NoError(t, sqliteFS.UpsertFiles(map[string][]byte{
+		"site/index.html": []byte("<html><body>sqlite manual</body></html>"),
+		"site/logo.svg":   []byte("<svg>sqlite</svg>"),
+		"data/notes":      []byte("sqlite notes"),
+		"data/raw":        []byte("\x00\x01sqlite"),
+		"docs/README.MD":  []byte("sqlite readme"),
+	}, 16))
+	require.Equal(t, []string{"data/notes", "docs/README.MD", "site/index.html"}, searchPaths(t, sqliteFS, "sqlite"))
+}
@@ -0,0 +1,32 @@
+//go:build !dbfs_purego
+
+package dbfs
+
+import (
+	"database/sql/driver"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriverName is the database/sql name of the cgo sqlite driver.
+// Build with the dbfs_purego tag to use the pure Go driver instead.
+const sqliteDriverName = "sqlite3"
+
+// sqlitePragma is the connection parameter setting the pragma name to value.
+func sqlitePragma(name, value string) string {
+	return "_" + name + "=" + value
+}
+
+func isSqliteDriver(d driver.Driver) bool {
+	_, ok := d.(*sqlite3.SQLiteDriver)
+	return ok
+}
+
+func isSqliteBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
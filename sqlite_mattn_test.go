@@ -0,0 +1,24 @@
+//go:build !dbfs_purego
+
+package dbfs_test
+
+import (
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+)
+
+// sqliteDriver is the database/sql name of the sqlite driver the package is built with.
+const sqliteDriver = "sqlite3"
+
+// sqliteTestDSN opens dbName in WAL mode with a busy timeout and the foreign keys check.
+func sqliteTestDSN(dbName string) string {
+	return dbName + "?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=1"
+}
+
+func TestSqlite3Version(t *testing.T) {
+	_, num, _ := sqlite3.Version()
+	require.Equal(t, 3, num/1000_000)
+	require.Equal(t, 42, (num%1000_000)/1000)
+}
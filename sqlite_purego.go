@@ -0,0 +1,35 @@
+//go:build dbfs_purego
+
+package dbfs
+
+import (
+	"database/sql/driver"
+	"errors"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteDriverName is the database/sql name of the pure Go sqlite driver
+// selected by the dbfs_purego build tag.
+const sqliteDriverName = "sqlite"
+
+// sqlitePragma is the connection parameter setting the pragma name to value.
+func sqlitePragma(name, value string) string {
+	return "_pragma=" + name + "(" + value + ")"
+}
+
+func isSqliteDriver(d driver.Driver) bool {
+	_, ok := d.(*sqlite.Driver)
+	return ok
+}
+
+func isSqliteBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		// the extended result codes keep the primary code in their low byte
+		code := sqliteErr.Code() & 0xff
+		return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+//go:build dbfs_purego
+
+package dbfs_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteDriver is the database/sql name of the sqlite driver the package is built with.
+const sqliteDriver = "sqlite"
+
+// sqliteTestDSN opens dbName in WAL mode with a busy timeout and the foreign keys check.
+func sqliteTestDSN(dbName string) string {
+	return dbName + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
+}
+
+func TestSqliteVersion(t *testing.T) {
+	db, err := sql.Open(sqliteDriver, ":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+
+	var version string
+	require.NoError(t, db.QueryRow("SELECT sqlite_version()").Scan(&version))
+	require.Equal(t, "3.45.3", version)
+}
@@ -0,0 +1,194 @@
+package dbfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"path"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// maxSymlinkHops is the number of symbolic links followed
+// while resolving a path before giving up.
+const maxSymlinkHops = 40
+
+var SymlinkLoopErr = fmt.Errorf("too many levels of symbolic links")
+
+// Symlink creates link as a symbolic link to target.
+// A relative target is resolved from the directory of link and an absolute
+// one from the root of the file system. The target does not need to exist.
+// The missing parent directories of link are created.
+// An error wrapping fs.ErrExist is returned if link already exists.
+func (fs *FS) Symlink(target, link string) error {
+	return fs.SymlinkContext(context.Background(), target, link)
+}
+
+// SymlinkContext is Symlink honouring the ctx cancellation.
+func (fs *FS) SymlinkContext(ctx context.Context, target, link string) error {
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		return fs.symlink(ctx, tx, target, link)
+	})
+}
+
+func (fs *FS) symlink(ctx context.Context, tx *sqlx.Tx, target, link string) error {
+	if target == "" {
+		return fmt.Errorf("%w: empty symbolic link target for %s", InvalidPathErr, link)
+	}
+	link, err := cleanPath(link)
+	if err != nil {
+		return err
+	}
+	if _, _, err := fs.namei(ctx, tx, link); err == nil {
+		return fmt.Errorf("%w: %s", iofs.ErrExist, link)
+	} else if !errors.Is(err, InodeNotFoundErr) {
+		return err
+	}
+	_, err = fs.writeNode(ctx, tx, link, SymlinkType, len(target), []byte(target))
+	return err
+}
+
+// ReadLink returns the target of the symbolic link name.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	return fsys.ReadLinkContext(context.Background(), name)
+}
+
+// ReadLinkContext is ReadLink honouring the ctx cancellation.
+func (fsys *FS) ReadLinkContext(ctx context.Context, name string) (string, error) {
+	tx, err := fsys.beginRead(ctx)
+	if err != nil {
+		return "", &iofs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	defer tx.Rollback()
+	return fsys.readLink(ctx, tx, name)
+}
+
+// Lstat returns the FileInfo of name without following it
+// when it is a symbolic link.
+func (fsys *FS) Lstat(name string) (iofs.FileInfo, error) {
+	return fsys.LstatContext(context.Background(), name)
+}
+
+// LstatContext is Lstat honouring the ctx cancellation.
+func (fsys *FS) LstatContext(ctx context.Context, name string) (iofs.FileInfo, error) {
+	tx, err := fsys.beginRead(ctx)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	defer tx.Rollback()
+	return fsys.lstat(ctx, tx, name)
+}
+
+// ReadLink returns the target of the symbolic link name
+// as it was when the view has been created.
+func (v *ReadView) ReadLink(name string) (string, error) {
+	if v.tx == nil {
+		return "", &iofs.PathError{Op: "readlink", Path: name, Err: ViewClosedErr}
+	}
+	return v.fs.readLink(v.ctx, v.tx, name)
+}
+
+// Lstat returns the FileInfo of name as it was when the view
+// has been created, without following it when it is a symbolic link.
+func (v *ReadView) Lstat(name string) (iofs.FileInfo, error) {
+	if v.tx == nil {
+		return nil, &iofs.PathError{Op: "lstat", Path: name, Err: ViewClosedErr}
+	}
+	return v.fs.lstat(v.ctx, v.tx, name)
+}
+
+func (fsys *FS) readLink(ctx context.Context, tx *sqlx.Tx, name string) (string, error) {
+	f, err := fsys.openNode(ctx, tx, name, false)
+	if err != nil {
+		return "", &iofs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if f.ftype != SymlinkType {
+		return "", &iofs.PathError{Op: "readlink", Path: name, Err: iofs.ErrInvalid}
+	}
+	_, _, target, err := fsys.readContent(ctx, tx, f.inode)
+	if err != nil {
+		return "", &iofs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return string(target), nil
+}
+
+func (fsys *FS) lstat(ctx context.Context, tx *sqlx.Tx, name string) (iofs.FileInfo, error) {
+	f, err := fsys.openNode(ctx, tx, name, false)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return f.Stat()
+}
+
+// resolve looks up the node fname following the symbolic links met in its
+// parent directories, and fname itself if follow is true.
+func (fs *FS) resolve(ctx context.Context, tx *sqlx.Tx, fname string, follow bool) (int, string, error) {
+	hops := 0
+	for {
+		inode, ftype, err := fs.namei(ctx, tx, fname)
+		if err == nil {
+			if ftype != SymlinkType || !follow {
+				return inode, ftype, nil
+			}
+			if fname, err = fs.followLink(ctx, tx, inode, fname, &hops); err != nil {
+				return 0, "", err
+			}
+			continue
+		}
+		if !errors.Is(err, InodeNotFoundErr) {
+			return 0, "", err
+		}
+		// one of the parent directories may be a symbolic link
+		if fname, err = fs.resolveParent(ctx, tx, fname, &hops); err != nil {
+			return 0, "", err
+		}
+	}
+}
+
+// resolveParent replaces in fname its first parent directory
+// which is a symbolic link by the target of the link.
+func (fs *FS) resolveParent(ctx context.Context, tx *sqlx.Tx, fname string, hops *int) (string, error) {
+	components := strings.Split(fname, "/")
+	for i := 1; i < len(components); i++ {
+		parent := path.Join(components[:i]...)
+		inode, ftype, err := fs.namei(ctx, tx, parent)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", InodeNotFoundErr, fname)
+		}
+		switch ftype {
+		case DirectoryType:
+			continue
+		case SymlinkType:
+			target, err := fs.followLink(ctx, tx, inode, parent, hops)
+			if err != nil {
+				return "", err
+			}
+			return path.Join(target, path.Join(components[i:]...)), nil
+		default:
+			return "", fmt.Errorf("%w: %s", InodeNotFoundErr, fname)
+		}
+	}
+	return "", fmt.Errorf("%w: %s", InodeNotFoundErr, fname)
+}
+
+// followLink returns the path the symbolic link inode named link points to.
+// A target going above the root directory stops at the root.
+func (fs *FS) followLink(ctx context.Context, tx *sqlx.Tx, inode int, link string, hops *int) (string, error) {
+	if *hops++; *hops > maxSymlinkHops {
+		return "", fmt.Errorf("%w: %s", SymlinkLoopErr, link)
+	}
+	_, _, data, err := fs.readContent(ctx, tx, inode)
+	if err != nil {
+		return "", err
+	}
+	target := string(data)
+	if !path.IsAbs(target) {
+		target = path.Join("/", path.Dir(link), target)
+	}
+	if target = strings.TrimPrefix(path.Clean(target), "/"); target == "" {
+		return ".", nil
+	}
+	return target, nil
+}
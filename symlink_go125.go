@@ -0,0 +1,10 @@
+//go:build go1.25
+
+package dbfs
+
+import "io/fs"
+
+var (
+	_ fs.ReadLinkFS = (*FS)(nil)
+	_ fs.ReadLinkFS = (*ReadView)(nil)
+)
@@ -0,0 +1,31 @@
+//go:build go1.25
+
+package dbfs_test
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ReadLinkFS(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	require.NoError(t, sqliteFS.UpsertFile("poésie/lamartine/le_lac", 16, []byte(leLac)))
+	require.NoError(t, sqliteFS.Symlink("lamartine/le_lac", "poésie/lake"))
+	require.NoError(t, fstest.TestFS(sqliteFS, "poésie/lamartine/le_lac", "poésie/lake"))
+
+	target, err := fs.ReadLink(sqliteFS, "poésie/lake")
+	require.NoError(t, err)
+	require.Equal(t, "lamartine/le_lac", target)
+	info, err := fs.Lstat(sqliteFS, "poésie/lake")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, info.Mode().Type())
+}
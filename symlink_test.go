@@ -0,0 +1,174 @@
+package dbfs_test
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"testing"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Symlinks(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(path.Join(t.TempDir(), "links.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	require.NoError(t, sqliteFS.UpsertFiles(map[string][]byte{
+		"poésie/lamartine/le_lac": []byte(leLac),
+		"notes/todo":              []byte("links"),
+	}, 16))
+	require.NoError(t, sqliteFS.Symlink("le_lac", "poésie/lamartine/lake"))
+	require.NoError(t, sqliteFS.Symlink("../poésie/lamartine", "links/lamartine"))
+	require.NoError(t, sqliteFS.Symlink("/notes/todo", "links/todo"))
+	require.NoError(t, sqliteFS.Symlink("../../../notes", "links/notes"))
+	require.NoError(t, sqliteFS.Symlink("missing", "links/dangling"))
+	require.NoError(t, sqliteFS.Symlink("loop", "links/loop"))
+	require.NoError(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.Symlink("lamartine/lake", "links/lake")
+	}))
+
+	require.ErrorIs(t, sqliteFS.Symlink("todo", "links/todo"), fs.ErrExist)
+	require.ErrorIs(t, sqliteFS.Symlink("todo", "notes/todo"), fs.ErrExist)
+	require.ErrorIs(t, sqliteFS.Symlink("", "links/empty"), InvalidPathErr)
+
+	for name, expected := range map[string]string{
+		"poésie/lamartine/lake":  leLac,
+		"links/lamartine/le_lac": leLac,
+		"links/lamartine/lake":   leLac,
+		"links/lake":             leLac,
+		"links/todo":             "links",
+		"links/notes/todo":       "links",
+	} {
+		data, err := fs.ReadFile(sqliteFS, name)
+		require.NoError(t, err, name)
+		require.Equal(t, expected, string(data), name)
+	}
+
+	_, err = fs.ReadFile(sqliteFS, "links/dangling")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+	_, err = fs.ReadFile(sqliteFS, "links/loop")
+	require.ErrorIs(t, err, SymlinkLoopErr)
+	_, err = fs.ReadFile(sqliteFS, "links/loop/file")
+	require.ErrorIs(t, err, SymlinkLoopErr)
+	_, err = fs.ReadFile(sqliteFS, "notes/todo/file")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+
+	info, err := fs.Stat(sqliteFS, "links/lamartine")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+	info, err = sqliteFS.Lstat("links/lamartine")
+	require.NoError(t, err)
+	require.Equal(t, "lamartine", info.Name())
+	require.Equal(t, fs.ModeSymlink, info.Mode().Type())
+	require.Equal(t, int64(len("../poésie/lamartine")), info.Size())
+	info, err = sqliteFS.Lstat("links/lamartine/lake")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, info.Mode().Type())
+	info, err = sqliteFS.Lstat("notes/todo")
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsRegular())
+	_, err = sqliteFS.Lstat("links/missing")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+
+	target, err := sqliteFS.ReadLink("links/lake")
+	require.NoError(t, err)
+	require.Equal(t, "lamartine/lake", target)
+	target, err = sqliteFS.ReadLink("links/lamartine/lake")
+	require.NoError(t, err)
+	require.Equal(t, "le_lac", target)
+	_, err = sqliteFS.ReadLink("notes/todo")
+	require.ErrorIs(t, err, fs.ErrInvalid)
+	var pathErr *fs.PathError
+	require.ErrorAs(t, err, &pathErr)
+
+	entries, err := fs.ReadDir(sqliteFS, "links")
+	require.NoError(t, err)
+	require.Len(t, entries, 6)
+	for _, entry := range entries {
+		require.Equal(t, fs.ModeSymlink, entry.Type(), entry.Name())
+	}
+
+	view, err := sqliteFS.View()
+	require.NoError(t, err)
+	require.NoError(t, sqliteFS.DeleteFile("links/todo"))
+	target, err = view.ReadLink("links/todo")
+	require.NoError(t, err)
+	require.Equal(t, "/notes/todo", target)
+	_, err = view.Lstat("links/todo")
+	require.NoError(t, err)
+	require.NoError(t, view.Close())
+
+	_, err = sqliteFS.Lstat("links/todo")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+	data, err := fs.ReadFile(sqliteFS, "notes/todo")
+	require.NoError(t, err)
+	require.Equal(t, "links", string(data))
+
+	report, err := sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Problems)
+}
+
+func Test_SymlinksReplicationAndSync(t *testing.T) {
+	primary, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, primary.Close())
+	})
+	follower, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, follower.Close())
+	})
+
+	require.NoError(t, primary.UpsertFile("a/b/c", 2, []byte("abc")))
+	require.NoError(t, primary.Symlink("b/c", "a/link"))
+	require.NoError(t, primary.Update(func(tx *Tx) error {
+		return tx.Rename("a/link", "a/moved")
+	}))
+
+	ctx := context.Background()
+	replicator := NewReplicator("primary", primary, follower)
+	_, err = replicator.CatchUp(ctx)
+	require.NoError(t, err)
+	require.Equal(t, fsContent(t, primary), fsContent(t, follower))
+	target, err := follower.ReadLink("a/moved")
+	require.NoError(t, err)
+	require.Equal(t, "b/c", target)
+
+	require.NoError(t, primary.DeleteFile("a/moved"))
+	require.NoError(t, primary.Symlink("b", "a/moved"))
+	_, err = replicator.CatchUp(ctx)
+	require.NoError(t, err)
+	target, err = follower.ReadLink("a/moved")
+	require.NoError(t, err)
+	require.Equal(t, "b", target)
+
+	other, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, other.Close())
+	})
+	_, err = SyncContext(ctx, follower, other, SyncOptions{})
+	require.NoError(t, err)
+	target, err = other.ReadLink("a/moved")
+	require.NoError(t, err)
+	require.Equal(t, "b", target)
+
+	// a regular file replaced by a symbolic link
+	require.NoError(t, other.UpsertFile("a/file", 2, []byte("file")))
+	_, err = SyncContext(ctx, follower, other, SyncOptions{})
+	require.NoError(t, err)
+	require.NoError(t, other.DeleteFile("a/file"))
+	require.NoError(t, other.Symlink("b/c", "a/file"))
+	_, err = SyncContext(ctx, follower, other, SyncOptions{})
+	require.NoError(t, err)
+	info, err := follower.Lstat("a/file")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, info.Mode().Type())
+	require.Equal(t, fsContent(t, follower), fsContent(t, other))
+}
@@ -0,0 +1,577 @@
+package dbfs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Resolution is the outcome chosen for a sync conflict.
+type Resolution int
+
+const (
+	// SkipConflict leaves both versions untouched.
+	// The conflict is reported again by the next Sync.
+	SkipConflict Resolution = iota
+	// UseA replaces the version of b with the version of a.
+	UseA
+	// UseB replaces the version of a with the version of b.
+	UseB
+	// KeepBoth keeps the version of a at its path and stores the version
+	// of b next to it under a conflict name on both sides. When a side has
+	// deleted the file, the remaining version is restored on both sides.
+	// When a file conflicts with a directory, the directory keeps the path
+	// and the file is moved under the conflict name.
+	KeepBoth
+)
+
+// SyncVersion describes the state of a path on one side of a Sync.
+type SyncVersion struct {
+	Exists bool
+	Type   string
+	// Digest is the sha256 digest of a regular file.
+	Digest []byte
+	// ModTime is the modification time of the node. For a path which does
+	// not exist, it is the time of its deletion as recorded in the change
+	// log, zero once that change has been pruned.
+	ModTime time.Time
+}
+
+// Conflict is a path changed differently on both sides since the last Sync.
+type Conflict struct {
+	Path       string
+	A, B       SyncVersion
+	Resolution Resolution
+}
+
+// ConflictResolver chooses the resolution of a conflict. A conflict between
+// a directory and a file or a symbolic link is always resolved with KeepBoth,
+// unless it is skipped, as a directory cannot replace a file or the reverse
+// without losing the nodes under it. A regular file and a symbolic link
+// replace each other with UseA and UseB.
+type ConflictResolver func(Conflict) (Resolution, error)
+
+// ResolveKeepBoth resolves every conflict with KeepBoth.
+func ResolveKeepBoth(Conflict) (Resolution, error) {
+	return KeepBoth, nil
+}
+
+// ResolveNewestWins keeps the most recently changed version,
+// including a deletion. Ties are kept both.
+func ResolveNewestWins(c Conflict) (Resolution, error) {
+	switch {
+	case c.A.ModTime.After(c.B.ModTime):
+		return UseA, nil
+	case c.B.ModTime.After(c.A.ModTime):
+		return UseB, nil
+	default:
+		return KeepBoth, nil
+	}
+}
+
+// SyncOptions tunes Sync.
+type SyncOptions struct {
+	// Resolve is called for every conflict.
+	// Conflicts are skipped and only reported when it is nil.
+	Resolve ConflictResolver
+}
+
+// SyncReport lists what a Sync did.
+type SyncReport struct {
+	// ToA lists the paths of a changed to match b.
+	ToA []string
+	// ToB lists the paths of b changed to match a.
+	ToB []string
+	// Conflicts lists the conflicts found along with their resolution.
+	Conflicts []Conflict
+}
+
+// Sync reconciles two file systems edited independently.
+// The state of each path is compared with its state at the end of the
+// previous Sync of the same pair, stored in both databases. A path changed
+// on one side only is copied to the other side, a path changed on both
+// sides is a conflict given to opts.Resolve. Changes are applied with
+// preconditions on the generations read, so a file written concurrently
+// makes Sync fail with ConflictErr instead of losing the write.
+// The two FS must use distinct databases: a copied database file
+// keeps the instance identifier of the original.
+func Sync(a, b *FS, opts SyncOptions) (SyncReport, error) {
+	return SyncContext(context.Background(), a, b, opts)
+}
+
+// SyncContext is Sync honouring the ctx cancellation.
+func SyncContext(ctx context.Context, a, b *FS, opts SyncOptions) (SyncReport, error) {
+	for _, fs := range []*FS{a, b} {
+		if err := fs.checkWritable(); err != nil {
+			return SyncReport{}, err
+		}
+	}
+	idA, err := a.instanceID(ctx)
+	if err != nil {
+		return SyncReport{}, err
+	}
+	idB, err := b.instanceID(ctx)
+	if err != nil {
+		return SyncReport{}, err
+	}
+	if idA == idB {
+		return SyncReport{}, fmt.Errorf("cannot sync instance %s with itself", idA)
+	}
+
+	base, err := a.syncBase(ctx, idB)
+	if err != nil {
+		return SyncReport{}, err
+	}
+	stateA, err := a.syncState(ctx)
+	if err != nil {
+		return SyncReport{}, err
+	}
+	stateB, err := b.syncState(ctx)
+	if err != nil {
+		return SyncReport{}, err
+	}
+
+	var (
+		report     SyncReport
+		opsA, opsB syncOps
+	)
+	for _, name := range syncPaths(base, stateA, stateB) {
+		nodeA, nodeB := stateA[name], stateB[name]
+		fpA, fpB := nodeA.fingerprint(), nodeB.fingerprint()
+		fpBase, synced := base[name]
+
+		switch {
+		case fpA == fpB:
+			continue
+		case synced && fpA == fpBase:
+			opsA.copy(name, b, nodeB, nodeA)
+			report.ToA = append(report.ToA, name)
+			continue
+		case synced && fpB == fpBase:
+			opsB.copy(name, a, nodeA, nodeB)
+			report.ToB = append(report.ToB, name)
+			continue
+		case !synced && !nodeA.exists():
+			opsA.copy(name, b, nodeB, nodeA)
+			report.ToA = append(report.ToA, name)
+			continue
+		case !synced && !nodeB.exists():
+			opsB.copy(name, a, nodeA, nodeB)
+			report.ToB = append(report.ToB, name)
+			continue
+		}
+
+		conflict := Conflict{Path: name}
+		if conflict.A, err = a.syncVersion(ctx, name, nodeA); err != nil {
+			return report, err
+		}
+		if conflict.B, err = b.syncVersion(ctx, name, nodeB); err != nil {
+			return report, err
+		}
+		if opts.Resolve != nil {
+			if conflict.Resolution, err = opts.Resolve(conflict); err != nil {
+				return report, fmt.Errorf("cannot resolve conflict on %s: %w", name, err)
+			}
+		}
+		if (nodeA.ftype == DirectoryType) != (nodeB.ftype == DirectoryType) &&
+			nodeA.exists() && nodeB.exists() && conflict.Resolution != SkipConflict {
+			conflict.Resolution = KeepBoth
+		}
+		report.Conflicts = append(report.Conflicts, conflict)
+
+		switch conflict.Resolution {
+		case UseA:
+			opsB.copy(name, a, nodeA, nodeB)
+			report.ToB = append(report.ToB, name)
+		case UseB:
+			opsA.copy(name, b, nodeB, nodeA)
+			report.ToA = append(report.ToA, name)
+		case KeepBoth:
+			switch {
+			case !nodeA.exists():
+				opsA.copy(name, b, nodeB, nodeA)
+				report.ToA = append(report.ToA, name)
+			case !nodeB.exists():
+				opsB.copy(name, a, nodeA, nodeB)
+				report.ToB = append(report.ToB, name)
+			default:
+				aside := conflictName(name, idB)
+				if nodeA.ftype == DirectoryType {
+					// b holds the file, it is moved aside on its side
+					opsA.copyAs(aside, b, name, nodeB, stateA[aside])
+					opsB.copyAs(aside, b, name, nodeB, stateB[aside])
+					opsB.remove(name, nodeB)
+					opsB.mkdir(name)
+				} else if nodeB.ftype == DirectoryType {
+					aside = conflictName(name, idA)
+					opsA.copyAs(aside, a, name, nodeA, stateA[aside])
+					opsB.copyAs(aside, a, name, nodeA, stateB[aside])
+					opsA.remove(name, nodeA)
+					opsA.mkdir(name)
+				} else {
+					opsA.copyAs(aside, b, name, nodeB, stateA[aside])
+					opsB.copyAs(aside, b, name, nodeB, stateB[aside])
+					opsB.copy(name, a, nodeA, nodeB)
+				}
+				report.ToA = append(report.ToA, name)
+				report.ToB = append(report.ToB, name)
+			}
+		}
+	}
+
+	if err := opsA.apply(ctx, a); err != nil {
+		return report, fmt.Errorf("cannot apply changes to %s: %w", idA, err)
+	}
+	if err := opsB.apply(ctx, b); err != nil {
+		return report, fmt.Errorf("cannot apply changes to %s: %w", idB, err)
+	}
+
+	// the new base is the state both sides agree on,
+	// the base of the skipped conflicts is kept.
+	if stateA, err = a.syncState(ctx); err != nil {
+		return report, err
+	}
+	if stateB, err = b.syncState(ctx); err != nil {
+		return report, err
+	}
+	newBase := map[string]string{}
+	for _, name := range syncPaths(base, stateA, stateB) {
+		fpA, fpB := stateA[name].fingerprint(), stateB[name].fingerprint()
+		switch {
+		case fpA == fpB && fpA != "":
+			newBase[name] = fpA
+		case fpA != fpB:
+			if fp, ok := base[name]; ok {
+				newBase[name] = fp
+			}
+		}
+	}
+	if err := a.storeSyncBase(ctx, idB, newBase); err != nil {
+		return report, err
+	}
+	if err := b.storeSyncBase(ctx, idA, newBase); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// conflictName is the name given to the version of a conflicting file
+// coming from the instance id.
+func conflictName(name, id string) string {
+	return fmt.Sprintf("%s.sync-conflict-%s", name, id[:8])
+}
+
+// syncNode is the state of a path as seen by Sync.
+type syncNode struct {
+	ftype      string
+	generation int64
+	modifiedAt int64
+	digest     []byte
+	// xattrs is the digest of the extended attributes, nil when there are none.
+	xattrs []byte
+}
+
+func (n syncNode) exists() bool {
+	return n.ftype != ""
+}
+
+// fingerprint identifies the content and the extended attributes of a node.
+// It is empty for a node which does not exist.
+func (n syncNode) fingerprint() string {
+	fp := n.ftype
+	if hasContent(n.ftype) {
+		fp += ":" + hex.EncodeToString(n.digest)
+	}
+	if n.xattrs != nil {
+		fp += ";x:" + hex.EncodeToString(n.xattrs)
+	}
+	return fp
+}
+
+// precondition ensures a node has not changed since it has been read.
+func (n syncNode) precondition() Precondition {
+	if !n.exists() {
+		return IfNotExists()
+	}
+	return IfMatch(n.generation)
+}
+
+func syncPaths(base map[string]string, states ...map[string]syncNode) []string {
+	seen := map[string]bool{}
+	for name := range base {
+		seen[name] = true
+	}
+	for _, state := range states {
+		for name := range state {
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fs *FS) instanceID(ctx context.Context) (string, error) {
+	var id string
+	if err := fs.db.GetContext(ctx, &id,
+		fs.query("SELECT instance_id FROM github_dgsb_dbfs_volumes WHERE root = ?"), fs.rootInode); err != nil {
+		return "", fmt.Errorf("cannot query instance identifier: %w", err)
+	}
+	return id, nil
+}
+
+// syncState returns the state of all the nodes of the file system.
+func (fs *FS) syncState(ctx context.Context) (map[string]syncNode, error) {
+	tx, err := fs.beginRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	type row struct {
+		inode int
+		name  string
+		node  syncNode
+	}
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT f.inode, f.full_path, f.type, f.generation, COALESCE(f.modified_at, 0), h.digest
+		FROM github_dgsb_dbfs_files f
+			LEFT JOIN github_dgsb_dbfs_hashes h ON h.inode = f.inode AND h.algorithm = ?
+		WHERE f.root = ? AND f.inode <> ?`), SHA256, fs.rootInode, fs.rootInode)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query files table: %w", err)
+	}
+	var nodes []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.inode, &r.name, &r.node.ftype, &r.node.generation, &r.node.modifiedAt, &r.node.digest); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("cannot scan files table: %w", err)
+		}
+		nodes = append(nodes, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over files table: %w", err)
+	}
+
+	xattrs, err := fs.volumeXattrs(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	state := make(map[string]syncNode, len(nodes))
+	for _, r := range nodes {
+		r.node.xattrs = xattrsDigest(xattrs[r.inode])
+		if hasContent(r.node.ftype) && r.node.digest == nil {
+			// files written before the digests were recorded
+			_, _, data, err := fs.readContent(ctx, tx, r.inode)
+			if err != nil {
+				return nil, err
+			}
+			r.node.digest = hashData(data)[SHA256]
+		}
+		state[r.name] = r.node
+	}
+	return state, nil
+}
+
+// syncVersion describes node for a Conflict. Only the deletion
+// of a node which does not exist anymore is read from the change log.
+func (fs *FS) syncVersion(ctx context.Context, name string, node syncNode) (SyncVersion, error) {
+	version := SyncVersion{Exists: node.exists(), Type: node.ftype, Digest: node.digest}
+	if node.exists() {
+		if node.modifiedAt != 0 {
+			version.ModTime = time.UnixMilli(node.modifiedAt)
+		}
+		return version, nil
+	}
+
+	var deletedAt sql.NullInt64
+	if err := fs.db.GetContext(ctx, &deletedAt, fs.query(`
+		SELECT max(changed_at)
+		FROM github_dgsb_dbfs_changes
+		WHERE root = ? AND ((op = ? AND path = ?) OR old_path = ?)`),
+		fs.rootInode, DeleteEvent, name, name); err != nil {
+		return SyncVersion{}, fmt.Errorf("cannot query the deletion of %s: %w", name, err)
+	}
+	if deletedAt.Valid {
+		version.ModTime = time.UnixMilli(deletedAt.Int64)
+	}
+	return version, nil
+}
+
+func (fs *FS) syncBase(ctx context.Context, peer string) (map[string]string, error) {
+	rows, err := fs.db.QueryxContext(ctx,
+		fs.query("SELECT path, fingerprint FROM github_dgsb_dbfs_sync WHERE root = ? AND peer = ?"), fs.rootInode, peer)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query sync markers of %s: %w", peer, err)
+	}
+	defer rows.Close()
+
+	base := map[string]string{}
+	for rows.Next() {
+		var name, fp string
+		if err := rows.Scan(&name, &fp); err != nil {
+			return nil, fmt.Errorf("cannot scan sync marker of %s: %w", peer, err)
+		}
+		base[name] = fp
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over sync markers of %s: %w", peer, err)
+	}
+	return base, nil
+}
+
+func (fs *FS) storeSyncBase(ctx context.Context, peer string, base map[string]string) error {
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx,
+			fs.query("DELETE FROM github_dgsb_dbfs_sync WHERE root = ? AND peer = ?"), fs.rootInode, peer); err != nil {
+			return fmt.Errorf("cannot delete sync markers of %s: %w", peer, err)
+		}
+		for name, fp := range base {
+			if _, err := tx.ExecContext(ctx,
+				fs.query("INSERT INTO github_dgsb_dbfs_sync (root, peer, path, fingerprint) VALUES (?, ?, ?, ?)"),
+				fs.rootInode, peer, name, fp); err != nil {
+				return fmt.Errorf("cannot store sync marker of %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// syncOp is a change applied by Sync to one side.
+type syncOp struct {
+	name string
+	// from is the file system to copy the node fromName from.
+	from     *FS
+	fromName string
+	// the node is removed when source does not exist.
+	source syncNode
+	target syncNode
+}
+
+type syncOps []syncOp
+
+// copy makes the node name a copy of the node source of from.
+// target is the current node on the side changed.
+func (ops *syncOps) copy(name string, from *FS, source, target syncNode) {
+	ops.copyAs(name, from, name, source, target)
+}
+
+// copyAs makes the node name a copy of the node fromName of from.
+func (ops *syncOps) copyAs(name string, from *FS, fromName string, source, target syncNode) {
+	if !source.exists() {
+		ops.remove(name, target)
+		return
+	}
+	*ops = append(*ops, syncOp{name: name, from: from, fromName: fromName, source: source, target: target})
+}
+
+func (ops *syncOps) remove(name string, target syncNode) {
+	*ops = append(*ops, syncOp{name: name, target: target})
+}
+
+func (ops *syncOps) mkdir(name string) {
+	*ops = append(*ops, syncOp{name: name, source: syncNode{ftype: DirectoryType}})
+}
+
+// apply runs the operations in a single transaction of fs.
+// The removal of directories is done last, children first,
+// and is skipped when the directory is not empty anymore.
+func (ops syncOps) apply(ctx context.Context, fs *FS) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	var dirRemovals []syncOp
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		for _, op := range ops {
+			switch {
+			case !op.source.exists() && op.target.ftype == DirectoryType:
+				dirRemovals = append(dirRemovals, op)
+			case !op.source.exists():
+				if err := fs.deleteFile(ctx, tx, op.name, op.target.precondition()); err != nil {
+					return err
+				}
+			case op.source.ftype == DirectoryType:
+				if err := fs.mkdir(ctx, tx, op.name, true); err != nil {
+					return err
+				}
+				if op.from == nil {
+					continue
+				}
+				_, _, xattrs, err := op.from.readNode(ctx, op.fromName, op.source)
+				if err != nil {
+					return err
+				}
+				if err := fs.replaceXattrs(ctx, tx, op.name, xattrs); err != nil {
+					return err
+				}
+			default:
+				chunkSize, data, xattrs, err := op.from.readNode(ctx, op.fromName, op.source)
+				if err != nil {
+					return err
+				}
+				precondition := op.target.precondition()
+				if op.target.exists() && op.target.ftype != op.source.ftype {
+					// a regular file replaced by a symbolic link or the reverse
+					if err := fs.deleteFile(ctx, tx, op.name, precondition); err != nil {
+						return err
+					}
+					precondition = IfNotExists()
+				}
+				if _, err := fs.writeNode(ctx, tx, op.name, op.source.ftype, chunkSize, data, precondition); err != nil {
+					return err
+				}
+				if err := fs.replaceXattrs(ctx, tx, op.name, xattrs); err != nil {
+					return err
+				}
+			}
+		}
+
+		sort.Slice(dirRemovals, func(i, j int) bool {
+			return dirRemovals[i].name > dirRemovals[j].name
+		})
+		for _, op := range dirRemovals {
+			err := fs.deleteFile(ctx, tx, op.name, op.target.precondition())
+			if err != nil && !errors.Is(err, DirNotEmptyErr) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readNode reads the content of the regular file or symbolic link name
+// and the extended attributes of name, which must still be the node read by Sync.
+func (fs *FS) readNode(ctx context.Context, name string, node syncNode) (int, []byte, map[string][]byte, error) {
+	tx, err := fs.beginRead(ctx)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fs.checkPreconditions(ctx, tx, name, []Precondition{node.precondition()}); err != nil {
+		return 0, nil, nil, err
+	}
+	inode, _, err := fs.namei(ctx, tx, name)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("cannot find inode for %s: %w", name, err)
+	}
+	xattrs, err := fs.readXattrs(ctx, tx, inode)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	_, chunkSize, data, err := fs.readContent(ctx, tx, inode)
+	return chunkSize, data, xattrs, err
+}
@@ -0,0 +1,205 @@
+package dbfs_test
+
+import (
+	"io/fs"
+	"math"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Sync(t *testing.T) {
+	dir := t.TempDir()
+	server, err := NewSqliteFS(path.Join(dir, "server.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, server.Close())
+	})
+	laptop, err := NewSqliteFS(path.Join(dir, "laptop.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, laptop.Close())
+	})
+
+	_, err = Sync(server, server, SyncOptions{})
+	require.Error(t, err)
+
+	require.NoError(t, server.UpsertFiles(map[string][]byte{
+		"survey/site-a.csv": []byte("lat,lon\n"),
+		"survey/site-b.csv": []byte("lat,lon\n"),
+		"survey/notes.txt":  []byte("day 1"),
+		"forms/intake.md":   []byte("# intake"),
+	}, 16))
+	report, err := Sync(laptop, server, SyncOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Conflicts)
+	require.Empty(t, report.ToB)
+	require.Len(t, report.ToA, 6)
+	require.Equal(t, fsContent(t, server), fsContent(t, laptop))
+
+	// independent edits merge without conflict
+	require.NoError(t, laptop.UpsertFile("survey/site-a.csv", 16, []byte("lat,lon\n48.85,2.35\n")))
+	require.NoError(t, laptop.DeleteFile("survey/site-b.csv"))
+	require.NoError(t, laptop.UpsertFile("survey/photos/p1.jpg", 16, []byte("jpeg")))
+	require.NoError(t, server.UpsertFile("forms/intake.md", 16, []byte("# intake v2")))
+	require.NoError(t, server.UpsertFile("forms/exit.md", 16, []byte("# exit")))
+	report, err = Sync(laptop, server, SyncOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Conflicts)
+	require.ElementsMatch(t, []string{"forms/exit.md", "forms/intake.md"}, report.ToA)
+	require.ElementsMatch(t, []string{
+		"survey/site-a.csv", "survey/site-b.csv", "survey/photos", "survey/photos/p1.jpg",
+	}, report.ToB)
+	require.Equal(t, fsContent(t, server), fsContent(t, laptop))
+
+	report, err = Sync(server, laptop, SyncOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.ToA)
+	require.Empty(t, report.ToB)
+	require.Empty(t, report.Conflicts)
+
+	// concurrent edits are reported and left untouched without resolver
+	require.NoError(t, laptop.UpsertFile("survey/notes.txt", 16, []byte("day 1, laptop")))
+	require.NoError(t, server.UpsertFile("survey/notes.txt", 16, []byte("day 1, server")))
+	for i := 0; i < 2; i++ {
+		report, err = Sync(laptop, server, SyncOptions{})
+		require.NoError(t, err)
+		require.Len(t, report.Conflicts, 1)
+		require.Equal(t, "survey/notes.txt", report.Conflicts[0].Path)
+		require.Equal(t, SkipConflict, report.Conflicts[0].Resolution)
+		require.True(t, report.Conflicts[0].A.Exists)
+		require.True(t, report.Conflicts[0].B.Exists)
+		require.NotEqual(t, report.Conflicts[0].A.Digest, report.Conflicts[0].B.Digest)
+	}
+	data, err := fs.ReadFile(laptop, "survey/notes.txt")
+	require.NoError(t, err)
+	require.Equal(t, "day 1, laptop", string(data))
+
+	report, err = Sync(laptop, server, SyncOptions{Resolve: ResolveKeepBoth})
+	require.NoError(t, err)
+	require.Len(t, report.Conflicts, 1)
+	require.Equal(t, KeepBoth, report.Conflicts[0].Resolution)
+	require.Equal(t, fsContent(t, server), fsContent(t, laptop))
+	data, err = fs.ReadFile(server, "survey/notes.txt")
+	require.NoError(t, err)
+	require.Equal(t, "day 1, laptop", string(data))
+	entries, err := fs.Glob(server, "survey/notes.txt.sync-conflict-*")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	data, err = fs.ReadFile(laptop, entries[0])
+	require.NoError(t, err)
+	require.Equal(t, "day 1, server", string(data))
+
+	// the most recent change wins, deletions included
+	require.NoError(t, server.UpsertFile("forms/exit.md", 16, []byte("# exit, server")))
+	require.NoError(t, laptop.DeleteFile("forms/intake.md"))
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, laptop.UpsertFile("forms/exit.md", 16, []byte("# exit, laptop")))
+	require.NoError(t, server.UpsertFile("forms/intake.md", 16, []byte("# intake v3")))
+	report, err = Sync(laptop, server, SyncOptions{Resolve: ResolveNewestWins})
+	require.NoError(t, err)
+	require.Len(t, report.Conflicts, 2)
+	require.Equal(t, fsContent(t, server), fsContent(t, laptop))
+	data, err = fs.ReadFile(server, "forms/exit.md")
+	require.NoError(t, err)
+	require.Equal(t, "# exit, laptop", string(data))
+	data, err = fs.ReadFile(laptop, "forms/intake.md")
+	require.NoError(t, err)
+	require.Equal(t, "# intake v3", string(data))
+
+	// a callback chooses, here the server always wins
+	require.NoError(t, laptop.UpsertFile("survey/site-a.csv", 16, []byte("lat,lon\n0,0\n")))
+	require.NoError(t, server.UpsertFiles(map[string][]byte{
+		"survey/site-a.csv":    []byte("lat,lon\n1,1\n"),
+		"survey/photos/p1.jpg": []byte("png"),
+	}, 16))
+	require.NoError(t, laptop.DeleteFile("survey/photos/p1.jpg"))
+	var seen []string
+	report, err = Sync(laptop, server, SyncOptions{Resolve: func(c Conflict) (Resolution, error) {
+		seen = append(seen, c.Path)
+		return UseB, nil
+	}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"survey/photos/p1.jpg", "survey/site-a.csv"}, seen)
+	require.Equal(t, fsContent(t, server), fsContent(t, laptop))
+	data, err = fs.ReadFile(laptop, "survey/site-a.csv")
+	require.NoError(t, err)
+	require.Equal(t, "lat,lon\n1,1\n", string(data))
+}
+
+func Test_SyncFileDirectoryConflict(t *testing.T) {
+	dir := t.TempDir()
+	a, err := NewSqliteFS(path.Join(dir, "a.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+	})
+	b, err := NewSqliteFS(path.Join(dir, "b.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, b.Close())
+	})
+
+	require.NoError(t, a.UpsertFile("report/summary", 16, []byte("a directory on a")))
+	require.NoError(t, b.UpsertFile("report", 16, []byte("a file on b")))
+	report, err := Sync(a, b, SyncOptions{Resolve: func(Conflict) (Resolution, error) {
+		return UseB, nil
+	}})
+	require.NoError(t, err)
+	require.Len(t, report.Conflicts, 1)
+	require.Equal(t, KeepBoth, report.Conflicts[0].Resolution)
+	require.Equal(t, fsContent(t, a), fsContent(t, b))
+	info, err := fs.Stat(b, "report")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+	entries, err := fs.Glob(a, "report.sync-conflict-*")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// a file and a symbolic link follow the resolver
+	require.NoError(t, a.UpsertFile("latest", 16, []byte("a file on a")))
+	require.NoError(t, b.Symlink("report/summary", "latest"))
+	report, err = Sync(a, b, SyncOptions{Resolve: func(Conflict) (Resolution, error) {
+		return UseB, nil
+	}})
+	require.NoError(t, err)
+	require.Len(t, report.Conflicts, 1)
+	require.Equal(t, UseB, report.Conflicts[0].Resolution)
+	require.Equal(t, fsContent(t, a), fsContent(t, b))
+	target, err := a.ReadLink("latest")
+	require.NoError(t, err)
+	require.Equal(t, "report/summary", target)
+}
+
+func Test_SyncNewestWinsWithoutChangeLog(t *testing.T) {
+	dir := t.TempDir()
+	a, err := NewSqliteFS(path.Join(dir, "a.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+	})
+	b, err := NewSqliteFS(path.Join(dir, "b.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, b.Close())
+	})
+
+	require.NoError(t, b.UpsertFile("notes.txt", 16, []byte("older, on b")))
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, a.UpsertFile("notes.txt", 16, []byte("newer, on a")))
+	for _, fsys := range []*FS{a, b} {
+		_, err := fsys.PruneChanges(math.MaxInt64)
+		require.NoError(t, err)
+	}
+	report, err := Sync(a, b, SyncOptions{Resolve: ResolveNewestWins})
+	require.NoError(t, err)
+	require.Len(t, report.Conflicts, 1)
+	require.False(t, report.Conflicts[0].A.ModTime.IsZero())
+	require.True(t, report.Conflicts[0].A.ModTime.After(report.Conflicts[0].B.ModTime))
+	data, err := fs.ReadFile(b, "notes.txt")
+	require.NoError(t, err)
+	require.Equal(t, "newer, on a", string(data))
+}
@@ -0,0 +1,299 @@
+package dbfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// busyTimeout is how long sqlite itself waits on a locked database.
+	busyTimeout = 5 * time.Second
+	// maxBusyRetries bounds the number of attempts made by withWriteTx
+	// to take the write lock on top of the sqlite busy timeout.
+	maxBusyRetries = 10
+)
+
+// beginRead starts a transaction reading a single snapshot of the database.
+func (fs *FS) beginRead(ctx context.Context) (*sqlx.Tx, error) {
+	return fs.db.BeginTxx(ctx, fs.dialect.readTxOptions())
+}
+
+// holdConn waits for the right to hold a connection of a bounded pool
+// beyond a single call. It is released by releaseConn.
+func (fs *FS) holdConn(ctx context.Context) error {
+	if fs.heldConns == nil {
+		return nil
+	}
+	select {
+	case fs.heldConns <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseConn gives back the right taken by holdConn.
+func (fs *FS) releaseConn() {
+	if fs.heldConns != nil {
+		<-fs.heldConns
+	}
+}
+
+// beginHeldRead is beginRead for a transaction held beyond a single call,
+// to be released by releaseConn once rolled back.
+func (fs *FS) beginHeldRead(ctx context.Context) (*sqlx.Tx, error) {
+	if err := fs.holdConn(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := fs.beginRead(ctx)
+	if err != nil {
+		fs.releaseConn()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// checkWritable fails with fs.ErrPermission if fs is read only.
+func (fs *FS) checkWritable() error {
+	if fs.readOnly {
+		return fmt.Errorf("read only file system: %w", iofs.ErrPermission)
+	}
+	return nil
+}
+
+// beginWrite starts a transaction holding the database write lock.
+// Writers are serialized so that the generations, the change log order
+// and the preconditions are consistent. With sqlite, transactions are
+// started in deferred mode and only take the write lock on their first
+// write. A transaction which has already read may then fail with
+// SQLITE_BUSY in the middle of its work when another connection
+// committed in between. Taking the lock before anything else moves
+// that failure to the beginning of the transaction where it is safe
+// to retry.
+func (fs *FS) beginWrite(ctx context.Context) (*sqlx.Tx, error) {
+	if err := fs.checkWritable(); err != nil {
+		return nil, err
+	}
+	backoff := 10 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		tx, err := fs.db.BeginTxx(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot start transaction: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, fs.query(fs.dialect.writeLockQuery()))
+		if err == nil {
+			return tx, nil
+		}
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			err = multierror.Append(err, rollbackErr)
+		}
+		if !fs.dialect.isBusy(err) || attempt >= maxBusyRetries {
+			return nil, fmt.Errorf("cannot take the database write lock: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("cannot take the database write lock: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// withWriteTx runs fn in a write transaction committed if fn succeeds
+// and rolled back otherwise.
+func (fs *FS) withWriteTx(ctx context.Context, fn func(*sqlx.Tx) error) (ret error) {
+	tx, err := fs.beginWrite(ctx)
+	if err != nil {
+		return err
+	}
+	fs.fullTextStates.Store(tx, (*fullTextState)(nil))
+	defer func() {
+		fs.fullTextStates.Delete(tx)
+		if ret == nil {
+			ret = tx.Commit()
+		} else {
+			ret = multierror.Append(ret, tx.Rollback())
+		}
+	}()
+
+	return fn(tx)
+}
+
+// Tx gives access to the file system inside a transaction started by Update.
+// All the changes made through a Tx are committed together if the function
+// given to Update succeeds and are all rolled back otherwise.
+// A Tx must not be used once the function given to Update has returned.
+type Tx struct {
+	fs  *FS
+	ctx context.Context
+	tx  *sqlx.Tx
+}
+
+// Update runs fn in a single write transaction.
+// The transaction is committed if fn returns nil and rolled back otherwise.
+func (fs *FS) Update(fn func(tx *Tx) error) error {
+	return fs.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext is Update honouring the ctx cancellation.
+func (fs *FS) UpdateContext(ctx context.Context, fn func(tx *Tx) error) error {
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		return fn(&Tx{fs: fs, ctx: ctx, tx: tx})
+	})
+}
+
+// Open opens the named file as seen from within the transaction,
+// including the changes already made through it.
+func (t *Tx) Open(name string) (iofs.File, error) {
+	return t.fs.openFile(t.ctx, t.tx, name)
+}
+
+// WriteFile inserts or updates the named file as UpsertFile does.
+func (t *Tx) WriteFile(name string, chunkSize int, data []byte, conds ...Precondition) (UpsertStatus, error) {
+	return t.fs.writeFile(t.ctx, t.tx, name, chunkSize, data, conds...)
+}
+
+// Symlink creates link as a symbolic link to target as FS.Symlink does.
+func (t *Tx) Symlink(target, link string) error {
+	return t.fs.symlink(t.ctx, t.tx, target, link)
+}
+
+// Remove deletes the named file or empty directory as DeleteFile does.
+func (t *Tx) Remove(name string, conds ...Precondition) error {
+	return t.fs.deleteFile(t.ctx, t.tx, name, conds...)
+}
+
+// Mkdir creates the named directory. Its parent directory must exist.
+func (t *Tx) Mkdir(name string) error {
+	return t.fs.mkdir(t.ctx, t.tx, name, false)
+}
+
+// MkdirAll creates the named directory along with its missing parents.
+// It does nothing if the directory already exists.
+func (t *Tx) MkdirAll(name string) error {
+	return t.fs.mkdir(t.ctx, t.tx, name, true)
+}
+
+// Rename moves the file or directory oldName to newName.
+// The missing parent directories of newName are created.
+// A regular file already existing at newName is replaced
+// when oldName is a regular file too.
+func (t *Tx) Rename(oldName, newName string) error {
+	return t.fs.rename(t.ctx, t.tx, oldName, newName)
+}
+
+func (fs *FS) mkdir(ctx context.Context, tx *sqlx.Tx, name string, all bool) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+
+	if !all {
+		if dir := path.Dir(name); dir != "." {
+			_, ftype, err := fs.namei(ctx, tx, dir)
+			if err != nil {
+				return fmt.Errorf("cannot find parent directory of %s: %w", name, err)
+			}
+			if ftype != DirectoryType {
+				return fmt.Errorf("%w: %s %s", IncorrectTypeErr, dir, ftype)
+			}
+		}
+	}
+
+	_, created, err := fs.addNode(ctx, tx, name, DirectoryType)
+	if err != nil {
+		return fmt.Errorf("cannot create directory %s: %w", name, err)
+	}
+	if !created && !all {
+		return fmt.Errorf("%w: %s", iofs.ErrExist, name)
+	}
+	return nil
+}
+
+func (fs *FS) rename(ctx context.Context, tx *sqlx.Tx, oldName, newName string) error {
+	oldName, err := cleanPath(oldName)
+	if err != nil {
+		return err
+	}
+	newName, err = cleanPath(newName)
+	if err != nil {
+		return err
+	}
+
+	inode, ftype, err := fs.namei(ctx, tx, oldName)
+	if err != nil {
+		return fmt.Errorf("cannot find inode for %s: %w", oldName, err)
+	}
+	if oldName == newName {
+		return nil
+	}
+	if strings.HasPrefix(newName, oldName+"/") {
+		return fmt.Errorf("%w: cannot move %s inside itself", InvalidPathErr, oldName)
+	}
+
+	_, targetType, err := fs.namei(ctx, tx, newName)
+	switch {
+	case err == nil:
+		if ftype == DirectoryType || targetType == DirectoryType {
+			return fmt.Errorf("%w: %s", iofs.ErrExist, newName)
+		}
+		if err := fs.deleteFile(ctx, tx, newName); err != nil {
+			return fmt.Errorf("cannot replace %s: %w", newName, err)
+		}
+	case !errors.Is(err, InodeNotFoundErr):
+		return err
+	}
+
+	parentInode := fs.rootInode
+	if dir := path.Dir(newName); dir != "." {
+		if parentInode, _, err = fs.addNode(ctx, tx, dir, DirectoryType); err != nil {
+			return fmt.Errorf("cannot create parent directory of %s: %w", newName, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, fs.query(`
+		UPDATE github_dgsb_dbfs_files
+		SET fname = ?, parent = ?, full_path = ?
+		WHERE inode = ?`), path.Base(newName), parentInode, newName, inode); err != nil {
+		return fmt.Errorf("cannot move %s to %s: %w", oldName, newName, err)
+	}
+	if err := fs.bumpGeneration(ctx, tx, inode); err != nil {
+		return err
+	}
+	if err := fs.logChange(ctx, tx, RenameEvent, inode, newName, oldName, ftype); err != nil {
+		return err
+	}
+
+	if ftype == DirectoryType {
+		children, childrenArgs := underDir("full_path", oldName)
+		if _, err := tx.ExecContext(ctx, fs.query(`
+			UPDATE github_dgsb_dbfs_files
+			SET full_path = ? || substr(full_path, ?)
+			WHERE root = ? AND `+children),
+			append([]any{newName, dirLength(oldName) + 1, fs.rootInode}, childrenArgs...)...); err != nil {
+			return fmt.Errorf("cannot move the children of %s: %w", oldName, err)
+		}
+	}
+
+	// the moved files may enter or leave the full text index
+	state, err := fs.fullTextIndexState(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if state.selection != nil && (ftype == RegularFileType || state.selection.matchesFullPath()) {
+		if err := fs.reindexTree(ctx, tx, fs.rootInode, newName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
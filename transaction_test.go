@@ -0,0 +1,109 @@
+package dbfs_test
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Update(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	require.NoError(t, sqliteFS.UpsertFiles(map[string][]byte{
+		"site/v1/index.html": []byte("v1 index"),
+		"site/v1/stale.html": []byte("v1 stale"),
+		"site/current":       []byte("v1"),
+	}, 16))
+
+	// publish a new version of the site
+	require.NoError(t, sqliteFS.Update(func(tx *Tx) error {
+		if err := tx.Mkdir("site/v2"); err != nil {
+			return err
+		}
+		if _, err := tx.WriteFile("site/v2/index.html", 16, []byte("v2 index")); err != nil {
+			return err
+		}
+		if err := tx.Remove("site/v1/stale.html"); err != nil {
+			return err
+		}
+		if err := tx.Rename("site/v1", "archive/v1"); err != nil {
+			return err
+		}
+		if _, err := tx.WriteFile("site/current.new", 16, []byte("v2")); err != nil {
+			return err
+		}
+		if err := tx.Rename("site/current.new", "site/current"); err != nil {
+			return err
+		}
+
+		data, err := fs.ReadFile(tx, "archive/v1/index.html")
+		if err != nil {
+			return err
+		}
+		if string(data) != "v1 index" {
+			return fmt.Errorf("unexpected content %s", data)
+		}
+		return nil
+	}))
+
+	require.NoError(t, fstest.TestFS(sqliteFS, "site/current", "site/v2/index.html", "archive/v1/index.html"))
+	data, err := fs.ReadFile(sqliteFS, "site/current")
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(data))
+	for _, name := range []string{"site/v1", "site/v1/index.html", "site/current.new", "archive/v1/stale.html"} {
+		_, err = fs.Stat(sqliteFS, name)
+		require.ErrorIs(t, err, InodeNotFoundErr, name)
+	}
+
+	// nothing is applied when the function fails
+	err = sqliteFS.Update(func(tx *Tx) error {
+		if _, err := tx.WriteFile("site/v3/index.html", 16, []byte("v3 index")); err != nil {
+			return err
+		}
+		if err := tx.Rename("archive", "site/v2/archive"); err != nil {
+			return err
+		}
+		return tx.Remove("site/v2")
+	})
+	require.ErrorIs(t, err, DirNotEmptyErr)
+	_, err = fs.Stat(sqliteFS, "site/v3")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+	_, err = fs.Stat(sqliteFS, "archive/v1/index.html")
+	require.NoError(t, err)
+
+	require.ErrorIs(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.Mkdir("site/v2")
+	}), fs.ErrExist)
+	require.ErrorIs(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.Mkdir("does/not/exist")
+	}), InodeNotFoundErr)
+	require.ErrorIs(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.Rename("site", "site/inner")
+	}), InvalidPathErr)
+	require.ErrorIs(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.Rename("archive", "site/current")
+	}), fs.ErrExist)
+	require.ErrorIs(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.Remove(".")
+	}), InvalidPathErr)
+
+	require.NoError(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.MkdirAll("empty/directory/tree")
+	}))
+	entries, err := fs.ReadDir(sqliteFS, "empty/directory/tree")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	report, err := sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Problems)
+}
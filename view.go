@@ -0,0 +1,74 @@
+package dbfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ViewClosedErr = fmt.Errorf("view closed")
+
+// ReadView is a read only fs.FS over a single point in time of an FS.
+// All the files opened through a view read the database content
+// as it was when the view has been created, whatever the concurrent
+// updates. A view holds a read transaction until it is closed,
+// taking a connection of the pool like the files opened by FS.Open.
+type ReadView struct {
+	fs  *FS
+	ctx context.Context
+	tx  *sqlx.Tx
+}
+
+// View returns a consistent read only view of the file system.
+func (fs *FS) View() (*ReadView, error) {
+	return fs.ViewContext(context.Background())
+}
+
+// ViewContext is View honouring the ctx cancellation.
+// The files opened through the view issue their queries with ctx.
+func (fs *FS) ViewContext(ctx context.Context) (*ReadView, error) {
+	tx, err := fs.beginHeldRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+
+	// sqlite only takes its snapshot on the first read of the transaction.
+	var count int
+	if err := tx.GetContext(ctx, &count, fs.query("SELECT count(1) FROM github_dgsb_dbfs_files WHERE inode = ?"),
+		fs.rootInode); err != nil {
+		tx.Rollback()
+		fs.releaseConn()
+		return nil, fmt.Errorf("cannot start read snapshot: %w", err)
+	}
+
+	return &ReadView{fs: fs, ctx: ctx, tx: tx}, nil
+}
+
+// Open opens the named file as it was when the view has been created.
+// Closing the returned file does not close the view.
+func (v *ReadView) Open(fname string) (fs.File, error) {
+	if v.tx == nil {
+		return nil, ViewClosedErr
+	}
+	return v.fs.openFile(v.ctx, v.tx, fname)
+}
+
+// Close releases the read transaction of the view.
+// The files opened through the view cannot be read anymore.
+func (v *ReadView) Close() error {
+	if v.tx == nil {
+		return ViewClosedErr
+	}
+	tx := v.tx
+	v.tx = nil
+	err := tx.Rollback()
+	v.fs.releaseConn()
+	if err != nil && !errors.Is(err, sql.ErrTxDone) {
+		return fmt.Errorf("cannot release read transaction: %w", err)
+	}
+	return nil
+}
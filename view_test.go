@@ -0,0 +1,59 @@
+package dbfs_test
+
+import (
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_View(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(path.Join(t.TempDir(), "view.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	require.NoError(t, sqliteFS.UpsertFiles(map[string][]byte{
+		"templates/base.html":  []byte("<html>{{ block }}</html>"),
+		"templates/index.html": []byte("{{ define block }}index{{ end }}"),
+	}, 8))
+
+	view, err := sqliteFS.View()
+	require.NoError(t, err)
+
+	require.NoError(t, sqliteFS.UpsertFiles(map[string][]byte{
+		"templates/base.html":  []byte("<html><body>{{ block }}</body></html>"),
+		"templates/index.html": []byte("{{ define block }}new index{{ end }}"),
+		"templates/about.html": []byte("{{ define block }}about{{ end }}"),
+	}, 8))
+	require.NoError(t, sqliteFS.DeleteFile("templates/index.html"))
+
+	data, err := fs.ReadFile(view, "templates/base.html")
+	require.NoError(t, err)
+	require.Equal(t, "<html>{{ block }}</html>", string(data))
+	data, err = fs.ReadFile(view, "templates/index.html")
+	require.NoError(t, err)
+	require.Equal(t, "{{ define block }}index{{ end }}", string(data))
+	_, err = fs.Stat(view, "templates/about.html")
+	require.ErrorIs(t, err, InodeNotFoundErr)
+	require.NoError(t, fstest.TestFS(view, "templates/base.html", "templates/index.html"))
+
+	require.NoError(t, view.Close())
+	_, err = view.Open("templates/base.html")
+	require.ErrorIs(t, err, ViewClosedErr)
+	require.ErrorIs(t, view.Close(), ViewClosedErr)
+
+	view, err = sqliteFS.View()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, view.Close())
+	})
+	data, err = fs.ReadFile(view, "templates/base.html")
+	require.NoError(t, err)
+	require.Equal(t, "<html><body>{{ block }}</body></html>", string(data))
+	require.NoError(t, fstest.TestFS(view, "templates/base.html", "templates/about.html"))
+}
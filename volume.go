@@ -0,0 +1,181 @@
+package dbfs
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DefaultVolume is the volume of the FS returned by the constructors.
+const DefaultVolume = "default"
+
+var (
+	VolumeNotFoundErr = fmt.Errorf("cannot find volume")
+	VolumeExistsErr   = fmt.Errorf("volume already exists")
+)
+
+// Volume returns the name of the volume of fs.
+func (fs *FS) Volume() string {
+	return fs.volume
+}
+
+// CreateVolume creates the empty volume name in the database of fs.
+// A volume is a file system tree independent from the other volumes
+// of the database: its files, extended attributes, change log, locks, replication and
+// synchronisation state are its own.
+// VolumeExistsErr is returned if the volume already exists.
+func (fs *FS) CreateVolume(name string) error {
+	return fs.CreateVolumeContext(context.Background(), name)
+}
+
+// CreateVolumeContext is CreateVolume honouring the ctx cancellation.
+func (fs *FS) CreateVolumeContext(ctx context.Context, name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid volume name %q", name)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("cannot generate instance identifier: %w", err)
+	}
+
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		var count int
+		if err := tx.GetContext(ctx, &count,
+			fs.query("SELECT count(1) FROM github_dgsb_dbfs_volumes WHERE name = ?"), name); err != nil {
+			return fmt.Errorf("cannot query volumes table: %w", err)
+		}
+		if count > 0 {
+			return fmt.Errorf("%w: %s", VolumeExistsErr, name)
+		}
+
+		var root int
+		if err := tx.GetContext(ctx, &root, fs.query(`
+			INSERT INTO github_dgsb_dbfs_files (fname, type)
+			VALUES ('/', ?)
+			RETURNING inode`), DirectoryType); err != nil {
+			return fmt.Errorf("cannot insert root directory of volume %s: %w", name, err)
+		}
+		if _, err := tx.ExecContext(ctx,
+			fs.query("UPDATE github_dgsb_dbfs_files SET root = inode WHERE inode = ?"), root); err != nil {
+			return fmt.Errorf("cannot update root directory of volume %s: %w", name, err)
+		}
+		if _, err := tx.ExecContext(ctx, fs.query(`
+			INSERT INTO github_dgsb_dbfs_volumes (name, root, instance_id)
+			VALUES (?, ?, ?)`), name, root, hex.EncodeToString(id)); err != nil {
+			return fmt.Errorf("cannot insert volume %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// ListVolumes returns the names of the volumes of the database, sorted.
+func (fs *FS) ListVolumes() ([]string, error) {
+	return fs.ListVolumesContext(context.Background())
+}
+
+// ListVolumesContext is ListVolumes honouring the ctx cancellation.
+func (fs *FS) ListVolumesContext(ctx context.Context) ([]string, error) {
+	names := []string{}
+	if err := fs.db.SelectContext(ctx, &names,
+		fs.query("SELECT name FROM github_dgsb_dbfs_volumes ORDER BY name")); err != nil {
+		return nil, fmt.Errorf("cannot query volumes table: %w", err)
+	}
+	return names, nil
+}
+
+// OpenVolume returns the file system of the volume name.
+// The returned FS shares the database of fs and cannot be used
+// once fs is closed. Closing it does nothing.
+// VolumeNotFoundErr is returned if the volume does not exist.
+func (fs *FS) OpenVolume(name string) (*FS, error) {
+	return fs.OpenVolumeContext(context.Background(), name)
+}
+
+// OpenVolumeContext is OpenVolume honouring the ctx cancellation.
+func (fs *FS) OpenVolumeContext(ctx context.Context, name string) (*FS, error) {
+	root, err := fs.volumeRoot(ctx, fs.db, name)
+	if err != nil {
+		return nil, err
+	}
+
+	volume := &FS{
+		db:             fs.db,
+		dialect:        fs.dialect,
+		tablePrefix:    fs.tablePrefix,
+		chunkSize:      fs.chunkSize,
+		rootInode:      root,
+		volume:         name,
+		readChunksStmt: fs.readChunksStmt,
+		fileSizeStmt:   fs.fileSizeStmt,
+		nameiStmt:      fs.nameiStmt,
+		readOnly:       fs.readOnly,
+		heldConns:      fs.heldConns,
+		shared:         true,
+	}
+	volume.skipChecksums.Store(fs.skipChecksums.Load())
+	return volume, nil
+}
+
+// DeleteVolume deletes the volume name with all its content.
+// The default volume cannot be deleted. The FS opened
+// on the deleted volume must not be used anymore.
+// VolumeNotFoundErr is returned if the volume does not exist.
+func (fs *FS) DeleteVolume(name string) error {
+	return fs.DeleteVolumeContext(context.Background(), name)
+}
+
+// DeleteVolumeContext is DeleteVolume honouring the ctx cancellation.
+func (fs *FS) DeleteVolumeContext(ctx context.Context, name string) error {
+	if name == DefaultVolume {
+		return fmt.Errorf("cannot delete the %s volume", DefaultVolume)
+	}
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		root, err := fs.volumeRoot(ctx, tx, name)
+		if err != nil {
+			return err
+		}
+
+		if err := fs.unindexVolume(ctx, tx, root); err != nil {
+			return err
+		}
+		queries := []string{
+			`DELETE FROM github_dgsb_dbfs_chunks
+			WHERE inode IN (SELECT inode FROM github_dgsb_dbfs_files WHERE root = ?)`,
+			`DELETE FROM github_dgsb_dbfs_hashes
+			WHERE inode IN (SELECT inode FROM github_dgsb_dbfs_files WHERE root = ?)`,
+			`DELETE FROM github_dgsb_dbfs_xattrs
+			WHERE inode IN (SELECT inode FROM github_dgsb_dbfs_files WHERE root = ?)`,
+			"DELETE FROM github_dgsb_dbfs_changes WHERE root = ?",
+			"DELETE FROM github_dgsb_dbfs_locks WHERE root = ?",
+			"DELETE FROM github_dgsb_dbfs_replication WHERE root = ?",
+			"DELETE FROM github_dgsb_dbfs_sync WHERE root = ?",
+			"DELETE FROM github_dgsb_dbfs_volumes WHERE root = ?",
+			"DELETE FROM github_dgsb_dbfs_files WHERE root = ?",
+		}
+		for _, q := range queries {
+			if _, err := tx.ExecContext(ctx, fs.query(q), root); err != nil {
+				return fmt.Errorf("cannot delete volume %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// volumeRoot returns the root inode of the volume name.
+func (fs *FS) volumeRoot(ctx context.Context, db sqlx.QueryerContext, name string) (int, error) {
+	var root int
+	err := sqlx.GetContext(ctx, db, &root,
+		fs.query("SELECT root FROM github_dgsb_dbfs_volumes WHERE name = ?"), name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%w: %s", VolumeNotFoundErr, name)
+	} else if err != nil {
+		return 0, fmt.Errorf("cannot query volume %s: %w", name, err)
+	}
+	return root, nil
+}
@@ -0,0 +1,112 @@
+package dbfs_test
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Volumes(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(path.Join(t.TempDir(), "tenants.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+	require.Equal(t, DefaultVolume, sqliteFS.Volume())
+
+	require.NoError(t, sqliteFS.CreateVolume("alice"))
+	require.NoError(t, sqliteFS.CreateVolume("bob"))
+	require.ErrorIs(t, sqliteFS.CreateVolume("alice"), VolumeExistsErr)
+	require.Error(t, sqliteFS.CreateVolume(""))
+	require.Error(t, sqliteFS.CreateVolume("a/b"))
+	volumes, err := sqliteFS.ListVolumes()
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice", "bob", DefaultVolume}, volumes)
+
+	_, err = sqliteFS.OpenVolume("carol")
+	require.ErrorIs(t, err, VolumeNotFoundErr)
+	alice, err := sqliteFS.OpenVolume("alice")
+	require.NoError(t, err)
+	require.Equal(t, "alice", alice.Volume())
+	bob, err := sqliteFS.OpenVolume("bob")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, bob.Close())
+	})
+
+	require.NoError(t, sqliteFS.UpsertFile("docs/readme.md", 16, []byte("default")))
+	require.NoError(t, alice.UpsertFiles(map[string][]byte{
+		"docs/readme.md": []byte("alice"),
+		"docs/todo.md":   []byte("alice todo"),
+	}, 16))
+	require.NoError(t, bob.UpsertFile("docs/readme.md", 16, []byte("bob")))
+
+	require.Equal(t, map[string][]byte{"docs": nil, "docs/readme.md": []byte("default")}, fsContent(t, sqliteFS))
+	require.Equal(t, map[string][]byte{
+		"docs":           nil,
+		"docs/readme.md": []byte("alice"),
+		"docs/todo.md":   []byte("alice todo"),
+	}, fsContent(t, alice))
+	require.Equal(t, map[string][]byte{"docs": nil, "docs/readme.md": []byte("bob")}, fsContent(t, bob))
+	require.NoError(t, fstest.TestFS(alice, "docs/readme.md", "docs/todo.md"))
+
+	require.NoError(t, alice.Update(func(tx *Tx) error {
+		return tx.Rename("docs", "archive")
+	}))
+	_, err = fs.Stat(alice, "archive/todo.md")
+	require.NoError(t, err)
+	_, err = fs.Stat(bob, "docs/readme.md")
+	require.NoError(t, err)
+	require.NoError(t, bob.DeleteFile("docs/readme.md"))
+	_, err = fs.Stat(alice, "archive/readme.md")
+	require.NoError(t, err)
+
+	_, err = alice.Lock("deploy", "worker-1", time.Minute)
+	require.NoError(t, err)
+	_, err = bob.Lock("deploy", "worker-2", time.Minute)
+	require.NoError(t, err)
+	_, err = sqliteFS.Lock("deploy", "worker-3", time.Minute)
+	require.NoError(t, err)
+
+	changes, err := bob.ChangesSince(0)
+	require.NoError(t, err)
+	require.Len(t, changes.Changes, 3)
+	for _, change := range changes.Changes {
+		require.Contains(t, []string{"docs", "docs/readme.md"}, change.Path)
+	}
+
+	report, err := Sync(bob, alice, SyncOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Conflicts)
+	require.Equal(t, fsContent(t, alice), fsContent(t, bob))
+
+	check, err := sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, check.Clean(), "%v", check.Problems)
+
+	require.Error(t, sqliteFS.DeleteVolume(DefaultVolume))
+	require.ErrorIs(t, sqliteFS.DeleteVolume("carol"), VolumeNotFoundErr)
+	require.NoError(t, alice.Close())
+	require.NoError(t, sqliteFS.DeleteVolume("alice"))
+	volumes, err = sqliteFS.ListVolumes()
+	require.NoError(t, err)
+	require.Equal(t, []string{"bob", DefaultVolume}, volumes)
+	_, err = sqliteFS.OpenVolume("alice")
+	require.ErrorIs(t, err, VolumeNotFoundErr)
+
+	require.Equal(t, map[string][]byte{
+		"archive":           nil,
+		"archive/readme.md": []byte("alice"),
+		"archive/todo.md":   []byte("alice todo"),
+		"docs":              nil,
+	}, fsContent(t, bob))
+	check, err = sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, check.Clean(), "%v", check.Problems)
+}
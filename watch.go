@@ -0,0 +1,310 @@
+package dbfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// EventOp is the kind of change reported by an Event.
+type EventOp string
+
+const (
+	// CreateEvent is reported for a new file or directory.
+	CreateEvent EventOp = "create"
+	// ModifyEvent is reported when the content of a regular file changes.
+	ModifyEvent EventOp = "modify"
+	// DeleteEvent is reported for a removed file or directory.
+	DeleteEvent EventOp = "delete"
+	// RenameEvent is reported when a file or a directory is moved.
+	// The children of a moved directory do not get their own event.
+	RenameEvent EventOp = "rename"
+	// XattrEvent is reported when the extended attributes of a node change.
+	XattrEvent EventOp = "xattr"
+)
+
+// watchInterval is how often a watcher checks the database for new changes.
+const watchInterval = 50 * time.Millisecond
+
+// Event describes a change made to the file system.
+type Event struct {
+	// Seq orders the events in the order their transactions committed.
+	Seq  int64
+	Op   EventOp
+	Path string
+	// OldPath is the path a renamed file had before the move.
+	OldPath string
+	// Type is the type of the changed node, DirectoryType, RegularFileType or SymlinkType.
+	Type string
+	Time time.Time
+
+	// inode is the changed node, it is not known for the changes
+	// logged before the inodes were recorded.
+	inode int
+}
+
+// logChange records a change in the change log.
+// It must be called in the transaction making the change so that
+// the change and its event are committed together.
+func (fs *FS) logChange(ctx context.Context, tx *sqlx.Tx, op EventOp, inode int, fname, oldName, ftype string) error {
+	var oldPath sql.NullString
+	if oldName != "" {
+		oldPath = sql.NullString{String: oldName, Valid: true}
+	}
+	if _, err := tx.ExecContext(ctx, fs.query(`
+		INSERT INTO github_dgsb_dbfs_changes (root, op, inode, path, old_path, type, changed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		fs.rootInode, op, inode, fname, oldPath, ftype, time.Now().UnixMilli()); err != nil {
+		return fmt.Errorf("cannot log %s of %s: %w", op, fname, err)
+	}
+	return nil
+}
+
+// Watch is WatchContext without its error: the returned channel is
+// already closed when the watch cannot start, as when ctx is done.
+func (fs *FS) Watch(ctx context.Context, prefix string) <-chan Event {
+	events, err := fs.WatchContext(ctx, prefix)
+	if err != nil {
+		closed := make(chan Event)
+		close(closed)
+		return closed
+	}
+	return events
+}
+
+// WatchContext delivers the changes made under prefix from now on,
+// by this FS or by any other process sharing the same database:
+// the changes committed once WatchContext has returned are all delivered.
+// An empty prefix or "." watches the whole file system.
+// An error is returned if prefix is invalid or if the watcher cannot
+// read the change log. Otherwise the returned channel is closed when ctx
+// is done or when the database cannot be read anymore. Until then the
+// watcher holds a connection of the pool like the files opened by Open.
+func (fs *FS) WatchContext(ctx context.Context, prefix string) (<-chan Event, error) {
+	w, err := fs.startWatch(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer fs.releaseConn()
+		defer w.conn.Close()
+		fs.watch(ctx, w, events)
+	}()
+	return events, nil
+}
+
+// watcher is the state of a Watch: its connection and the point
+// of the change log it has reached.
+type watcher struct {
+	conn    *sqlx.Conn
+	prefix  string
+	last    int64
+	version int64
+}
+
+// startWatch opens the connection of a watcher and records its starting
+// point before WatchContext returns, so that no later change is missed.
+func (fs *FS) startWatch(ctx context.Context, prefix string) (*watcher, error) {
+	w := &watcher{prefix: prefix}
+	if w.prefix == "" {
+		w.prefix = "."
+	}
+	if w.prefix != "." {
+		var err error
+		if w.prefix, err = cleanPath(w.prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	// sqlite data_version only changes on commits made by other connections
+	// so the watcher needs a connection of its own, on which it never writes.
+	if err := fs.holdConn(ctx); err != nil {
+		return nil, fmt.Errorf("cannot open the watcher connection: %w", err)
+	}
+	conn, err := fs.db.Connx(ctx)
+	if err != nil {
+		fs.releaseConn()
+		return nil, fmt.Errorf("cannot open the watcher connection: %w", err)
+	}
+	// The version is read first: a change committed before the sequence
+	// is read is skipped, a change committed after changes the version.
+	if err := conn.GetContext(ctx, &w.version, fs.query(fs.dialect.changeVersionQuery())); err != nil {
+		conn.Close()
+		fs.releaseConn()
+		return nil, fmt.Errorf("cannot read the change version: %w", err)
+	}
+	if err := conn.GetContext(ctx, &w.last,
+		fs.query("SELECT COALESCE(max(seq), 0) FROM github_dgsb_dbfs_changes")); err != nil {
+		conn.Close()
+		fs.releaseConn()
+		return nil, fmt.Errorf("cannot read the change log: %w", err)
+	}
+	w.conn = conn
+	return w, nil
+}
+
+func (fs *FS) watch(ctx context.Context, w *watcher, events chan<- Event) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var current int64
+		if err := w.conn.GetContext(ctx, &current, fs.query(fs.dialect.changeVersionQuery())); err != nil {
+			return
+		}
+		if current == w.version {
+			continue
+		}
+		w.version = current
+
+		changes, err := fs.readChanges(ctx, w.conn, w.last, -1)
+		if err != nil {
+			return
+		}
+		for _, event := range changes {
+			w.last = event.Seq
+			if !event.concerns(w.prefix) {
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// readChanges returns at most limit logged changes which come after seq.
+// A negative limit returns all of them.
+func (fs *FS) readChanges(ctx context.Context, db sqlx.QueryerContext, seq int64, limit int64) ([]Event, error) {
+	if limit < 0 {
+		limit = math.MaxInt64
+	}
+	rows, err := db.QueryxContext(ctx, fs.query(`
+		SELECT seq, op, COALESCE(inode, 0), path, COALESCE(old_path, ''), type, changed_at
+		FROM github_dgsb_dbfs_changes
+		WHERE root = ? AND seq > ?
+		ORDER BY seq
+		LIMIT ?`), fs.rootInode, seq, limit)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query the change log: %w", err)
+	}
+	defer rows.Close()
+
+	var changes []Event
+	for rows.Next() {
+		var (
+			event     Event
+			changedAt int64
+		)
+		if err := rows.Scan(
+			&event.Seq, &event.Op, &event.inode, &event.Path, &event.OldPath, &event.Type, &changedAt); err != nil {
+			return nil, fmt.Errorf("cannot scan the change log: %w", err)
+		}
+		event.Time = time.UnixMilli(changedAt)
+		changes = append(changes, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over the change log: %w", err)
+	}
+	return changes, nil
+}
+
+// ChangesPrunedErr is returned by ChangesSince when some of the changes
+// following the given sequence number have been deleted by PruneChanges.
+var ChangesPrunedErr = fmt.Errorf("changes have been pruned from the change log")
+
+// PruneChanges deletes the changes of the volume logged before the sequence
+// number before and returns the number of deleted changes. Without pruning,
+// the change log keeps growing with every write.
+//
+// A follower whose Replicator has not read the deleted changes yet cannot
+// catch up anymore: ChangesSince returns ChangesPrunedErr for it and the
+// follower must be rebuilt from a new Snapshot, in an empty file system.
+// The changes should then only be pruned up to the Last sequence number
+// reached by the slowest follower, which is the Last of the first page
+// for a follower still copying the pages of a Snapshot.
+//
+// A watcher misses the events of the changes pruned before it reads them,
+// which it does every 50ms.
+func (fs *FS) PruneChanges(before int64) (int64, error) {
+	return fs.PruneChangesContext(context.Background(), before)
+}
+
+// PruneChangesContext is PruneChanges honouring the ctx cancellation.
+func (fs *FS) PruneChangesContext(ctx context.Context, before int64) (int64, error) {
+	var pruned int64
+	err := fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		// The changes logged later get a greater sequence number
+		// so the horizon cannot go beyond the last logged change.
+		var last int64
+		if err := tx.GetContext(ctx, &last,
+			fs.query("SELECT COALESCE(max(seq), 0) FROM github_dgsb_dbfs_changes")); err != nil {
+			return fmt.Errorf("cannot query the change log: %w", err)
+		}
+		horizon := before - 1
+		if horizon > last {
+			horizon = last
+		}
+
+		result, err := tx.ExecContext(ctx,
+			fs.query("DELETE FROM github_dgsb_dbfs_changes WHERE root = ? AND seq <= ?"), fs.rootInode, horizon)
+		if err != nil {
+			return fmt.Errorf("cannot prune the change log: %w", err)
+		}
+		if pruned, err = result.RowsAffected(); err != nil {
+			return fmt.Errorf("cannot prune the change log: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, fs.query(`
+			UPDATE github_dgsb_dbfs_volumes SET pruned_seq = ?
+			WHERE root = ? AND pruned_seq < ?`), horizon, fs.rootInode, horizon); err != nil {
+			return fmt.Errorf("cannot record the pruned changes: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return pruned, nil
+}
+
+// prunedSeq returns the sequence number of the last change pruned
+// from the change log of the volume.
+func (fs *FS) prunedSeq(ctx context.Context, db sqlx.QueryerContext) (int64, error) {
+	var seq int64
+	if err := sqlx.GetContext(ctx, db, &seq,
+		fs.query("SELECT pruned_seq FROM github_dgsb_dbfs_volumes WHERE root = ?"), fs.rootInode); err != nil {
+		return 0, fmt.Errorf("cannot query the pruned changes: %w", err)
+	}
+	return seq, nil
+}
+
+// concerns reports whether the event changes something under prefix.
+// Moving a directory containing prefix concerns it as well.
+func (e Event) concerns(prefix string) bool {
+	if underPrefix(e.Path, prefix) || underPrefix(e.OldPath, prefix) {
+		return true
+	}
+	return e.Op == RenameEvent && (underPrefix(prefix, e.Path) || underPrefix(prefix, e.OldPath))
+}
+
+// underPrefix reports whether fname is prefix or is inside the directory prefix.
+func underPrefix(fname, prefix string) bool {
+	if fname == "" {
+		return false
+	}
+	return prefix == "." || fname == prefix || strings.HasPrefix(fname, prefix+"/")
+}
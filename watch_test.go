@@ -0,0 +1,135 @@
+package dbfs_test
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Watch(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "watch.db")
+	sqliteFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+	// another handle on the same database stands for another process
+	writerFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, writerFS.Close())
+	})
+
+	require.NoError(t, writerFS.UpsertFile("config/app.yaml", 16, []byte("debug: false")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := sqliteFS.Watch(ctx, "config")
+
+	require.NoError(t, writerFS.UpsertFile("config/app.yaml", 16, []byte("debug: true")))
+	require.NoError(t, writerFS.UpsertFile("config/app.yaml", 16, []byte("debug: true")))
+	require.NoError(t, writerFS.UpsertFile("static/logo.svg", 16, []byte("<svg/>")))
+	require.NoError(t, writerFS.UpsertFile("config/db/primary.yaml", 16, []byte("host: db1")))
+	require.NoError(t, writerFS.Update(func(tx *Tx) error {
+		return tx.Rename("config/db/primary.yaml", "config/db/replica.yaml")
+	}))
+	require.NoError(t, sqliteFS.DeleteFile("config/app.yaml"))
+
+	type change struct {
+		op      EventOp
+		path    string
+		oldPath string
+		ftype   string
+	}
+	expected := []change{
+		{ModifyEvent, "config/app.yaml", "", RegularFileType},
+		{CreateEvent, "config/db", "", DirectoryType},
+		{CreateEvent, "config/db/primary.yaml", "", RegularFileType},
+		{RenameEvent, "config/db/replica.yaml", "config/db/primary.yaml", RegularFileType},
+		{DeleteEvent, "config/app.yaml", "", RegularFileType},
+	}
+	var lastSeq int64
+	for _, want := range expected {
+		select {
+		case event := <-events:
+			require.Equal(t, want, change{event.Op, event.Path, event.OldPath, event.Type})
+			require.Greater(t, event.Seq, lastSeq)
+			require.False(t, event.Time.IsZero())
+			lastSeq = event.Seq
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "missing event", "%v", want)
+		}
+	}
+
+	cancel()
+	select {
+	case event, ok := <-events:
+		require.False(t, ok, "unexpected event %v", event)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "events channel not closed")
+	}
+}
+
+func Test_WatchDirectoryRename(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+	require.NoError(t, sqliteFS.UpsertFile("etc/app/main.conf", 16, []byte("listen 80")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	events := sqliteFS.Watch(ctx, "etc/app/main.conf")
+
+	require.NoError(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.Rename("etc", "old/etc")
+	}))
+	select {
+	case event := <-events:
+		require.Equal(t, RenameEvent, event.Op)
+		require.Equal(t, "old/etc", event.Path)
+		require.Equal(t, "etc", event.OldPath)
+		require.Equal(t, DirectoryType, event.Type)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "missing rename event")
+	}
+}
+
+func Test_WatchStartingPoint(t *testing.T) {
+	dbName := path.Join(t.TempDir(), "start.db")
+	sqliteFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+	writerFS, err := NewSqliteFS(dbName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, writerFS.Close())
+	})
+
+	// a change committed right after Watch returns is delivered
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		events := sqliteFS.Watch(ctx, ".")
+		require.NoError(t, writerFS.UpsertFile("counter", 16, []byte(fmt.Sprint(i))))
+		select {
+		case event := <-events:
+			require.Equal(t, "counter", event.Path)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "missing event", "iteration %d", i)
+		}
+		cancel()
+	}
+
+	_, err = sqliteFS.WatchContext(context.Background(), "../outside")
+	require.ErrorIs(t, err, InvalidPathErr)
+	events := sqliteFS.Watch(context.Background(), "../outside")
+	_, ok := <-events
+	require.False(t, ok)
+}
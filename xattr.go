@@ -0,0 +1,362 @@
+package dbfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var XattrNotFoundErr = fmt.Errorf("cannot find extended attribute")
+
+// SetXattr sets the extended attribute name of the file or directory fname
+// to value. Extended attributes are arbitrary metadata attached to a node:
+// they are kept when the node is renamed or written, copied by Clone,
+// replicated and synchronised. The attributes of a symbolic link are
+// those of the link itself. The root directory has no extended attributes:
+// all the extended attribute functions return InvalidPathErr for ".".
+// The change only happens if all the preconditions hold,
+// a ConflictErr is returned otherwise.
+func (fs *FS) SetXattr(fname, name string, value []byte, conds ...Precondition) error {
+	return fs.SetXattrContext(context.Background(), fname, name, value, conds...)
+}
+
+// SetXattrContext is SetXattr honouring the ctx cancellation.
+func (fs *FS) SetXattrContext(
+	ctx context.Context, fname, name string, value []byte, conds ...Precondition,
+) error {
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		return fs.setXattr(ctx, tx, fname, name, value, conds...)
+	})
+}
+
+// GetXattr returns the value of the extended attribute name of fname.
+// XattrNotFoundErr is returned if fname has no such attribute.
+func (fs *FS) GetXattr(fname, name string) ([]byte, error) {
+	return fs.GetXattrContext(context.Background(), fname, name)
+}
+
+// GetXattrContext is GetXattr honouring the ctx cancellation.
+func (fs *FS) GetXattrContext(ctx context.Context, fname, name string) ([]byte, error) {
+	tx, err := fs.beginRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	return fs.getXattr(ctx, tx, fname, name)
+}
+
+// ListXattr returns the sorted names of the extended attributes of fname.
+func (fs *FS) ListXattr(fname string) ([]string, error) {
+	return fs.ListXattrContext(context.Background(), fname)
+}
+
+// ListXattrContext is ListXattr honouring the ctx cancellation.
+func (fs *FS) ListXattrContext(ctx context.Context, fname string) ([]string, error) {
+	tx, err := fs.beginRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	return fs.listXattr(ctx, tx, fname)
+}
+
+// RemoveXattr removes the extended attribute name of fname.
+// XattrNotFoundErr is returned if fname has no such attribute.
+// The removal only happens if all the preconditions hold,
+// a ConflictErr is returned otherwise.
+func (fs *FS) RemoveXattr(fname, name string, conds ...Precondition) error {
+	return fs.RemoveXattrContext(context.Background(), fname, name, conds...)
+}
+
+// RemoveXattrContext is RemoveXattr honouring the ctx cancellation.
+func (fs *FS) RemoveXattrContext(ctx context.Context, fname, name string, conds ...Precondition) error {
+	return fs.withWriteTx(ctx, func(tx *sqlx.Tx) error {
+		return fs.removeXattr(ctx, tx, fname, name, conds...)
+	})
+}
+
+// SetXattr sets the extended attribute name of fname as FS.SetXattr does.
+func (t *Tx) SetXattr(fname, name string, value []byte, conds ...Precondition) error {
+	return t.fs.setXattr(t.ctx, t.tx, fname, name, value, conds...)
+}
+
+// GetXattr returns the extended attribute name of fname
+// as seen from within the transaction.
+func (t *Tx) GetXattr(fname, name string) ([]byte, error) {
+	return t.fs.getXattr(t.ctx, t.tx, fname, name)
+}
+
+// ListXattr returns the names of the extended attributes of fname
+// as seen from within the transaction.
+func (t *Tx) ListXattr(fname string) ([]string, error) {
+	return t.fs.listXattr(t.ctx, t.tx, fname)
+}
+
+// RemoveXattr removes the extended attribute name of fname as FS.RemoveXattr does.
+func (t *Tx) RemoveXattr(fname, name string, conds ...Precondition) error {
+	return t.fs.removeXattr(t.ctx, t.tx, fname, name, conds...)
+}
+
+func (fs *FS) setXattr(
+	ctx context.Context, tx *sqlx.Tx, fname, name string, value []byte, conds ...Precondition,
+) error {
+	if err := checkXattrName(name); err != nil {
+		return err
+	}
+	fname, err := cleanPath(fname)
+	if err != nil {
+		return err
+	}
+	if err := fs.checkPreconditions(ctx, tx, fname, conds); err != nil {
+		return err
+	}
+	inode, ftype, err := fs.xattrInode(ctx, tx, fname)
+	if err != nil {
+		return err
+	}
+
+	if value == nil {
+		value = []byte{}
+	}
+	if _, err := tx.ExecContext(ctx, fs.query(`
+		INSERT INTO github_dgsb_dbfs_xattrs (inode, name, value)
+		VALUES (?, ?, ?)
+		ON CONFLICT (inode, name) DO UPDATE SET value = excluded.value`),
+		inode, name, value); err != nil {
+		return fmt.Errorf("cannot store extended attribute %s of %s: %w", name, fname, err)
+	}
+	if err := fs.bumpGeneration(ctx, tx, inode); err != nil {
+		return err
+	}
+	return fs.logChange(ctx, tx, XattrEvent, inode, fname, "", ftype)
+}
+
+func (fs *FS) removeXattr(ctx context.Context, tx *sqlx.Tx, fname, name string, conds ...Precondition) error {
+	if err := checkXattrName(name); err != nil {
+		return err
+	}
+	fname, err := cleanPath(fname)
+	if err != nil {
+		return err
+	}
+	if err := fs.checkPreconditions(ctx, tx, fname, conds); err != nil {
+		return err
+	}
+	inode, ftype, err := fs.xattrInode(ctx, tx, fname)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx,
+		fs.query("DELETE FROM github_dgsb_dbfs_xattrs WHERE inode = ? AND name = ?"), inode, name)
+	if err != nil {
+		return fmt.Errorf("cannot delete extended attribute %s of %s: %w", name, fname, err)
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("cannot delete extended attribute %s of %s: %w", name, fname, err)
+	} else if count == 0 {
+		return fmt.Errorf("%w: %s %s", XattrNotFoundErr, fname, name)
+	}
+	if err := fs.bumpGeneration(ctx, tx, inode); err != nil {
+		return err
+	}
+	return fs.logChange(ctx, tx, XattrEvent, inode, fname, "", ftype)
+}
+
+func (fs *FS) getXattr(ctx context.Context, tx *sqlx.Tx, fname, name string) ([]byte, error) {
+	if err := checkXattrName(name); err != nil {
+		return nil, err
+	}
+	fname, err := cleanPath(fname)
+	if err != nil {
+		return nil, err
+	}
+	inode, _, err := fs.xattrInode(ctx, tx, fname)
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	err = tx.GetContext(ctx, &value,
+		fs.query("SELECT value FROM github_dgsb_dbfs_xattrs WHERE inode = ? AND name = ?"), inode, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s %s", XattrNotFoundErr, fname, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot query extended attribute %s of %s: %w", name, fname, err)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+func (fs *FS) listXattr(ctx context.Context, tx *sqlx.Tx, fname string) ([]string, error) {
+	fname, err := cleanPath(fname)
+	if err != nil {
+		return nil, err
+	}
+	inode, _, err := fs.xattrInode(ctx, tx, fname)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	if err := tx.SelectContext(ctx, &names,
+		fs.query("SELECT name FROM github_dgsb_dbfs_xattrs WHERE inode = ? ORDER BY name"), inode); err != nil {
+		return nil, fmt.Errorf("cannot query extended attributes of %s: %w", fname, err)
+	}
+	return names, nil
+}
+
+// xattrInode returns the inode and the type of the node fname,
+// cleaned by cleanPath, whose extended attributes are used.
+func (fs *FS) xattrInode(ctx context.Context, tx *sqlx.Tx, fname string) (int, string, error) {
+	inode, ftype, err := fs.namei(ctx, tx, fname)
+	if err != nil {
+		return 0, "", fmt.Errorf("cannot find inode for %s: %w", fname, err)
+	}
+	return inode, ftype, nil
+}
+
+// checkXattrName validates the name of an extended attribute.
+func checkXattrName(name string) error {
+	if name == "" {
+		return fmt.Errorf("invalid extended attribute name %q", name)
+	}
+	return nil
+}
+
+// readXattrs returns all the extended attributes of inode,
+// nil if the inode does not exist anymore.
+func (fs *FS) readXattrs(ctx context.Context, tx *sqlx.Tx, inode int) (map[string][]byte, error) {
+	var count int
+	if err := tx.GetContext(ctx, &count,
+		fs.query("SELECT count(1) FROM github_dgsb_dbfs_files WHERE inode = ?"), inode); err != nil {
+		return nil, fmt.Errorf("cannot query inode %d: %w", inode, err)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	rows, err := tx.QueryxContext(ctx,
+		fs.query("SELECT name, value FROM github_dgsb_dbfs_xattrs WHERE inode = ?"), inode)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query extended attributes of inode %d: %w", inode, err)
+	}
+	defer rows.Close()
+
+	xattrs := map[string][]byte{}
+	for rows.Next() {
+		var (
+			name  string
+			value []byte
+		)
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf("cannot scan extended attribute of inode %d: %w", inode, err)
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		xattrs[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over extended attributes of inode %d: %w", inode, err)
+	}
+	return xattrs, nil
+}
+
+// volumeXattrs returns the extended attributes of all the nodes of the volume by inode.
+func (fs *FS) volumeXattrs(ctx context.Context, tx *sqlx.Tx) (map[int]map[string][]byte, error) {
+	rows, err := tx.QueryxContext(ctx, fs.query(`
+		SELECT x.inode, x.name, x.value
+		FROM github_dgsb_dbfs_xattrs x JOIN github_dgsb_dbfs_files f ON f.inode = x.inode
+		WHERE f.root = ?`), fs.rootInode)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query extended attributes: %w", err)
+	}
+	defer rows.Close()
+
+	xattrs := map[int]map[string][]byte{}
+	for rows.Next() {
+		var (
+			inode int
+			name  string
+			value []byte
+		)
+		if err := rows.Scan(&inode, &name, &value); err != nil {
+			return nil, fmt.Errorf("cannot scan extended attribute: %w", err)
+		}
+		if xattrs[inode] == nil {
+			xattrs[inode] = map[string][]byte{}
+		}
+		xattrs[inode][name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot iterate over extended attributes: %w", err)
+	}
+	return xattrs, nil
+}
+
+// replaceXattrs makes xattrs the extended attributes of fname.
+// Nothing is changed if fname already has these attributes.
+func (fs *FS) replaceXattrs(ctx context.Context, tx *sqlx.Tx, fname string, xattrs map[string][]byte) error {
+	inode, ftype, err := fs.namei(ctx, tx, fname)
+	if err != nil {
+		return fmt.Errorf("cannot find inode for %s: %w", fname, err)
+	}
+	current, err := fs.readXattrs(ctx, tx, inode)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(xattrsDigest(current), xattrsDigest(xattrs)) {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		fs.query("DELETE FROM github_dgsb_dbfs_xattrs WHERE inode = ?"), inode); err != nil {
+		return fmt.Errorf("cannot delete extended attributes of %s: %w", fname, err)
+	}
+	for name, value := range xattrs {
+		if value == nil {
+			value = []byte{}
+		}
+		if _, err := tx.ExecContext(ctx,
+			fs.query("INSERT INTO github_dgsb_dbfs_xattrs (inode, name, value) VALUES (?, ?, ?)"),
+			inode, name, value); err != nil {
+			return fmt.Errorf("cannot store extended attribute %s of %s: %w", name, fname, err)
+		}
+	}
+	if err := fs.bumpGeneration(ctx, tx, inode); err != nil {
+		return err
+	}
+	return fs.logChange(ctx, tx, XattrEvent, inode, fname, "", ftype)
+}
+
+// xattrsDigest identifies a set of extended attributes.
+// It is nil for an empty set.
+func xattrsDigest(xattrs map[string][]byte) []byte {
+	if len(xattrs) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		for _, field := range [][]byte{[]byte(name), xattrs[name]} {
+			var length [8]byte
+			binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+			h.Write(length[:])
+			h.Write(field)
+		}
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,220 @@
+package dbfs_test
+
+import (
+	"context"
+	"io/fs"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	. "github.com/dgsb/dbfs"
+	"github.com/stretchr/testify/require"
+)
+
+// xattrContent returns the extended attributes of every node of fsys.
+func xattrContent(t *testing.T, fsys *FS) map[string]map[string]string {
+	content := map[string]map[string]string{}
+	require.NoError(t, fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		names, err := fsys.ListXattr(name)
+		if err != nil || len(names) == 0 {
+			return err
+		}
+		content[name] = map[string]string{}
+		for _, xattr := range names {
+			value, err := fsys.GetXattr(name, xattr)
+			if err != nil {
+				return err
+			}
+			content[name][xattr] = string(value)
+		}
+		return nil
+	}))
+	return content
+}
+
+func Test_Xattrs(t *testing.T) {
+	sqliteFS, err := NewSqliteFS(path.Join(t.TempDir(), "xattrs.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqliteFS.Close())
+	})
+
+	require.NoError(t, sqliteFS.UpsertFile("releases/app.tar", 16, []byte("tarball")))
+	require.NoError(t, sqliteFS.Symlink("app.tar", "releases/latest"))
+	require.NoError(t, sqliteFS.SetXattr("releases/app.tar", "owner", []byte("ops")))
+	require.NoError(t, sqliteFS.SetXattr("releases/app.tar", "content-type", []byte("application/x-tar")))
+	require.NoError(t, sqliteFS.SetXattr("releases/app.tar", "commit", nil))
+	require.NoError(t, sqliteFS.SetXattr("releases", "owner", []byte("release-team")))
+	require.NoError(t, sqliteFS.SetXattr("releases/latest", "channel", []byte("stable")))
+	require.Error(t, sqliteFS.SetXattr("releases/app.tar", "", []byte("empty")))
+	require.ErrorIs(t, sqliteFS.SetXattr("missing", "owner", []byte("ops")), InodeNotFoundErr)
+
+	value, err := sqliteFS.GetXattr("releases/app.tar", "owner")
+	require.NoError(t, err)
+	require.Equal(t, "ops", string(value))
+	value, err = sqliteFS.GetXattr("releases/app.tar", "commit")
+	require.NoError(t, err)
+	require.Equal(t, []byte{}, value)
+	_, err = sqliteFS.GetXattr("releases/app.tar", "expires")
+	require.ErrorIs(t, err, XattrNotFoundErr)
+	names, err := sqliteFS.ListXattr("releases/app.tar")
+	require.NoError(t, err)
+	require.Equal(t, []string{"commit", "content-type", "owner"}, names)
+	names, err = sqliteFS.ListXattr("releases/latest")
+	require.NoError(t, err)
+	require.Equal(t, []string{"channel"}, names)
+	for _, fname := range []string{".", "/releases", "../releases"} {
+		_, err = sqliteFS.ListXattr(fname)
+		require.ErrorIs(t, err, InvalidPathErr, fname)
+		_, err = sqliteFS.GetXattr(fname, "owner")
+		require.ErrorIs(t, err, InvalidPathErr, fname)
+		require.ErrorIs(t, sqliteFS.SetXattr(fname, "owner", []byte("ops")), InvalidPathErr, fname)
+		require.ErrorIs(t, sqliteFS.RemoveXattr(fname, "owner"), InvalidPathErr, fname)
+	}
+	_, err = sqliteFS.GetXattr("releases/app.tar", "")
+	require.Error(t, err)
+	require.Error(t, sqliteFS.RemoveXattr("releases/app.tar", ""))
+
+	// extended attributes are part of the generation of a node
+	info, err := fs.Stat(sqliteFS, "releases/app.tar")
+	require.NoError(t, err)
+	generation := info.Sys().(SysInfo).Generation
+	require.NoError(t, sqliteFS.SetXattr("releases/app.tar", "owner", []byte("dev"), IfMatch(generation)))
+	require.ErrorIs(t,
+		sqliteFS.SetXattr("releases/app.tar", "owner", []byte("lost"), IfMatch(generation)), ConflictErr)
+	require.ErrorIs(t, sqliteFS.RemoveXattr("releases/app.tar", "commit", IfMatch(generation)), ConflictErr)
+	require.NoError(t, sqliteFS.RemoveXattr("releases/app.tar", "commit"))
+	require.ErrorIs(t, sqliteFS.RemoveXattr("releases/app.tar", "commit"), XattrNotFoundErr)
+
+	// they follow the node when it is written or moved
+	require.NoError(t, sqliteFS.UpsertFile("releases/app.tar", 16, []byte("tarball v2")))
+	require.NoError(t, sqliteFS.Update(func(tx *Tx) error {
+		if err := tx.Rename("releases/app.tar", "releases/app-v2.tar"); err != nil {
+			return err
+		}
+		if err := tx.SetXattr("releases/app-v2.tar", "expires", []byte("2030-01-01")); err != nil {
+			return err
+		}
+		value, err := tx.GetXattr("releases/app-v2.tar", "expires")
+		if err != nil {
+			return err
+		}
+		require.Equal(t, "2030-01-01", string(value))
+		names, err := tx.ListXattr("releases/app-v2.tar")
+		require.Equal(t, []string{"content-type", "expires", "owner"}, names)
+		return err
+	}))
+	require.NoError(t, sqliteFS.Clone("releases", "archive"))
+	expected := map[string]map[string]string{
+		"releases": {"owner": "release-team"},
+		"releases/app-v2.tar": {
+			"owner": "dev", "content-type": "application/x-tar", "expires": "2030-01-01",
+		},
+		"releases/latest": {"channel": "stable"},
+		"archive":         {"owner": "release-team"},
+		"archive/app-v2.tar": {
+			"owner": "dev", "content-type": "application/x-tar", "expires": "2030-01-01",
+		},
+		"archive/latest": {"channel": "stable"},
+	}
+	require.Equal(t, expected, xattrContent(t, sqliteFS))
+
+	require.NoError(t, sqliteFS.Update(func(tx *Tx) error {
+		return tx.RemoveXattr("archive/latest", "channel")
+	}))
+	delete(expected, "archive/latest")
+	require.NoError(t, sqliteFS.DeleteFile("archive/app-v2.tar"))
+	delete(expected, "archive/app-v2.tar")
+	require.Equal(t, expected, xattrContent(t, sqliteFS))
+
+	set, err := sqliteFS.ChangesSince(0)
+	require.NoError(t, err)
+	var xattrEvents int
+	for _, change := range set.Changes {
+		if change.Op == XattrEvent {
+			xattrEvents++
+		}
+	}
+	require.Equal(t, 9, xattrEvents)
+
+	replica, err := NewSqliteFS(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, replica.Close())
+	})
+	server := httptest.NewServer(sqliteFS.ChangeFeedHandler())
+	t.Cleanup(server.Close)
+	replicator := NewReplicator("primary", NewHTTPChangeSource(server.URL, server.Client()), replica)
+	_, err = replicator.CatchUp(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, expected, xattrContent(t, replica))
+
+	require.NoError(t, sqliteFS.SetXattr("archive", "owner", []byte("archivist")))
+	require.NoError(t, sqliteFS.RemoveXattr("releases/latest", "channel"))
+	expected["archive"]["owner"] = "archivist"
+	delete(expected, "releases/latest")
+	_, err = replicator.CatchUp(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, expected, xattrContent(t, replica))
+
+	report, err := sqliteFS.Check(context.Background(), CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Problems)
+}
+
+func Test_XattrsSync(t *testing.T) {
+	dir := t.TempDir()
+	server, err := NewSqliteFS(path.Join(dir, "server.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, server.Close())
+	})
+	laptop, err := NewSqliteFS(path.Join(dir, "laptop.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, laptop.Close())
+	})
+
+	require.NoError(t, server.UpsertFile("survey/site-a.csv", 16, []byte("lat,lon\n")))
+	require.NoError(t, server.SetXattr("survey/site-a.csv", "owner", []byte("alice")))
+	require.NoError(t, server.SetXattr("survey", "project", []byte("coast")))
+	report, err := Sync(laptop, server, SyncOptions{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"survey", "survey/site-a.csv"}, report.ToA)
+	require.Equal(t, xattrContent(t, server), xattrContent(t, laptop))
+
+	// a change of the attributes only is synchronised
+	require.NoError(t, laptop.SetXattr("survey/site-a.csv", "reviewed", []byte("yes")))
+	require.NoError(t, server.RemoveXattr("survey", "project"))
+	report, err = Sync(laptop, server, SyncOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Conflicts)
+	require.Equal(t, []string{"survey"}, report.ToA)
+	require.Equal(t, []string{"survey/site-a.csv"}, report.ToB)
+	require.Equal(t, map[string]map[string]string{
+		"survey/site-a.csv": {"owner": "alice", "reviewed": "yes"},
+	}, xattrContent(t, server))
+	require.Equal(t, xattrContent(t, server), xattrContent(t, laptop))
+
+	report, err = Sync(server, laptop, SyncOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.ToA)
+	require.Empty(t, report.ToB)
+	require.Empty(t, report.Conflicts)
+
+	// concurrent changes of the attributes conflict
+	require.NoError(t, laptop.SetXattr("survey/site-a.csv", "owner", []byte("bob")))
+	require.NoError(t, server.SetXattr("survey/site-a.csv", "owner", []byte("carol")))
+	report, err = Sync(laptop, server, SyncOptions{Resolve: func(Conflict) (Resolution, error) {
+		return UseB, nil
+	}})
+	require.NoError(t, err)
+	require.Len(t, report.Conflicts, 1)
+	value, err := laptop.GetXattr("survey/site-a.csv", "owner")
+	require.NoError(t, err)
+	require.Equal(t, "carol", string(value))
+	require.Equal(t, fsContent(t, server), fsContent(t, laptop))
+}